@@ -0,0 +1,623 @@
+// Package client is a Go client for servers built on package connection. A
+// Client reconnects with jittered exponential backoff when its connection
+// drops, resumes the server session if the server keeps sessions (see
+// connection.WithSessions) or re-joins its groups if not, and then writes the
+// messages queued while it was away:
+//
+//	c, err := client.Dial(ctx, "wss://example.com/ws",
+//	    client.WithHandler(func(c *client.Client, f connection.Frame) { ... }),
+//	    client.WithStateHandler(func(s client.State, err error) { log.Println(s, err) }),
+//	)
+//	c.Join("room-1")
+//	c.Send(connection.NewEnvelope("chat", "hello"))
+//
+// It speaks the server's protocols for it: it answers pings, acks reliable
+// messages and drops their retransmits, counts frames for session resume and
+// matches Call replies to their requests by id.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// Envelope types of the server's control frames; see package connection.
+const (
+	sessionType = "session"
+	resyncType  = "resync"
+	deliverType = "deliver"
+	ackType     = "ack"
+	cancelType  = "cancel"
+	helloType   = "hello"
+)
+
+var (
+	// ErrClosed is returned for work given to a Client after Close, or after it
+	// stopped reconnecting.
+	ErrClosed = errors.New("client: closed")
+
+	// ErrQueueFull is returned by Send when the outbound queue is full,
+	// typically because the client has been reconnecting for a while.
+	ErrQueueFull = errors.New("client: outbound queue full")
+
+	// ErrRefused is what a Client stops with when the server answers an
+	// upgrade with a 4xx status other than 408 or 429: retrying the same
+	// request will not change its mind.
+	ErrRefused = errors.New("client: upgrade refused")
+)
+
+// State is where a Client is in its connection's life.
+type State int
+
+const (
+	Connecting   State = iota // dialing for the first time
+	Connected                 // connected and flushing the queue
+	Reconnecting              // the connection dropped; dialing again
+	Closed                    // closed, or gave up reconnecting; see Client.Err
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Handler receives the frames the server sends, other than the control frames
+// the Client handles itself. A reliable message arrives as its payload, once,
+// however often the server retransmitted it.
+type Handler func(c *Client, f connection.Frame)
+
+// Client is a WebSocket connection to a connection.Registry that outlives the
+// socket under it: when the socket drops, the Client dials again, resumes its
+// session if the server keeps sessions, re-joins its groups if not, and writes
+// whatever was queued meanwhile. Its methods are safe to call from multiple
+// goroutines.
+type Client struct {
+	url string
+	cfg config
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the client has stopped for good
+
+	// wake has room for one value, sent whenever the queue grows, so an idle
+	// writer notices without polling.
+	wake chan struct{}
+
+	mu        sync.Mutex
+	state     State
+	err       error              // why the client stopped
+	queue     []connection.Frame // outbound, oldest first
+	groups    map[string]bool
+	token     string // the session's, once the server has sent one
+	seq       uint64 // data frames received in the session
+	delivered uint64 // the last reliable seq handed to the handler; per session, as seq
+	calls     map[string]chan connection.Envelope
+	nextID    uint64
+}
+
+// sessionInfo is the data of the server's session frame.
+type sessionInfo struct {
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed"`
+}
+
+// Dial connects to the WebSocket endpoint at rawURL, retrying with backoff
+// until it connects, ctx ends or the server refuses outright. The returned
+// Client keeps reconnecting, without ctx, until Close. It panics if opts leave
+// an invalid setting.
+func Dial(ctx context.Context, rawURL string, opts ...Option) (*Client, error) {
+	if _, err := url.Parse(rawURL); err != nil {
+		return nil, err
+	}
+	c := &Client{
+		url:    rawURL,
+		cfg:    defaultConfig().resolve(opts...),
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+		groups: make(map[string]bool),
+		calls:  make(map[string]chan connection.Envelope),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	ws, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+	go c.run(ws)
+	return c, nil
+}
+
+// State returns the client's current State.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Done is closed once the client has stopped for good: closed, or given up
+// reconnecting.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the client stopped: ErrClosed after Close, or the error it
+// gave up reconnecting on. It is nil while the client is running.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close sends the server a normal Close frame and stops the client. Messages
+// still queued are dropped.
+func (c *Client) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+// Send queues msg for the server, as a binary frame if it implements
+// message.Binary and as text otherwise. It does not wait for the write: a
+// message queued while the client is reconnecting goes out once it has. A
+// message whose write failed is written again on the next connection, so the
+// server may see it twice.
+func (c *Client) Send(msg message.IMessage) error {
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	if message.IsBinary(msg) {
+		return c.enqueue(connection.BinaryFrame(data))
+	}
+	return c.enqueue(connection.TextFrame(data))
+}
+
+// Join asks the server to add the client to group, by sending the join
+// message (see WithGroupMessages), and remembers the group so the client joins
+// it again on a connection whose session did not carry it over. The server's
+// join must therefore be idempotent, as Registry.AddToGroup is.
+func (c *Client) Join(group string) error {
+	c.mu.Lock()
+	c.groups[group] = true
+	c.mu.Unlock()
+	return c.Send(c.cfg.join(group))
+}
+
+// Leave sends the leave message for group and forgets it.
+func (c *Client) Leave(group string) error {
+	c.mu.Lock()
+	delete(c.groups, group)
+	c.mu.Unlock()
+	return c.Send(c.cfg.leave(group))
+}
+
+// Groups returns the groups the client has joined, in no particular order.
+func (c *Client) Groups() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	groups := make([]string, 0, len(c.groups))
+	for g := range c.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Call sends a request envelope of type typ carrying data to a Router and
+// waits for the answer with the same id: its data, or the *connection.Error of
+// an error frame. If ctx ends first, Call sends a cancel frame and returns
+// ctx's error. An answer sent while the client was reconnecting may be lost,
+// so ctx should have a deadline.
+func (c *Client) Call(ctx context.Context, typ string, data any) (json.RawMessage, error) {
+	env := connection.Envelope{Type: typ}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		env.Data = raw
+	}
+
+	answer := make(chan connection.Envelope, 1)
+	c.mu.Lock()
+	c.nextID++
+	env.ID = "c" + strconv.FormatUint(c.nextID, 10)
+	c.calls[env.ID] = answer
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, env.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.sendEnvelope(env); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-answer:
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		return reply.Data, nil
+	case <-ctx.Done():
+		c.sendEnvelope(connection.Envelope{Type: cancelType, ID: env.ID})
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+func (c *Client) sendEnvelope(env connection.Envelope) error {
+	// Cannot fail: Data is already JSON.
+	data, _ := json.Marshal(env)
+	return c.enqueue(connection.TextFrame(data))
+}
+
+func (c *Client) enqueue(f connection.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.state == Closed:
+		return ErrClosed
+	case len(c.queue) >= c.cfg.queueSize:
+		return ErrQueueFull
+	}
+	c.queue = append(c.queue, f)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *Client) setState(s State, err error) {
+	c.mu.Lock()
+	if c.state == s {
+		c.mu.Unlock()
+		return
+	}
+	c.state = s
+	if s == Closed {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.cfg.onState(s, err)
+}
+
+// run serves connections, reconnecting after each, until the client is
+// closed or gives up.
+func (c *Client) run(ws *websocket.Conn) {
+	defer close(c.done)
+	for {
+		err := c.serve(ws)
+		if c.ctx.Err() != nil {
+			c.setState(Closed, ErrClosed)
+			return
+		}
+		// A session taken over by another connection would only be taken
+		// back, and back again, by reconnecting.
+		if websocket.IsCloseError(err, connection.CloseSessionTakenOver) {
+			c.setState(Closed, err)
+			return
+		}
+		c.setState(Reconnecting, err)
+		if ws, err = c.connect(c.ctx); err != nil {
+			if c.ctx.Err() != nil {
+				err = ErrClosed
+			}
+			c.setState(Closed, err)
+			return
+		}
+	}
+}
+
+// connect dials until it succeeds, ctx ends, the server refuses or the
+// attempts run out.
+func (c *Client) connect(ctx context.Context) (*websocket.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		ws, resp, err := c.cfg.dialer.DialContext(ctx, c.dialURL(), c.cfg.header())
+		if err == nil {
+			return ws, nil
+		}
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w: %s", ErrRefused, resp.Status)
+		}
+		if c.cfg.maxAttempts > 0 && attempt+1 >= c.cfg.maxAttempts {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.cfg.backoff(attempt)):
+		}
+	}
+}
+
+// dialURL is the endpoint, with the session to resume if there is one.
+func (c *Client) dialURL() string {
+	c.mu.Lock()
+	token, seq := c.token, c.seq
+	c.mu.Unlock()
+	if token == "" {
+		return c.url
+	}
+	u, _ := url.Parse(c.url) // parsed once already by Dial
+	q := u.Query()
+	q.Set("resume", token)
+	q.Set("last_seq", strconv.FormatUint(seq, 10))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// link is one socket's worth of a Client.
+type link struct {
+	ws       *websocket.Conn
+	control  chan connection.Frame // acks, written ahead of the queue
+	welcome  chan bool             // the session frame's resumed flag
+	readDone chan struct{}         // closed when the read loop ends
+	readErr  error                 // why it ended; set before readDone closes
+}
+
+// serve runs one connection until it fails or the client is closed, and
+// returns why it ended.
+func (c *Client) serve(ws *websocket.Conn) (err error) {
+	l := &link{
+		ws:       ws,
+		control:  make(chan connection.Frame, 64),
+		welcome:  make(chan bool, 1),
+		readDone: make(chan struct{}),
+	}
+	c.mu.Lock()
+	expectWelcome := c.token != ""
+	if !expectWelcome {
+		c.delivered = 0 // a new connection without a session starts over
+	}
+	c.mu.Unlock()
+
+	go func() {
+		l.readErr = c.read(l)
+		close(l.readDone)
+	}()
+	defer func() {
+		ws.Close()
+		<-l.readDone
+		// The read loop's error says more than a failed write: it carries
+		// the peer's close code.
+		var ce *websocket.CloseError
+		if errors.As(l.readErr, &ce) || err == nil {
+			err = l.readErr
+		}
+	}()
+
+	// A connection that resumed its session got its groups back; any other
+	// has to ask for them again, ahead of what was queued.
+	resumed := false
+	if expectWelcome {
+		select {
+		case resumed = <-l.welcome:
+			if !resumed {
+				c.cfg.onResync()
+			}
+		case <-l.readDone:
+			return nil
+		case <-c.ctx.Done():
+			l.goodbye(c.cfg.writeWait)
+			return ErrClosed
+		case <-time.After(c.cfg.writeWait):
+			// The server no longer keeps sessions.
+			c.mu.Lock()
+			c.token, c.seq, c.delivered = "", 0, 0
+			c.mu.Unlock()
+		}
+	}
+	if !resumed {
+		c.rejoin()
+	}
+	c.setState(Connected, nil)
+	return c.write(l)
+}
+
+// rejoin puts a join message for every group at the head of the queue.
+func (c *Client) rejoin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	joins := make([]connection.Frame, 0, len(c.groups))
+	for g := range c.groups {
+		data, err := c.cfg.join(g).Serialize()
+		if err != nil {
+			continue
+		}
+		joins = append(joins, connection.TextFrame(data))
+	}
+	c.queue = append(joins, c.queue...)
+}
+
+// write writes control frames and the queue until a write fails, the read
+// loop ends or the client is closed. A queued frame leaves the queue only once
+// written, so one whose write failed is written again on the next connection.
+func (c *Client) write(l *link) error {
+	for {
+		select {
+		case f := <-l.control:
+			if err := l.send(f, c.cfg.writeWait); err != nil {
+				return err
+			}
+			continue
+		case <-c.ctx.Done():
+			l.goodbye(c.cfg.writeWait)
+			return ErrClosed
+		default:
+		}
+
+		c.mu.Lock()
+		var next *connection.Frame
+		if len(c.queue) > 0 {
+			next = &c.queue[0]
+		}
+		c.mu.Unlock()
+
+		if next == nil {
+			select {
+			case f := <-l.control:
+				if err := l.send(f, c.cfg.writeWait); err != nil {
+					return err
+				}
+			case <-c.wake:
+			case <-l.readDone:
+				return nil
+			case <-c.ctx.Done():
+				l.goodbye(c.cfg.writeWait)
+				return ErrClosed
+			}
+			continue
+		}
+		if err := l.send(*next, c.cfg.writeWait); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+	}
+}
+
+func (l *link) send(f connection.Frame, wait time.Duration) error {
+	l.ws.SetWriteDeadline(time.Now().Add(wait))
+	return l.ws.WriteMessage(f.Type, f.Data)
+}
+
+// goodbye tells the server the client is leaving on purpose.
+func (l *link) goodbye(wait time.Duration) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	l.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wait))
+}
+
+// read hands inbound frames to the handler, and handles the control frames
+// itself, until the connection fails.
+func (c *Client) read(l *link) error {
+	l.ws.SetPingHandler(func(data string) error {
+		l.ws.SetReadDeadline(time.Now().Add(c.cfg.readTimeout))
+		err := l.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.cfg.writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	for {
+		l.ws.SetReadDeadline(time.Now().Add(c.cfg.readTimeout))
+		typ, data, err := l.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		f := connection.Frame{Type: typ, Data: data}
+		var env connection.Envelope
+		if typ != websocket.TextMessage || json.Unmarshal(data, &env) != nil {
+			c.count()
+			c.cfg.handler(c, f)
+			continue
+		}
+
+		switch env.Type {
+		case sessionType:
+			var info sessionInfo
+			json.Unmarshal(env.Data, &info)
+			c.mu.Lock()
+			if !info.Resumed {
+				c.seq, c.delivered = 0, 0
+			}
+			c.token = info.Token
+			c.mu.Unlock()
+			select {
+			case l.welcome <- info.Resumed:
+			default:
+			}
+			continue
+		case resyncType:
+			c.cfg.onResync()
+			continue
+		}
+
+		if !codecSwitched(env) {
+			c.count()
+		}
+		if env.ID != "" && c.answer(env) {
+			continue
+		}
+		if env.Type == deliverType {
+			// Acks are cumulative, so acking a duplicate again is harmless
+			// and covers an ack the server never got. A replay after a
+			// resume is a duplicate like any other.
+			c.mu.Lock()
+			fresh := env.Seq > c.delivered
+			if fresh {
+				c.delivered = env.Seq
+			}
+			delivered := c.delivered
+			c.mu.Unlock()
+			ack, _ := json.Marshal(connection.Envelope{Type: ackType, Seq: delivered})
+			select {
+			case l.control <- connection.TextFrame(ack):
+			default: // the next ack covers this one
+			}
+			if fresh {
+				c.cfg.handler(c, connection.TextFrame(env.Data))
+			}
+			continue
+		}
+		c.cfg.handler(c, f)
+	}
+}
+
+// count records one more data frame received in the session.
+func (c *Client) count() {
+	c.mu.Lock()
+	c.seq++
+	c.mu.Unlock()
+}
+
+// codecSwitched reports whether env is the server's answer to a codec switch,
+// a control frame like the session and resync frames, which the session does
+// not count either. An application's own hello route answers with the
+// request's id, or with other data.
+func codecSwitched(env connection.Envelope) bool {
+	var hello struct {
+		Codec string `json:"codec"`
+	}
+	return env.Type == helloType && env.ID == "" &&
+		json.Unmarshal(env.Data, &hello) == nil && hello.Codec != ""
+}
+
+// answer passes env to the Call waiting on its id, and reports whether there
+// was one.
+func (c *Client) answer(env connection.Envelope) bool {
+	c.mu.Lock()
+	ch, ok := c.calls[env.ID]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- env:
+		default: // already answered
+		}
+	}
+	return ok
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// Defaults for the settings an Option can change. The read timeout and queue
+// size match the server's default pong wait and send buffer.
+const (
+	defaultMinBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+	defaultQueueSize   = 256
+	defaultReadTimeout = 60 * time.Second
+	defaultWriteWait   = 10 * time.Second
+)
+
+// Option configures a Client. As in package connection, an invalid value is a
+// programming error, so Dial panics on it.
+type Option func(*config)
+
+type config struct {
+	dialer      *websocket.Dialer
+	header      func() http.Header
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int // 0 for no limit
+	queueSize   int
+	readTimeout time.Duration
+	writeWait   time.Duration
+
+	handler  Handler
+	onState  func(State, error)
+	onResync func()
+
+	join, leave func(group string) message.IMessage
+}
+
+func defaultConfig() config {
+	return config{
+		dialer:      websocket.DefaultDialer,
+		header:      func() http.Header { return nil },
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		queueSize:   defaultQueueSize,
+		readTimeout: defaultReadTimeout,
+		writeWait:   defaultWriteWait,
+		handler:     func(*Client, connection.Frame) {},
+		onState:     func(State, error) {},
+		onResync:    func() {},
+		join:        groupMessage("join"),
+		leave:       groupMessage("leave"),
+	}
+}
+
+// groupMessage returns the default join or leave message: a Router envelope of
+// type typ carrying {"group": ...}.
+func groupMessage(typ string) func(string) message.IMessage {
+	return func(group string) message.IMessage {
+		return connection.NewEnvelope(typ, map[string]string{"group": group})
+	}
+}
+
+// WithHandler sets the function inbound frames are passed to. It is called on
+// the client's read goroutine, one frame at a time, so a slow handler slows
+// reading; hand long work off.
+func WithHandler(h Handler) Option {
+	return func(c *config) { c.handler = h }
+}
+
+// WithStateHandler sets a function called on every State change. err is what
+// ended the previous connection, or failed the last dial, and is nil on
+// Connected.
+func WithStateHandler(f func(s State, err error)) Option {
+	return func(c *config) { c.onState = f }
+}
+
+// WithResyncHandler sets a function called when the server says the client
+// missed frames it can no longer replay - a resync frame, or a session that
+// expired while the client was away. The application should refetch whatever
+// state it keeps.
+func WithResyncHandler(f func()) Option {
+	return func(c *config) { c.onResync = f }
+}
+
+// WithDialer dials with d instead of websocket.DefaultDialer.
+func WithDialer(d *websocket.Dialer) Option {
+	return func(c *config) { c.dialer = d }
+}
+
+// WithHeader sends h with every upgrade request.
+func WithHeader(h http.Header) Option {
+	return WithHeaderFunc(func() http.Header { return h })
+}
+
+// WithHeaderFunc calls f before every dial for the upgrade request's headers,
+// so a reconnect can carry a freshly issued token.
+func WithHeaderFunc(f func() http.Header) Option {
+	return func(c *config) { c.header = f }
+}
+
+// WithBackoff sets the bounds of the wait between reconnect attempts. The
+// wait doubles from min with each failed attempt up to max, and is randomized
+// between half and all of that so clients dropped together do not return
+// together.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *config) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// WithMaxAttempts gives up after n consecutive failed dials. The default of
+// zero never gives up.
+func WithMaxAttempts(n int) Option {
+	return func(c *config) { c.maxAttempts = n }
+}
+
+// WithQueueSize sets how many outbound messages may wait to be written,
+// including while the client is reconnecting. Send fails with ErrQueueFull
+// beyond that.
+func WithQueueSize(n int) Option {
+	return func(c *config) { c.queueSize = n }
+}
+
+// WithReadTimeout sets how long the client waits for any frame, pings
+// included, before it counts the connection as dead and reconnects. It must
+// be longer than the server's ping interval.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *config) { c.readTimeout = d }
+}
+
+// WithWriteWait bounds each write to the socket.
+func WithWriteWait(d time.Duration) Option {
+	return func(c *config) { c.writeWait = d }
+}
+
+// WithGroupMessages sets the messages Join and Leave send. The defaults are
+// the envelopes {"type": "join", "data": {"group": ...}} and its "leave"
+// counterpart, for a Router with routes of those types.
+func WithGroupMessages(join, leave func(group string) message.IMessage) Option {
+	return func(c *config) { c.join, c.leave = join, leave }
+}
+
+func (c config) resolve(opts ...Option) config {
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if err := c.validate(); err != nil {
+		panic("client: " + err.Error())
+	}
+	return c
+}
+
+func (c config) validate() error {
+	switch {
+	case c.dialer == nil || c.header == nil || c.handler == nil || c.onState == nil || c.onResync == nil:
+		return fmt.Errorf("dialer, header func and handlers must not be nil")
+	case c.join == nil || c.leave == nil:
+		return fmt.Errorf("group messages must not be nil")
+	case c.minBackoff <= 0 || c.maxBackoff < c.minBackoff:
+		return fmt.Errorf("backoff must satisfy 0 < min <= max, got min=%v max=%v", c.minBackoff, c.maxBackoff)
+	case c.maxAttempts < 0:
+		return fmt.Errorf("max attempts must not be negative, got %d", c.maxAttempts)
+	case c.queueSize <= 0:
+		return fmt.Errorf("queue size must be positive, got %d", c.queueSize)
+	case c.readTimeout <= 0:
+		return fmt.Errorf("read timeout must be positive, got %v", c.readTimeout)
+	case c.writeWait <= 0:
+		return fmt.Errorf("write wait must be positive, got %v", c.writeWait)
+	}
+	return nil
+}
+
+// backoff returns how long to wait after the nth consecutive failed dial,
+// counting from 0.
+func (c config) backoff(n int) time.Duration {
+	d := c.maxBackoff
+	if n < 32 {
+		if exp := c.minBackoff << n; exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
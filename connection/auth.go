@@ -0,0 +1,84 @@
+package connection
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Principal is who a connection was authenticated as.
+type Principal struct {
+	UserID string
+	Roles  []string
+	Claims map[string]any // everything the credential asserted, as decoded
+
+	// ExpiresAt, if set, is when the credential lapses; the connection is
+	// closed then.
+	ExpiresAt time.Time
+
+	// Subprotocol, if set, is the Sec-WebSocket-Protocol the upgrade answers
+	// with. An Authenticator that read the credential from that header sets it
+	// to the protocol the client offered alongside, since a browser fails a
+	// handshake whose answer names none of its offers.
+	Subprotocol string
+}
+
+// HasRole reports whether p was granted role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator decides who an upgrade request is from, before it is
+// upgraded. An error rejects the request with 401 Unauthorized.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(req *http.Request) (*Principal, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*Principal, error) {
+	return f(req)
+}
+
+// authenticate runs a, if set, on req. It answers the request itself and
+// returns ok false if a rejects it.
+func authenticate(a Authenticator, logger *slog.Logger, w http.ResponseWriter, req *http.Request) (p *Principal, ok bool) {
+	if a == nil {
+		return nil, true
+	}
+	p, err := a.Authenticate(req)
+	if err != nil || p == nil {
+		logger.Info("Upgrade rejected: not authenticated", slog.String(LogRemoteAddr, req.RemoteAddr), slog.Any(LogError, err))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	return p, true
+}
+
+// Principal returns who the connection was authenticated as, or nil if its
+// handler has no Authenticator.
+func (c *Connection) Principal() *Principal {
+	return c.principal
+}
+
+// expireWith closes c when its principal's credential lapses. The returned
+// stop cancels that; it is a no-op if the credential never lapses.
+func (c *Connection) expireWith(p *Principal) (stop func() bool) {
+	if p == nil || p.ExpiresAt.IsZero() {
+		return func() bool { return false }
+	}
+	t := time.AfterFunc(time.Until(p.ExpiresAt), func() {
+		c.logger().Info("Credential expired; closing connection")
+		c.noteClose(CloseInfo{Code: CloseCredentialExpired, Reason: "credential expired"})
+		c.CloseConnection()
+	})
+	return t.Stop
+}
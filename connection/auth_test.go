@@ -0,0 +1,144 @@
+package connection
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+var testSecret = []byte("test secret")
+
+func hmacToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// authServer serves a capturing handler behind opts and returns its URL.
+func authServer(t *testing.T, opts ...Option) (url string, conns chan *Connection) {
+	t.Helper()
+	r := NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	h := &captureHandler{conns: make(chan *Connection, 1)}
+	srv := httptest.NewServer(r.RegisterHandler(h, opts...))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), h.conns
+}
+
+// accepted dials with dialer and header, and returns the server side of the
+// connection and the subprotocol the upgrade answered with.
+func accepted(t *testing.T, dialer *websocket.Dialer, url string, header http.Header, conns chan *Connection) (*Connection, string) {
+	t.Helper()
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	select {
+	case conn := <-conns:
+		return conn, ws.Subprotocol()
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler never saw the connection")
+		return nil, ""
+	}
+}
+
+func TestJWTFromEachSource(t *testing.T) {
+	token := hmacToken(t, jwt.MapClaims{"sub": "alice", "roles": []string{"admin"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+	cases := []struct {
+		name     string
+		source   TokenSource
+		header   http.Header
+		query    string
+		protocol []string
+	}{
+		{"header", FromHeader(), http.Header{"Authorization": {"Bearer " + token}}, "", nil},
+		{"cookie", FromCookie("session"), http.Header{"Cookie": {"session=" + token}}, "", nil},
+		{"query", FromQuery("token"), nil, "?token=" + token, nil},
+		{"protocol", FromProtocol("access_token"), nil, "", []string{"access_token", token}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			url, conns := authServer(t, WithAuthenticator(JWTHMAC(testSecret, tc.source)))
+			dialer := &websocket.Dialer{Subprotocols: tc.protocol}
+
+			conn, protocol := accepted(t, dialer, url+tc.query, tc.header, conns)
+			p := conn.Principal()
+			if p == nil || p.UserID != "alice" || !p.HasRole("admin") || p.ExpiresAt.IsZero() {
+				t.Fatalf("got principal %+v, want alice, an admin, with an expiry", p)
+			}
+			if tc.protocol != nil && protocol != "access_token" {
+				t.Fatalf("upgrade answered protocol %q, want the marker", protocol)
+			}
+		})
+	}
+}
+
+func TestJWTRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, conns := authServer(t, WithAuthenticator(JWTRS256(&key.PublicKey)))
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "bob"}).SignedString(key)
+	conn, _ := accepted(t, websocket.DefaultDialer, url, http.Header{"Authorization": {"Bearer " + token}}, conns)
+	if p := conn.Principal(); p == nil || p.UserID != "bob" {
+		t.Fatalf("got principal %+v, want bob", p)
+	}
+
+	// An HMAC token must not pass as RS256, whatever key it claims.
+	forged := hmacToken(t, jwt.MapClaims{"sub": "bob"})
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + forged}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("HS256 token: got %v, want 401", err)
+	}
+}
+
+func TestUnauthenticatedUpgradeIsRejected(t *testing.T) {
+	url, _ := authServer(t, WithAuthenticator(JWTHMAC(testSecret)))
+
+	cases := map[string]http.Header{
+		"no token":      nil,
+		"bad signature": {"Authorization": {"Bearer " + hmacToken(t, jwt.MapClaims{"sub": "a"})[:20] + "x"}},
+		"expired":       {"Authorization": {"Bearer " + hmacToken(t, jwt.MapClaims{"sub": "a", "exp": time.Now().Add(-time.Minute).Unix()})}},
+		"no subject":    {"Authorization": {"Bearer " + hmacToken(t, jwt.MapClaims{"name": "a"})}},
+	}
+	for name, header := range cases {
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: got %v, want a 401 before the upgrade", name, err)
+		}
+	}
+}
+
+func TestConnectionClosesWhenCredentialExpires(t *testing.T) {
+	auth := AuthenticatorFunc(func(*http.Request) (*Principal, error) {
+		return &Principal{UserID: "alice", ExpiresAt: time.Now().Add(100 * time.Millisecond)}, nil
+	})
+	url, conns := authServer(t, WithAuthenticator(auth))
+	conn, _ := accepted(t, websocket.DefaultDialer, url, nil, conns)
+
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection outlived its credential")
+	}
+}
@@ -0,0 +1,211 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// Backplane carries a Registry's broadcasts to the Registries of the other
+// replicas of a service, so that a group spans every replica its members are
+// connected to. Payloads are opaque to it. Every Registry sharing a backplane
+// receives everything published on it, its own messages included; the
+// Registry recognizes and drops those itself.
+//
+// The Redis pub/sub implementation is in package
+// github.com/gclluch/go-rtc-lib/redisbackplane; MemoryBackplane connects
+// Registries within one process.
+type Backplane interface {
+	// Publish sends payload to every subscriber.
+	Publish(ctx context.Context, payload []byte) error
+
+	// Subscribe starts calling deliver with every payload published from now
+	// on, in order, from a goroutine of its own. It returns once the
+	// subscription is in place, and delivery stops when ctx ends.
+	Subscribe(ctx context.Context, deliver func(payload []byte)) error
+}
+
+// What a backplane message asks the receiving Registry to do.
+const (
+	remoteBroadcast   = "broadcast"
+	remotePresence    = "presence"
+	remoteDeleteGroup = "delete_group"
+	remoteSendTo      = "send_to"
+	remoteSendToUser  = "send_to_user"
+)
+
+// remoteMessage is the payload a Registry publishes.
+type remoteMessage struct {
+	Origin string `json:"origin"` // the publishing Registry's node ID
+	Kind   string `json:"kind"`
+	Group  string `json:"group,omitempty"`
+	Target string `json:"target,omitempty"` // a connection or user ID
+	Type   int    `json:"frame_type,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	NoCompress bool             `json:"no_compress,omitempty"`
+	Key        string           `json:"key,omitempty"` // see message.Keyed
+	Priority   message.Priority `json:"priority,omitempty"`
+
+	// Encodings is Data in each codec the publisher's handlers negotiate, by
+	// codec name; see WithCodecs.
+	Encodings map[string][]byte `json:"encodings,omitempty"`
+}
+
+// backplaneRetry is how long a Registry waits before subscribing again after
+// the backplane refused.
+const backplaneRetry = time.Second
+
+// backplaneOutbox is how many messages a Registry holds for publishing. The
+// backplane is written from one goroutine, never under the registry lock; if
+// it falls this far behind, further messages are dropped for the other
+// replicas rather than stalling this one.
+const backplaneOutbox = 1024
+
+// subscribe subscribes r to its backplane, retrying until it succeeds or ctx
+// ends.
+func (r *Registry) subscribe(ctx context.Context) {
+	for {
+		err := r.cfg.backplane.Subscribe(ctx, r.deliverRemote)
+		if err == nil {
+			return
+		}
+		r.cfg.log().Error("Backplane subscribe failed; retrying", slog.Any(LogError, err), slog.Duration("retry_in", backplaneRetry))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backplaneRetry):
+		}
+	}
+}
+
+// publish queues m for the other replicas, if there is a backplane. It never
+// blocks, so it is safe under r.mu.
+func (r *Registry) publish(m remoteMessage) {
+	if r.cfg.backplane == nil {
+		return
+	}
+	m.Origin = r.node
+	select {
+	case r.outbox <- m:
+	default:
+		r.cfg.log().Warn("Backplane is not keeping up; message not published", slog.String("kind", m.Kind), slog.String(LogGroup, m.Group))
+	}
+}
+
+// publishLoop publishes queued messages in order until ctx ends. Each publish
+// is bounded by the write wait, as a socket write is.
+func (r *Registry) publishLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-r.outbox:
+			// Cannot fail: every field is a plain value.
+			payload, _ := json.Marshal(m)
+			pubCtx, cancel := context.WithTimeout(ctx, r.cfg.writeWait)
+			if err := r.cfg.backplane.Publish(pubCtx, payload); err != nil {
+				r.cfg.log().Error("Backplane publish failed", slog.String("kind", m.Kind), slog.Any(LogError, err))
+			}
+			cancel()
+		}
+	}
+}
+
+// deliverRemote applies a message another replica published to this
+// replica's connections. r's own messages are dropped: they were delivered
+// locally before they were published.
+func (r *Registry) deliverRemote(payload []byte) {
+	var m remoteMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		r.cfg.log().Warn("Backplane message dropped: undecodable", slog.Any(LogError, err))
+		return
+	}
+	if m.Origin == r.node {
+		return
+	}
+
+	f := Frame{Type: m.Type, Data: m.Data, noCompress: m.NoCompress, key: m.Key, priority: m.Priority}
+	set := &frameSet{base: f, encoded: m.Encodings}
+	switch m.Kind {
+	case remoteBroadcast:
+		// A group with no members on this replica is not an error here.
+		r.fanOut(set, m.Group)
+	case remotePresence:
+		var env struct {
+			Data presenceEvent `json:"data"`
+		}
+		r.mu.Lock()
+		if json.Unmarshal(m.Data, &env) == nil {
+			r.applyRemotePresence(m.Group, m.Origin, env.Data)
+		}
+		r.queueToGroup(f, m.Group)
+		r.mu.Unlock()
+	case remoteDeleteGroup:
+		r.deleteGroup(m.Group)
+	case remoteSendTo:
+		if conn, ok := r.Connection(m.Target); ok {
+			// Cannot fail: a remote set encodes nothing.
+			f, _ := set.frame(conn.Codec())
+			conn.queue(f)
+		}
+	case remoteSendToUser:
+		r.sendToUser(m.Target, set)
+	}
+}
+
+// MemoryBackplane is a Backplane within a single process: every Registry given
+// it shares broadcasts and groups with the others. It is meant for tests and
+// for trying out multi-replica behavior locally. Publish delivers to every
+// subscriber before it returns, in the publisher's goroutine.
+type MemoryBackplane struct {
+	mu   sync.Mutex
+	subs map[*memorySub]bool
+}
+
+type memorySub struct {
+	ctx     context.Context
+	deliver func([]byte)
+}
+
+// NewMemoryBackplane returns a MemoryBackplane with no subscribers.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subs: make(map[*memorySub]bool)}
+}
+
+// Publish delivers payload to every current subscriber.
+func (b *MemoryBackplane) Publish(ctx context.Context, payload []byte) error {
+	b.mu.Lock()
+	subs := make([]*memorySub, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.ctx.Err() == nil {
+			sub.deliver(payload)
+		}
+	}
+	return ctx.Err()
+}
+
+// Subscribe adds deliver as a subscriber until ctx ends.
+func (b *MemoryBackplane) Subscribe(ctx context.Context, deliver func([]byte)) error {
+	sub := &memorySub{ctx: ctx, deliver: deliver}
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}()
+	return nil
+}
@@ -0,0 +1,138 @@
+package connection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// replicas starts n registries sharing one MemoryBackplane and waits until
+// each is subscribed.
+func replicas(t *testing.T, n int) []*Registry {
+	t.Helper()
+	b := NewMemoryBackplane()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	rs := make([]*Registry, n)
+	for i := range rs {
+		rs[i] = NewRegistry(WithBackplane(b))
+		go rs[i].Run(ctx)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		subscribed := len(b.subs)
+		b.mu.Unlock()
+		if subscribed == n {
+			return rs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d replicas subscribed", subscribed, n)
+		}
+	}
+}
+
+// next reads the next frame queued on conn.
+func next(t *testing.T, conn *Connection) Frame {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		if f, ok := conn.out.pop(); ok {
+			return f
+		}
+		select {
+		case <-conn.out.ready:
+		case <-deadline:
+			t.Fatal("nothing was queued")
+			return Frame{}
+		}
+	}
+}
+
+func TestBroadcastSpansReplicasExactlyOnce(t *testing.T) {
+	rs := replicas(t, 2)
+	here, there := registered(rs[0]), registered(rs[1])
+	rs[0].AddToGroup("room", here)
+	rs[1].AddToGroup("room", there)
+
+	rs[0].Broadcast(&message.ByteMessage{Data: []byte{1, 2}}, "room")
+	for _, conn := range []*Connection{here, there} {
+		if f := next(t, conn); !f.IsBinary() || string(f.Data) != "\x01\x02" {
+			t.Fatalf("got %+v, want the binary frame", f)
+		}
+	}
+
+	// The publishing replica drops its own message when the backplane hands
+	// it back, so a second copy never arrives.
+	rs[0].BroadcastToAll(message.NewJSONMessage("marker"))
+	for _, conn := range []*Connection{here, there} {
+		if f := next(t, conn); string(f.Data) != `"marker"` {
+			t.Fatalf("got %s, want the marker and no duplicate before it", f.Data)
+		}
+	}
+}
+
+// A group only needs members on some replica for a broadcast to it from any
+// other to arrive.
+func TestBroadcastToGroupWithMembersElsewhere(t *testing.T) {
+	rs := replicas(t, 2)
+	there := registered(rs[1])
+	rs[1].AddToGroup("room", there)
+
+	rs[0].Broadcast(message.NewJSONMessage("hi"), "room")
+	if f := next(t, there); string(f.Data) != `"hi"` {
+		t.Fatalf("got %s, want hi", f.Data)
+	}
+}
+
+func TestDeleteGroupAndPresenceSpanReplicas(t *testing.T) {
+	rs := replicas(t, 2)
+	here, there := registered(rs[0]), registered(rs[1])
+	rs[0].AddToGroup("room", here)
+	rs[1].AddToGroup("room", there)
+
+	rs[0].SetPresence("room", here, "alice", nil)
+	if ev := nextPresence(t, there); ev.Event != PresenceJoin || ev.Key != "alice" {
+		t.Fatalf("got %+v, want alice's join on the other replica", ev)
+	}
+
+	rs[0].DeleteGroup("room")
+	select {
+	case <-there.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the other replica's member of the deleted group was left open")
+	}
+}
+
+// Presence answers for every replica: a key present on one is listed on the
+// others until it leaves.
+func TestPresenceSpansReplicas(t *testing.T) {
+	rs := replicas(t, 2)
+	here, there := registered(rs[0]), registered(rs[1])
+	rs[0].AddToGroup("room", here)
+	rs[1].AddToGroup("room", there)
+
+	rs[0].SetPresence("room", here, "alice", map[string]string{"status": "away"})
+	rs[1].SetPresence("room", there, "bob", nil)
+	// Each replica has both joins once its member has been sent both.
+	for _, conn := range []*Connection{here, there} {
+		nextPresence(t, conn)
+		nextPresence(t, conn)
+	}
+	for i, r := range rs {
+		got := r.Presence("room")
+		if len(got) != 2 || got[0].Key != "alice" || string(got[0].Meta) != `{"status":"away"}` || got[1].Key != "bob" {
+			t.Fatalf("replica %d: got %+v, want alice, away, and bob", i, got)
+		}
+	}
+
+	rs[0].RemoveFromGroup("room", here)
+	if ev := nextPresence(t, there); ev.Event != PresenceLeave || ev.Key != "alice" {
+		t.Fatalf("got %+v, want alice's leave", ev)
+	}
+	if got := rs[1].Presence("room"); len(got) != 1 || got[0].Key != "bob" {
+		t.Fatalf("after the leave: got %+v, want bob only", got)
+	}
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -19,10 +20,9 @@ func TestBroadcastClosesAConnectionThatStoppedDraining(t *testing.T) {
 	r.connections[conn] = true
 	r.mu.Unlock()
 
-	// Nobody reads Send, so fill it to capacity and the next send has nowhere
-	// to go - exactly the state a wedged peer leaves behind.
-	for len(conn.Send) < cap(conn.Send) {
-		conn.Send <- []byte("backlog")
+	// Nobody reads the queue, so fill it to capacity and the next send has
+	// nowhere to go - exactly the state a wedged peer leaves behind.
+	for conn.out.push(TextFrame([]byte("backlog"))) {
 	}
 
 	r.Broadcast(message.NewJSONMessage("one too many"), "")
@@ -36,3 +36,144 @@ func TestBroadcastClosesAConnectionThatStoppedDraining(t *testing.T) {
 			"would sit stale with no error anywhere")
 	}
 }
+
+// member registers a connection on r's own settings, so it shares r's
+// slow-consumer counters, with a queue of two frames already full.
+func member(t *testing.T, r *Registry, group string) *Connection {
+	t.Helper()
+	conn := newConnection(nil, nil, r.cfg.resolve(WithSendBuffer(2)))
+	r.mu.Lock()
+	r.connections[conn] = true
+	r.mu.Unlock()
+	if group != "" {
+		r.AddToGroup(group, conn)
+	}
+	conn.out.push(TextFrame([]byte("1")))
+	conn.out.push(TextFrame([]byte("2")))
+	return conn
+}
+
+// queued empties conn's queue and returns what was in it.
+func queued(conn *Connection) string {
+	var got []string
+	for f, ok := conn.out.pop(); ok; f, ok = conn.out.pop() {
+		got = append(got, string(f.Data))
+	}
+	return strings.Join(got, ",")
+}
+
+// closed reports whether conn closes within the close-frame grace and then
+// some.
+func closed(conn *Connection) bool {
+	select {
+	case <-conn.done:
+		return true
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy SlowConsumerPolicy
+		queued string
+		stats  SlowConsumerStats
+	}{
+		{CloseSlowConsumer, "", SlowConsumerStats{Closed: 1}},
+		{DropNewest, "1,2", SlowConsumerStats{DroppedNewest: 1}},
+		{DropOldest, "2,3", SlowConsumerStats{DroppedOldest: 1}},
+		{Conflate, "3", SlowConsumerStats{Conflated: 2}},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			r := NewRegistry(WithSlowConsumerPolicy(tc.policy), WithNopLogger())
+			conn := member(t, r, "")
+			say(r, "", "3")
+
+			if tc.policy == CloseSlowConsumer {
+				if !closed(conn) {
+					t.Fatal("the connection was left open")
+				}
+			} else {
+				if got := queued(conn); got != tc.queued {
+					t.Fatalf("queue holds %s, want %s", got, tc.queued)
+				}
+				if conn.CloseInfo().SlowConsumer {
+					t.Fatal("the connection was closed")
+				}
+			}
+			if got := r.SlowConsumerStats(); got != tc.stats {
+				t.Fatalf("stats %+v, want %+v", got, tc.stats)
+			}
+		})
+	}
+}
+
+func TestConflationKeepsControlFrames(t *testing.T) {
+	r := NewRegistry(WithSlowConsumerPolicy(Conflate))
+	conn := member(t, r, "")
+	conn.out.pop() // 1
+	resync := controlFrame(resyncType, nil)
+	resync.priority = message.PriorityNormal // in the lane being conflated
+	conn.out.push(resync)
+
+	say(r, "", "3")
+	if got := queued(conn); got != `{"type":"resync"},3` {
+		t.Fatalf("queue holds %s, want the resync kept ahead of 3", got)
+	}
+}
+
+func TestGroupSlowConsumerPolicyOverridesTheRegistrys(t *testing.T) {
+	r := NewRegistry(WithNopLogger())
+	r.SetGroupSlowConsumerPolicy("ticks", Conflate)
+	conn := member(t, r, "ticks")
+
+	say(r, "ticks", "3")
+	if got := queued(conn); got != "3" {
+		t.Fatalf("queue holds %s, want the group's broadcast conflated", got)
+	}
+
+	// Anything else takes the Registry's policy, and closes the connection.
+	conn.out.push(TextFrame([]byte("1")))
+	conn.out.push(TextFrame([]byte("2")))
+	say(r, "", "3")
+	if !closed(conn) {
+		t.Fatal("a broadcast to everyone left the connection open")
+	}
+	if got := r.SlowConsumerStats(); got != (SlowConsumerStats{Conflated: 2, Closed: 1}) {
+		t.Fatalf("stats %+v", got)
+	}
+
+	r.DeleteGroup("ticks")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.slowPolicy("ticks") != nil {
+		t.Fatal("a deleted group's policy was kept")
+	}
+}
+
+func TestBlockingPolicyWaitsThenCloses(t *testing.T) {
+	r := NewRegistry(WithSlowConsumerPolicy(BlockFor(time.Second)), WithNopLogger())
+	conn := member(t, r, "")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.out.pop()
+	}()
+	say(r, "", "3")
+	if got := queued(conn); got != "2,3" {
+		t.Fatalf("queue holds %s, want 3 queued once there was room", got)
+	}
+
+	r = NewRegistry(WithSlowConsumerPolicy(BlockFor(20*time.Millisecond)), WithNopLogger())
+	conn = member(t, r, "")
+	start := time.Now()
+	say(r, "", "3")
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("gave up after %v, want the full timeout", elapsed)
+	}
+	if !closed(conn) {
+		t.Fatal("a connection that never made room was left open")
+	}
+	if got := r.SlowConsumerStats(); got != (SlowConsumerStats{Blocked: 1, TimedOut: 1, Closed: 1}) {
+		t.Fatalf("stats %+v", got)
+	}
+}
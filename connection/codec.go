@@ -0,0 +1,229 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// ErrUnknownCodec is returned by SetCodec for a codec the connection's
+// handler was not configured with; see WithCodecs.
+var ErrUnknownCodec = errors.New("connection: unknown codec")
+
+// helloType is the envelope type a client sends, with {"codec": name} as its
+// data, to switch codec, and the server sends back once it has. A Router only
+// treats it as such for a handler with codecs; see WithCodecs.
+const helloType = "hello"
+
+// CodeUnknownCodec is the code a Router answers a hello for an unknown codec
+// with.
+const CodeUnknownCodec = "unknown_codec"
+
+type helloData struct {
+	Codec string `json:"codec"`
+}
+
+// codecBox lets a message.Codec, whatever its concrete type, sit behind an
+// atomic pointer.
+type codecBox struct {
+	message.Codec
+}
+
+// Codec returns the codec c negotiated, or nil if it negotiated none and gets
+// each message in the message's own format.
+func (c *Connection) Codec() message.Codec {
+	if b := c.codec.Load(); b != nil {
+		return b.Codec
+	}
+	return nil
+}
+
+// SetCodec switches c to the codec called name, one of those WithCodecs gave
+// its handler, for a client that negotiates with a message rather than a
+// subprotocol. A Router does it for the client's hello envelope. It queues a
+// hello envelope, {"type": "hello", "data": {"codec": name}}, as a text frame;
+// every frame after that one is in the new codec.
+func (c *Connection) SetCodec(name string) error {
+	codec := c.cfg.codec(name)
+	if codec == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	// Cannot fail: the data is a plain struct.
+	hello, _ := json.Marshal(outEnvelope{Type: helloType, Data: helloData{Codec: name}})
+	f := TextFrame(hello)
+	f.control = true
+	f.switchTo = codec
+	c.codec.Store(&codecBox{codec})
+	return c.queue(f)
+}
+
+// useCodec puts c on codec from the start, for a codec negotiated as the
+// subprotocol.
+func (c *Connection) useCodec(codec message.Codec) {
+	c.codec.Store(&codecBox{codec})
+	c.wire = codec
+}
+
+// negotiateCodec returns the first subprotocol req offers that names one of
+// cfg's codecs, or nil.
+func (cfg config) negotiateCodec(req *http.Request) message.Codec {
+	for _, protocol := range websocket.Subprotocols(req) {
+		if codec := cfg.codec(protocol); codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+// codec returns cfg's codec called name, or nil.
+func (cfg config) codec(name string) message.Codec {
+	for _, codec := range cfg.codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// sameCodec reports whether a and b are the same codec, nil being a message's
+// own format. Codecs are compared by name, since a Codec need not be
+// comparable.
+func sameCodec(a, b message.Codec) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Name() == b.Name()
+}
+
+// encodedAs returns f carrying data, f.msg encoded with codec.
+func (f Frame) encodedAs(codec message.Codec, data []byte) Frame {
+	binary := message.IsBinary(f.msg)
+	if codec != nil {
+		binary = codec.Binary()
+	}
+	f.Type = websocket.TextMessage
+	if binary {
+		f.Type = websocket.BinaryMessage
+	}
+	f.Data = data
+	f.codec = codec
+	f.prepared = nil
+	return f
+}
+
+// frameSet is one outbound message in each encoding its recipients need: the
+// message's own, and the codec each negotiated. A codec's frame is encoded on
+// first use, so the message is serialized once per codec among the
+// recipients rather than once per recipient. A frameSet is used by one
+// goroutine.
+type frameSet struct {
+	base    Frame
+	encoded map[string][]byte // by codec name
+}
+
+func newFrameSet(msg message.IMessage) (*frameSet, error) {
+	f, err := newFrame(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &frameSet{base: f, encoded: make(map[string][]byte)}, nil
+}
+
+// frame returns the frame for a connection on codec. A message no codec can
+// encode, and one that arrived over the backplane without an encoding in
+// codec, goes out in its own format.
+func (s *frameSet) frame(codec message.Codec) (Frame, error) {
+	if codec == nil {
+		return s.base, nil
+	}
+	data, ok := s.encoded[codec.Name()]
+	if !ok {
+		if s.base.msg == nil {
+			return s.base, nil
+		}
+		if s.base.msg.Type() == codec.Name() {
+			data = s.base.Data // in that format already
+		} else {
+			var err error
+			if data, err = message.Encode(s.base.msg, codec); err != nil {
+				return Frame{}, err
+			}
+		}
+		s.encoded[codec.Name()] = data
+	}
+	return s.base.encodedAs(codec, data), nil
+}
+
+// codecBatch is the recipients of a broadcast that share a codec.
+type codecBatch struct {
+	codec message.Codec
+	conns []*Connection
+}
+
+// byCodec groups conns by the codec each negotiated.
+func byCodec(conns []*Connection) []codecBatch {
+	var batches []codecBatch
+	index := make(map[string]int)
+	for _, conn := range conns {
+		codec := conn.Codec()
+		name := ""
+		if codec != nil {
+			name = codec.Name()
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(batches)
+			index[name] = i
+			batches = append(batches, codecBatch{codec: codec})
+		}
+		batches[i].conns = append(batches[i].conns, conn)
+	}
+	return batches
+}
+
+// remote fills in m's payload from s: the message's own format, and its
+// encoding in each codec r's handlers negotiate, so other replicas can serve
+// their connections without the message itself.
+func (r *Registry) remote(m remoteMessage, s *frameSet) remoteMessage {
+	m.Type, m.Data, m.NoCompress, m.Key, m.Priority = s.base.Type, s.base.Data, s.base.noCompress, s.base.key, s.base.priority
+	if s.base.msg == nil {
+		return m
+	}
+	for _, codec := range r.knownCodecs() {
+		f, err := s.frame(codec)
+		if err != nil {
+			r.cfg.log().Error("Encoding message for the backplane failed", slog.String("codec", codec.Name()), slog.Any(LogError, err))
+			continue
+		}
+		if m.Encodings == nil {
+			m.Encodings = make(map[string][]byte)
+		}
+		m.Encodings[codec.Name()] = f.Data
+	}
+	return m
+}
+
+// addCodecs records the codecs cfg negotiates, for remote.
+func (r *Registry) addCodecs(cfg config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, codec := range cfg.codecs {
+		r.codecs[codec.Name()] = codec
+	}
+}
+
+// knownCodecs returns every codec a handler of r negotiates.
+func (r *Registry) knownCodecs() []message.Codec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	codecs := make([]message.Codec, 0, len(r.codecs))
+	for _, codec := range r.codecs {
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
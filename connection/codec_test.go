@@ -0,0 +1,209 @@
+package connection
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type tick struct {
+	Symbol string  `json:"symbol" msgpack:"symbol"`
+	Price  float64 `json:"price" msgpack:"price"`
+}
+
+// countingCodec is message.Msgpack counting its Marshal calls.
+type countingCodec struct {
+	message.Codec
+	marshals *atomic.Int32
+}
+
+func (c countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshals.Add(1)
+	return c.Codec.Marshal(v)
+}
+
+// countingMessage is a JSONMessage counting its Serialize calls.
+type countingMessage struct {
+	*message.JSONMessage
+	serializes *atomic.Int32
+}
+
+func (m countingMessage) Serialize() ([]byte, error) {
+	m.serializes.Add(1)
+	return m.JSONMessage.Serialize()
+}
+
+func TestBroadcastSerializesOncePerCodec(t *testing.T) {
+	var marshals, serializes atomic.Int32
+	codec := countingCodec{message.Msgpack, &marshals}
+	r := NewRegistry()
+	native := []*Connection{registered(r), registered(r), registered(r)}
+	for _, conn := range native {
+		conn.useCodec(codec)
+	}
+	web := []*Connection{registered(r), registered(r)}
+
+	r.BroadcastToAll(countingMessage{message.NewJSONMessage(tick{"ACME", 12.5}), &serializes})
+	if serializes.Load() != 1 || marshals.Load() != 1 {
+		t.Fatalf("%d serializes and %d marshals, want one of each", serializes.Load(), marshals.Load())
+	}
+	for _, conn := range web {
+		if f := next(t, conn); f.IsBinary() || string(f.Data) != `{"symbol":"ACME","price":12.5}` {
+			t.Fatalf("web client got %q, want the message's own JSON", f.Data)
+		}
+	}
+	var got tick
+	for _, conn := range native {
+		f := next(t, conn)
+		if !f.IsBinary() {
+			t.Fatal("native client got a text frame")
+		}
+		if err := msgpack.Unmarshal(f.Data, &got); err != nil || got != (tick{"ACME", 12.5}) {
+			t.Fatalf("native client got %v, %v", got, err)
+		}
+	}
+
+	// A message no codec can encode goes to everyone as it is.
+	r.BroadcastToAll(&message.ByteMessage{Data: []byte{1, 2}})
+	if f := next(t, native[0]); f.codec != nil || string(f.Data) != "\x01\x02" {
+		t.Fatalf("native client got %q, want the bytes as sent", f.Data)
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	r := NewRegistry(WithCodecs(message.Msgpack, message.JSON), WithNopLogger())
+	joined := make(chan struct{}, 2)
+	r.Hooks.OnConnect = func(c *Connection) {
+		r.AddToGroup("ticks", c)
+		joined <- struct{}{}
+	}
+	url := serveHandler(t, r, NewRouter())
+
+	dial := func(protocols ...string) *websocket.Conn {
+		t.Helper()
+		dialer := websocket.Dialer{Subprotocols: protocols}
+		ws, resp, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		if len(protocols) > 0 && resp.Header.Get("Sec-Websocket-Protocol") != "msgpack" {
+			t.Fatalf("negotiated %q, want msgpack", resp.Header.Get("Sec-Websocket-Protocol"))
+		}
+		return ws
+	}
+	bySubprotocol := dial("v2.example", "msgpack")
+	byHello := dial()
+	byHello.WriteJSON(map[string]any{"type": "hello", "data": map[string]string{"codec": "cbor"}})
+	var env Envelope
+	if err := byHello.ReadJSON(&env); err != nil || env.Type != errorType || env.Error.Code != CodeUnknownCodec {
+		t.Fatalf("got %+v, %v: want an unknown_codec error", env, err)
+	}
+	byHello.WriteJSON(map[string]any{"type": "hello", "data": "msgpack"})
+	env = Envelope{}
+	if err := byHello.ReadJSON(&env); err != nil || env.Type != errorType || env.Error.Code != CodeBadRequest {
+		t.Fatalf("got %+v, %v: want a bad_request error", env, err)
+	}
+	byHello.WriteJSON(map[string]any{"type": "hello", "data": map[string]string{"codec": "msgpack"}})
+	if err := byHello.ReadJSON(&env); err != nil || env.Type != helloType {
+		t.Fatalf("got %+v, %v: want the hello back", env, err)
+	}
+	<-joined
+	<-joined
+
+	r.Broadcast(message.NewJSONMessage(tick{"ACME", 12.5}), "ticks")
+	for _, ws := range []*websocket.Conn{bySubprotocol, byHello} {
+		frameType, data, err := ws.ReadMessage()
+		var got tick
+		if err != nil || frameType != websocket.BinaryMessage || msgpack.Unmarshal(data, &got) != nil || got.Symbol != "ACME" {
+			t.Fatalf("got %d %q, %v: want a MessagePack tick", frameType, data, err)
+		}
+	}
+}
+
+func TestFramesFollowTheCodecSwitch(t *testing.T) {
+	var written []Frame
+	capture := func(next WriteFunc) WriteFunc {
+		return func(_ *Connection, f Frame) error {
+			written = append(written, f)
+			return nil
+		}
+	}
+	r := NewRegistry()
+	conn := registered(r, WithCodecs(message.Msgpack), WithOutbound(capture))
+	set, _ := newFrameSet(message.NewJSONMessage(tick{"ACME", 12.5}))
+
+	// Encoded for MessagePack just before the hello was queued, and so written
+	// ahead of it: it must still go out in the old format.
+	early, _ := set.frame(message.Msgpack)
+	if err := conn.SetCodec("msgpack"); err != nil {
+		t.Fatalf("SetCodec: %v", err)
+	}
+	hello := next(t, conn)
+	// Encoded in the old format just before the switch, written after it.
+	late, _ := set.frame(nil)
+	for _, f := range []Frame{early, hello, late} {
+		if err := conn.write(f); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if w := written[0]; w.IsBinary() || !json.Valid(w.Data) {
+		t.Fatalf("frame before the hello went out as %q", w.Data)
+	}
+	if w := written[1]; w.IsBinary() || string(w.Data) != `{"type":"hello","data":{"codec":"msgpack"}}` {
+		t.Fatalf("hello went out as %q", w.Data)
+	}
+	var got tick
+	if w := written[2]; !w.IsBinary() || msgpack.Unmarshal(w.Data, &got) != nil {
+		t.Fatalf("frame after the hello went out as %q", w.Data)
+	}
+	if err := conn.SetCodec("cbor"); err == nil {
+		t.Fatal("SetCodec to an unconfigured codec succeeded")
+	}
+}
+
+func TestBackplaneCarriesEachCodec(t *testing.T) {
+	rs := replicas(t, 2)
+	rs[0].addCodecs(config{codecs: []message.Codec{message.Msgpack}})
+	native := registered(rs[1])
+	native.useCodec(message.Msgpack)
+	web := registered(rs[1])
+
+	rs[0].BroadcastToAll(message.NewJSONMessage(tick{"ACME", 12.5}))
+	if f := next(t, web); f.IsBinary() {
+		t.Fatal("web client on the other replica got a binary frame")
+	}
+	var got tick
+	if f := next(t, native); !f.IsBinary() || msgpack.Unmarshal(f.Data, &got) != nil || got.Symbol != "ACME" {
+		t.Fatalf("native client on the other replica got %q", f.Data)
+	}
+}
+
+// An Envelope has the keys of its json tags in every codec, and leaves out
+// the empty ones.
+func TestEnvelopeKeysInMsgpack(t *testing.T) {
+	data, err := message.Encode(NewEnvelope("message", tick{"ACME", 12.5}), message.Msgpack)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	var keys map[string]any
+	if err := msgpack.Unmarshal(data, &keys); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(keys) != 2 || keys["type"] != "message" || keys["data"] == nil {
+		t.Errorf("got keys %v, want type and data", keys)
+	}
+
+	var env struct {
+		Type string `json:"type"`
+		Data tick   `json:"data"`
+	}
+	if err := message.Msgpack.Unmarshal(data, &env); err != nil || env.Type != "message" || env.Data != (tick{"ACME", 12.5}) {
+		t.Errorf("round trip: got %+v, %v", env, err)
+	}
+}
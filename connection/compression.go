@@ -0,0 +1,32 @@
+package connection
+
+import "github.com/gorilla/websocket"
+
+// SetGroupCompression turns compression of broadcasts to groupName off, for a
+// group whose payloads are compressed already, or back on. Broadcasts to every
+// group are compressed by default, on the connections that negotiated it; see
+// WithCompression. The setting is forgotten when the group is deleted.
+func (r *Registry) SetGroupCompression(groupName string, enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if enabled {
+		delete(r.uncompressed, groupName)
+	} else {
+		r.uncompressed[groupName] = true
+	}
+}
+
+// prepare readies f for a broadcast to recipients connections, if any handler
+// compresses. A prepared frame is compressed the first time it is written at
+// each compression level and reused from then on; without it, every recipient
+// would compress the same bytes again.
+func (r *Registry) prepare(f *Frame, recipients int) {
+	if recipients < 2 || f.noCompress || !r.compressing.Load() {
+		return
+	}
+	pm, err := websocket.NewPreparedMessage(f.Type, f.Data)
+	if err != nil {
+		return // each recipient writes it as usual
+	}
+	f.prepared = pm
+}
@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"compress/flate"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// countingConn counts the bytes read from the network.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestCompressionOnTheWire(t *testing.T) {
+	r := NewRegistry(WithCompression(flate.BestSpeed, 256))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	joined := make(chan struct{}, 2)
+	r.Hooks.OnConnect = func(c *Connection) {
+		r.AddToGroup("state", c)
+		r.AddToGroup("raw", c)
+		joined <- struct{}{}
+	}
+	r.SetGroupCompression("raw", false)
+	srv := httptest.NewServer(r.RegisterHandler(nil))
+	defer srv.Close()
+
+	// Two clients, so broadcasts take the prepared path.
+	var read atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{conn, &read}, err
+		},
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer other.Close()
+	<-joined
+	<-joined
+
+	state := strings.Repeat(`{"symbol":"ACME","price":12.5},`, 256) // 8 KiB, very compressible
+	cases := []struct {
+		name       string
+		send       func()
+		compressed bool
+	}{
+		{"large", func() { r.Broadcast(message.NewJSONMessage(state), "state") }, true},
+		{"below threshold", func() { r.Broadcast(message.NewJSONMessage("small"), "state") }, false},
+		{"marked uncompressed", func() { r.Broadcast(message.NoCompression(message.NewJSONMessage(state)), "state") }, false},
+		{"uncompressed group", func() { r.Broadcast(message.NewJSONMessage(state), "raw") }, false},
+	}
+	for _, tc := range cases {
+		before := read.Load()
+		tc.send()
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: read: %v", tc.name, err)
+		}
+		if _, plain, err := other.ReadMessage(); err != nil || string(plain) != string(data) {
+			t.Fatalf("%s: the uncompressed client got %d bytes, %v", tc.name, len(plain), err)
+		}
+		wire := read.Load() - before
+		if compressed := wire < int64(len(data)); compressed != tc.compressed {
+			t.Errorf("%s: %d bytes on the wire for %d of payload; want compressed %v", tc.name, wire, len(data), tc.compressed)
+		}
+	}
+}
+
+func TestBroadcastIsPreparedOnce(t *testing.T) {
+	r := NewRegistry()
+	r.compressing.Store(true)
+	a, b := registered(r), registered(r)
+
+	r.BroadcastToAll(message.NewJSONMessage("state"))
+	fa, fb := next(t, a), next(t, b)
+	if fa.prepared == nil || fa.prepared != fb.prepared {
+		t.Fatal("recipients got different frames, want one prepared message")
+	}
+
+	r.BroadcastToAll(message.NoCompression(message.NewJSONMessage("jpeg")))
+	if f := next(t, a); f.prepared != nil || !f.noCompress {
+		t.Fatal("an uncompressed message was prepared for compression")
+	}
+	next(t, b)
+}
+
+// Outbound middleware sees a broadcast's prepared frame, which goes out only
+// if the middleware passed the bytes on unchanged.
+func TestOutboundChangeSkipsThePreparedFrame(t *testing.T) {
+	var prepared atomic.Int32
+	shout := func(next WriteFunc) WriteFunc {
+		return func(c *Connection, f Frame) error {
+			if f.prepared != nil {
+				prepared.Add(1)
+			}
+			if string(f.Data) == `"shout"` {
+				f.Data = []byte(`"SHOUT"`)
+			}
+			return next(c, f)
+		}
+	}
+	r := NewRegistry(WithCompression(flate.BestSpeed, 0), WithOutbound(shout))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	joined := make(chan struct{}, 2)
+	r.Hooks.OnConnect = func(c *Connection) {
+		r.AddToGroup("room", c)
+		joined <- struct{}{}
+	}
+	srv := httptest.NewServer(r.RegisterHandler(nil))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := (&websocket.Dialer{EnableCompression: true}).Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+		<-joined
+	}
+
+	r.Broadcast(message.NewJSONMessage("shout"), "room")
+	r.Broadcast(message.NewJSONMessage("quiet"), "room")
+	for _, ws := range clients {
+		for _, want := range []string{`"SHOUT"`, `"quiet"`} {
+			if _, data, err := ws.ReadMessage(); err != nil || string(data) != want {
+				t.Fatalf("got %s, %v; want %s", data, err, want)
+			}
+		}
+	}
+	if n := prepared.Load(); n != 4 {
+		t.Errorf("middleware saw %d prepared frames, want 4", n)
+	}
+}
@@ -1,25 +1,42 @@
 package connection
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gclluch/go-rtc-lib/message"
 	"github.com/google/uuid"
 
 	"github.com/gorilla/websocket"
 )
 
-// Connection wraps a single upgraded WebSocket connection: its outgoing
+// Connection wraps a single upgraded WebSocket connection - or a client on
+// another transport, server-sent events or long polling: its outgoing
 // message queue, the goroutines that pump data to/from the socket, and the
 // set of broadcast groups it currently belongs to.
 type Connection struct {
-	ID             string // Unique identifier for the connection
-	WS             *websocket.Conn
-	Send           chan []byte
+	ID string          // Unique identifier for the connection
+	WS *websocket.Conn // nil for a connection on another transport
+
+	// transport is what the connection is carried on if it is not a
+	// WebSocket, and inbound serializes the frames the client POSTs to it.
+	// See transport.go.
+	transport transport
+	inbound   sync.Mutex
+
+	// Send is the v1 outbound queue, kept for compatibility. Everything sent
+	// on it goes out as a text frame. The library itself queues on out, which
+	// carries the frame type too.
+	Send chan []byte
+	out  *outQueue // see queue.go
+
 	wg             sync.WaitGroup
 	closeOnce      sync.Once
 	messageHandler MessageHandler
@@ -30,39 +47,111 @@ type Connection struct {
 	// the frame goes out before the socket does. See CloseConnection.
 	writeDone chan struct{}
 
-	groups map[string]bool // Tracks which groups this connection is part of.
+	groups   map[string]bool          // Tracks which groups this connection is part of.
+	presence map[string]presenceState // What it is present as, by group; see presence.go.
+
+	cfg config // Settings this connection was accepted with. See Option.
+
+	// writer is writeSocket wrapped in the outbound middleware, and writing
+	// the frame it is writing, before any middleware changed it; see write.
+	writer  WriteFunc
+	writing *Frame
+
+	// codec is the codec senders encode for, and wire the one the write pump
+	// writes in; they differ while a switch is queued. See SetCodec.
+	codec atomic.Pointer[codecBox]
+	wire  message.Codec
+
+	// ctx is canceled by CloseConnection; see Context.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	rpc      rpcState       // Pending calls and in-flight requests; see rpc.go.
+	reliable *reliableState // Unacknowledged reliable messages; see reliable.go.
+
+	// registered is closed once the registry has taken the connection on,
+	// including attaching its session; the pumps wait for it.
+	registered chan struct{}
+	session    *session       // nil unless sessions are on; see session.go
+	resume     *resumeRequest // the session the client asked to resume, if any
+
+	principal *Principal // who it authenticated as; see Principal
+
+	closeMu   sync.Mutex
+	closeInfo CloseInfo // why it closed; see noteClose
 }
 
+// ErrConnectionClosed is returned for work aimed at a connection that has
+// already closed.
+var ErrConnectionClosed = errors.New("connection: connection closed")
+
+// ErrSlowConsumer is returned when a message could not be queued because the
+// connection's outbound buffer was full. The connection is closed as a result;
+// see SlowConsumerPolicy.
+var ErrSlowConsumer = errors.New("connection: outbound buffer full; connection closed")
+
 // closeFrameGrace bounds how long CloseConnection waits for the write pump to
 // emit its Close frame. It is a courtesy to the peer, not a correctness
 // requirement, so it stays short enough never to matter to a shutdown.
 const closeFrameGrace = 250 * time.Millisecond
 
-func NewConnection(ws *websocket.Conn, handler MessageHandler) *Connection {
+// NewConnection wraps ws with the default settings, overridden by opts. It
+// panics if opts leave an invalid setting; see Option.
+func NewConnection(ws *websocket.Conn, handler MessageHandler, opts ...Option) *Connection {
+	return newConnection(ws, handler, defaultConfig().resolve(opts...))
+}
+
+func newConnection(ws *websocket.Conn, handler MessageHandler, cfg config) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Connection{
+		writer:         chainOutbound((*Connection).writeSocket, cfg.outbound),
 		ID:             uuid.NewString(), // Assign a unique ID to the connection
 		WS:             ws,
-		Send:           make(chan []byte, 256),
+		Send:           make(chan []byte, cfg.sendBuffer),
+		out:            newOutQueue(cfg),
 		messageHandler: handler,
 		done:           make(chan struct{}),
 		writeDone:      make(chan struct{}),
 		groups:         make(map[string]bool),
+		presence:       make(map[string]presenceState),
+		cfg:            cfg,
+		ctx:            ctx,
+		cancel:         cancel,
+		registered:     make(chan struct{}),
+		reliable:       &reliableState{},
 	}
 }
 
+// Context returns a context that is canceled when the connection closes, for
+// work that should not outlive it.
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
+// queue puts f on the outbound queue. A full queue means the peer is not
+// keeping up, and the connection's SlowConsumerPolicy decides what happens;
+// by default the connection is closed. Only a BlockFor policy waits.
+func (c *Connection) queue(f Frame) error {
+	return c.offer(f, nil, true)
+}
+
 // CloseConnection closes the underlying WebSocket and signals the read/write
 // pumps to stop. It deliberately never closes Send: registry.Broadcast sends
 // to Send from other goroutines, and a closed channel panics on send even
-// under select/default. The write pump is the only reader of Send, and it
-// learns to stop via done instead - so Send is simply left for GC once the
+// under select/default. The write pump is the only reader of it and out, and it
+// learns to stop via done instead - so they are simply left for GC once the
 // connection is unregistered. Safe to call more than once or concurrently.
 // It closes the socket only after the write pump has had a chance to send a
-// Close frame. Closing both at once raced: whether the peer saw a clean 1000 or
-// an abnormal 1006 depended on which goroutine the scheduler picked, so a
-// deliberate shutdown usually looked like a network fault to the client.
+// Close frame, carrying the code and reason the connection is closing with -
+// 1000 unless something else was noted first; see CloseWithReason. Closing
+// both at once raced: whether the peer saw a clean 1000 or an abnormal 1006
+// depended on which goroutine the scheduler picked, so a deliberate shutdown
+// usually looked like a network fault to the client.
 func (c *Connection) CloseConnection() {
 	c.closeOnce.Do(func() {
+		c.noteClose(CloseInfo{Code: websocket.CloseNormalClosure})
 		close(c.done)
+		c.cancel()
 
 		// writePump closes writeDone on its way out, so this returns as soon as
 		// the frame is written - or immediately when called from writePump's own
@@ -79,9 +168,9 @@ func (c *Connection) CloseConnection() {
 }
 
 func (c *Connection) setupPongHandler() {
-	c.WS.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.WS.SetReadDeadline(time.Now().Add(c.cfg.pongWait))
 	c.WS.SetPongHandler(func(string) error {
-		c.WS.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.WS.SetReadDeadline(time.Now().Add(c.cfg.pongWait))
 		return nil
 	})
 }
@@ -133,40 +222,97 @@ func AllowOrigins(origins ...string) func(r *http.Request) bool {
 
 // RegisterHandler returns an http.HandlerFunc that upgrades incoming
 // requests to WebSocket connections tracked by r, dispatching incoming
-// messages to customHandler.
-func (r *Registry) RegisterHandler(customHandler MessageHandler) http.HandlerFunc {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     r.CheckOrigin,
+// messages to customHandler. opts override the registry's settings for the
+// connections this handler accepts only; it panics if they are invalid.
+func (r *Registry) RegisterHandler(customHandler MessageHandler, opts ...Option) http.HandlerFunc {
+	cfg := r.cfg.resolve(opts...)
+	cfg.metrics = r.cfg.metrics
+	upgrader := newUpgrader(cfg, r.CheckOrigin)
+	if cfg.compression {
+		r.compressing.Store(true)
 	}
+	r.addCodecs(cfg)
 
 	return func(w http.ResponseWriter, req *http.Request) {
-		ws, err := upgrader.Upgrade(w, req, nil)
+		// Authenticate before upgrading, while a rejection can still be an
+		// HTTP status the client can act on.
+		principal, ok := authenticate(cfg.authenticator, cfg.log(), w, req)
+		if !ok {
+			cfg.metrics.Upgrade(UpgradeUnauthorized)
+			return
+		}
+		var header http.Header
+		var codec message.Codec
+		if principal != nil && principal.Subprotocol != "" {
+			header = http.Header{"Sec-Websocket-Protocol": {principal.Subprotocol}}
+		} else if codec = cfg.negotiateCodec(req); codec != nil {
+			header = http.Header{"Sec-Websocket-Protocol": {codec.Name()}}
+		}
+
+		ws, err := upgrader.Upgrade(w, req, header)
 		if err != nil {
-			log.Println("Upgrade failed:", err)
+			cfg.log().Warn("Upgrade failed", slog.String(LogRemoteAddr, req.RemoteAddr), slog.Any(LogError, err))
+			result := UpgradeHandshake
+			if upgrader.CheckOrigin != nil && !upgrader.CheckOrigin(req) {
+				result = UpgradeOrigin
+			}
+			cfg.metrics.Upgrade(result)
 			return
 		}
+		cfg.metrics.Upgrade(UpgradeOK)
+		if cfg.compression {
+			// Cannot fail: the level was validated with the options.
+			ws.SetCompressionLevel(cfg.compressionLevel)
+		}
 
 		// Initialize the connection with the custom handler.
-		client := NewConnection(ws, customHandler)
+		client := newConnection(ws, customHandler, cfg)
+		client.principal = principal
+		if codec != nil {
+			client.useCodec(codec)
+		}
+		if cfg.sessionGrace > 0 {
+			client.resume = parseResume(req)
+		}
+
+		r.serve(client, client.writePump, client.readPump)
+	}
+}
 
+// serve registers client, runs its pumps until they have all stopped, and
+// unregisters it.
+func (r *Registry) serve(client *Connection, pumps ...func()) {
+	select {
+	case r.register <- client:
+		// Run handles a registration in one step, so this never waits
+		// long - but the pumps must not start until it is done: a resumed
+		// connection takes over its session's ID and replay queue there.
+		<-client.registered
+	case <-r.stopped:
+		client.CloseConnection()
+		return
+	}
+	defer func() {
 		select {
-		case r.register <- client:
+		case r.unregister <- client:
 		case <-r.stopped:
-			client.CloseConnection()
-			return
 		}
-		defer func() {
-			select {
-			case r.unregister <- client:
-			case <-r.stopped:
-			}
-		}()
+	}()
+
+	defer client.expireWith(client.principal)()
+
+	client.wg.Add(len(pumps))
+	for _, pump := range pumps {
+		go pump()
+	}
+	client.wg.Wait()
+}
 
-		client.wg.Add(2)
-		go client.writePump()
-		go client.readPump()
-		client.wg.Wait()
+func newUpgrader(cfg config, checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    cfg.readBufferSize,
+		WriteBufferSize:   cfg.writeBufferSize,
+		CheckOrigin:       checkOrigin,
+		EnableCompression: cfg.compression,
 	}
 }
@@ -175,3 +175,110 @@ func TestAllowOriginsExtendsTheDefaultWithoutWideningIt(t *testing.T) {
 		})
 	}
 }
+
+// A plain MessageHandler's reply goes back in the frame type the message came
+// in, so echoing binary data never turns it into invalid text.
+func TestEchoPreservesBinaryFrames(t *testing.T) {
+	r := newTestRegistry(t)
+	server := httptest.NewServer(http.HandlerFunc(r.RegisterHandler(echoHandler{})))
+	defer server.Close()
+
+	ws, _, err := dialWebSocket(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer ws.Close()
+
+	payload := []byte{0xff, 0xfe, 0x00}
+	if err := ws.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal("WriteMessage failed:", err)
+	}
+
+	frameType, got, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage failed:", err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("got frame type %d, want binary", frameType)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %v, want %v", got, payload)
+	}
+}
+
+// frameTypeHandler reports the inbound frame type back as text.
+type frameTypeHandler struct{}
+
+func (frameTypeHandler) HandleMessage(*connection.Connection, []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func (frameTypeHandler) HandleFrame(_ *connection.Connection, in connection.Frame) (connection.Frame, error) {
+	if in.IsBinary() {
+		return connection.TextFrame([]byte("binary")), nil
+	}
+	return connection.TextFrame([]byte("text")), nil
+}
+
+func TestFrameHandlerSeesInboundFrameType(t *testing.T) {
+	r := newTestRegistry(t)
+	server := httptest.NewServer(http.HandlerFunc(r.RegisterHandler(frameTypeHandler{})))
+	defer server.Close()
+
+	ws, _, err := dialWebSocket(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer ws.Close()
+
+	for frameType, want := range map[int]string{
+		websocket.TextMessage:   "text",
+		websocket.BinaryMessage: "binary",
+	} {
+		if err := ws.WriteMessage(frameType, []byte("x")); err != nil {
+			t.Fatal("WriteMessage failed:", err)
+		}
+		replyType, got, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage failed:", err)
+		}
+		if replyType != websocket.TextMessage || string(got) != want {
+			t.Errorf("got %q in frame type %d, want %q as text", got, replyType, want)
+		}
+	}
+}
+
+// Broadcast sends each message in the frame type it declares: raw bytes as
+// binary, JSON as text.
+func TestBroadcastPreservesFrameType(t *testing.T) {
+	r := newTestRegistry(t)
+	server := httptest.NewServer(http.HandlerFunc(r.RegisterHandler(echoHandler{})))
+	defer server.Close()
+
+	ws, _, err := dialWebSocket(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer ws.Close()
+
+	// An echo round trip guarantees the connection is registered.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("ready")); err != nil {
+		t.Fatal("WriteMessage failed:", err)
+	}
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatal("ReadMessage failed:", err)
+	}
+
+	r.BroadcastToAll(&message.ByteMessage{Data: []byte{0xff}})
+	r.BroadcastToAll(message.NewJSONMessage("hi"))
+
+	for _, want := range []int{websocket.BinaryMessage, websocket.TextMessage} {
+		frameType, _, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage failed:", err)
+		}
+		if frameType != want {
+			t.Errorf("got frame type %d, want %d", frameType, want)
+		}
+	}
+}
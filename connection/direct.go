@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"errors"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+var (
+	// ErrConnectionNotFound is returned by SendTo for a connection ID the
+	// registry does not know - it never connected, or has been unregistered.
+	ErrConnectionNotFound = errors.New("connection: no connection with that ID")
+
+	// ErrMaybeRemote is returned by SendTo, with a backplane, for a
+	// connection ID this replica does not know. The message was published
+	// for the other replicas, but whether one of them has the connection is
+	// not known: it may reach nobody.
+	ErrMaybeRemote = errors.New("connection: no connection with that ID here; sent to the other replicas")
+
+	// ErrUserNotFound is returned by SendToUser when the user has no
+	// connections.
+	ErrUserNotFound = errors.New("connection: user has no connections")
+)
+
+// index records conn under its ID, its principal's user ID and its
+// transport's token. Callers hold r.mu, and call it once conn has its final
+// ID.
+func (r *Registry) index(conn *Connection) {
+	r.byID[conn.ID] = conn
+	if conn.transport != nil {
+		r.transports[conn.transport.token()] = conn
+	}
+	if conn.principal == nil {
+		return
+	}
+	conns, exists := r.byUser[conn.principal.UserID]
+	if !exists {
+		conns = make(map[*Connection]bool)
+		r.byUser[conn.principal.UserID] = conns
+	}
+	conns[conn] = true
+}
+
+// unindex undoes index. A resumed session's new connection shares the old
+// one's ID, so the ID entry is only removed if it is still conn's. Callers
+// hold r.mu.
+func (r *Registry) unindex(conn *Connection) {
+	if r.byID[conn.ID] == conn {
+		delete(r.byID, conn.ID)
+	}
+	if conn.transport != nil {
+		delete(r.transports, conn.transport.token())
+	}
+	if conn.principal == nil {
+		return
+	}
+	if conns, exists := r.byUser[conn.principal.UserID]; exists {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(r.byUser, conn.principal.UserID)
+		}
+	}
+}
+
+// Connection returns the registered connection with id.
+func (r *Registry) Connection(id string) (*Connection, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conn, ok := r.byID[id]
+	return conn, ok
+}
+
+// UserConnections returns the registered connections authenticated as
+// userID: one per tab or device.
+func (r *Registry) UserConnections(userID string) []*Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]*Connection, 0, len(r.byUser[userID]))
+	for conn := range r.byUser[userID] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// SendTo sends msg to the connection with connID alone. It returns
+// ErrConnectionNotFound if there is no such connection, ErrConnectionClosed
+// if it is closing, ErrSlowConsumer if it was closed for not draining, and
+// ErrMessageDropped if its SlowConsumerPolicy dropped msg instead. A
+// connection whose session is parked gets msg in the replay when it resumes,
+// as it gets its groups' broadcasts.
+//
+// With a backplane, a connection not found here is looked for on the other
+// replicas, and SendTo returns ErrMaybeRemote: it cannot tell whether one of
+// them has it.
+func (r *Registry) SendTo(connID string, msg message.IMessage) error {
+	set, err := newFrameSet(msg)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	conn, ok := r.byID[connID]
+	// Under the same lock as a resume, so the frame is replayed or sent live.
+	parked := !ok && r.recordParkedConn(set.base, connID)
+	r.mu.Unlock()
+	switch {
+	case parked:
+		return nil
+	case !ok && r.cfg.backplane != nil:
+		r.publish(r.remote(remoteMessage{Kind: remoteSendTo, Target: connID}, set))
+		return ErrMaybeRemote
+	case !ok:
+		return ErrConnectionNotFound
+	}
+	frame, err := set.frame(conn.Codec())
+	if err != nil {
+		return err
+	}
+	return conn.queue(frame)
+}
+
+// SendToUser sends msg to every connection authenticated as userID. It
+// returns nil if msg was queued for at least one of them, ErrUserNotFound if
+// the user has none, and otherwise why the first one failed.
+//
+// With a backplane, msg also goes to the user's connections on the other
+// replicas, and a user with none here is not an error.
+func (r *Registry) SendToUser(userID string, msg message.IMessage) error {
+	set, err := newFrameSet(msg)
+	if err != nil {
+		return err
+	}
+
+	err = r.sendToUser(userID, set)
+	if r.cfg.backplane != nil {
+		r.publish(r.remote(remoteMessage{Kind: remoteSendToUser, Target: userID}, set))
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+	}
+	return err
+}
+
+// sendToUser queues set for userID's connections on this replica, each in
+// the codec it negotiated.
+func (r *Registry) sendToUser(userID string, set *frameSet) error {
+	conns := r.UserConnections(userID)
+	if len(conns) == 0 {
+		return ErrUserNotFound
+	}
+	var first error
+	sent := false
+	for _, conn := range conns {
+		frame, err := set.frame(conn.Codec())
+		if err == nil {
+			err = conn.queue(frame)
+		}
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	return first
+}
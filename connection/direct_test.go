@@ -0,0 +1,106 @@
+package connection
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// userConn returns a connection registered with r as authenticated as userID.
+func userConn(r *Registry, userID string) *Connection {
+	conn := NewConnection(nil, nil)
+	conn.principal = &Principal{UserID: userID}
+	r.registerConnection(conn)
+	return conn
+}
+
+func TestSendToByConnectionID(t *testing.T) {
+	r := NewRegistry()
+	conn := userConn(r, "alice")
+
+	if err := r.SendTo(conn.ID, message.NewJSONMessage("hi")); err != nil {
+		t.Fatalf("SendTo: %v", err)
+	}
+	if f := next(t, conn); string(f.Data) != `"hi"` {
+		t.Fatalf("got %s, want hi", f.Data)
+	}
+
+	if err := r.SendTo("nobody", message.NewJSONMessage("hi")); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("unknown ID: got %v, want ErrConnectionNotFound", err)
+	}
+
+	conn.CloseConnection()
+	if err := r.SendTo(conn.ID, message.NewJSONMessage("hi")); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("closing connection: got %v, want ErrConnectionClosed", err)
+	}
+	r.unregisterConnection(conn)
+	if err := r.SendTo(conn.ID, message.NewJSONMessage("hi")); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("unregistered connection: got %v, want ErrConnectionNotFound", err)
+	}
+}
+
+func TestSendToUserReachesEveryTab(t *testing.T) {
+	r := NewRegistry()
+	tab1, tab2 := userConn(r, "alice"), userConn(r, "alice")
+	other := userConn(r, "bob")
+
+	if err := r.SendToUser("alice", message.NewJSONMessage("hi")); err != nil {
+		t.Fatalf("SendToUser: %v", err)
+	}
+	for _, conn := range []*Connection{tab1, tab2} {
+		if f := next(t, conn); string(f.Data) != `"hi"` {
+			t.Fatalf("got %s, want hi", f.Data)
+		}
+	}
+	if other.out.len() != 0 {
+		t.Fatal("another user's connection got the message")
+	}
+
+	r.unregisterConnection(tab1)
+	r.unregisterConnection(tab2)
+	if err := r.SendToUser("alice", message.NewJSONMessage("hi")); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("user gone: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestSendToUserSpansReplicas(t *testing.T) {
+	rs := replicas(t, 2)
+	there := userConn(rs[1], "alice")
+
+	if err := rs[0].SendToUser("alice", message.NewJSONMessage("hi")); err != nil {
+		t.Fatalf("SendToUser: %v", err)
+	}
+	if f := next(t, there); string(f.Data) != `"hi"` {
+		t.Fatalf("got %s, want hi", f.Data)
+	}
+	if err := rs[0].SendTo(there.ID, message.NewJSONMessage("direct")); !errors.Is(err, ErrMaybeRemote) {
+		t.Fatalf("SendTo: got %v, want ErrMaybeRemote", err)
+	}
+	if f := next(t, there); string(f.Data) != `"direct"` {
+		t.Fatalf("got %s, want direct", f.Data)
+	}
+	// Known here, it is sent here and nowhere else.
+	if err := rs[1].SendTo(there.ID, message.NewJSONMessage("local")); err != nil {
+		t.Fatalf("local SendTo: %v", err)
+	}
+}
+
+// A connection whose session is parked gets a direct message on resume.
+func TestSendToParkedSessionIsReplayed(t *testing.T) {
+	r := NewRegistry()
+	conn := NewConnection(nil, nil, WithSessions(time.Minute, 16))
+	r.registerConnection(conn)
+	r.unregisterConnection(conn)
+
+	if err := r.SendTo(conn.ID, message.NewJSONMessage("while away")); err != nil {
+		t.Fatalf("SendTo a parked session: %v", err)
+	}
+	s := conn.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if frames, ok := s.since(0); !ok || len(frames) != 1 || string(frames[0].Data) != `"while away"` {
+		t.Fatalf("replay: got %v, want the message", frames)
+	}
+}
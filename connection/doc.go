@@ -14,7 +14,67 @@
 //	cancel() // closes every live connection and returns from Run
 //
 // myHandler is any [MessageHandler]. Its HandleMessage is called for each
-// inbound frame and may return bytes to send straight back to that client.
+// inbound frame and may return bytes to send straight back to that client, in
+// the same frame type the message arrived in. A handler that needs the frame
+// type itself implements [FrameHandler].
+//
+// # Routing
+//
+// [Router] is a ready-made MessageHandler for JSON clients. It decodes each frame
+// as an [Envelope] - {"type": ..., "data": ...} - and dispatches on the type to
+// a typed route registered with [Handle], replying with an envelope of the same
+// type or with a structured error frame:
+//
+//	router := connection.NewRouter()
+//	connection.Handle(router, "join", func(c *connection.Connection, req JoinReq) (*JoinResp, error) {
+//	    reg.AddToGroup(req.Group, c)
+//	    return &JoinResp{Group: req.Group}, nil
+//	})
+//	http.Handle("/ws", reg.RegisterHandler(router))
+//
+// # Middleware
+//
+// A [Middleware] wraps a handler with what every message should get, and
+// [Chain] applies several, the first outermost. [Recover], [LogMessages],
+// [Timing] and [MaxMessageSize] are built in:
+//
+//	reg.RegisterHandler(connection.Chain(router, connection.Recover(), connection.MaxMessageSize(64<<10)))
+//
+// Middleware that returns a [FrameHandlerFunc] and calls the next handler
+// through [HandleFrame] keeps frame types intact, as the built-ins do.
+// [WithOutbound] does the same for what the write pump sends, with
+// [OutboundMiddleware] that can change, drop or audit each frame.
+//
+// # Requests and replies
+//
+// An envelope with an "id" is a request, and its reply or error frame carries
+// the same id back. Routes registered with [HandleAsync] answer later, out of
+// order and from any goroutine, through a [Request]. The server can call the
+// client too, with [Connection.Call], which waits for the matching reply or
+// sends a cancel frame when its context ends. Pending calls and in-flight
+// requests are released when the connection closes.
+//
+// # Text and binary frames
+//
+// Outbound messages travel as text frames unless the message.IMessage
+// implements message.Binary, as message.ByteMessage and the MessagePack, CBOR
+// and protobuf messages do; [Registry.Broadcast] keeps that choice for every
+// recipient. Binary payloads - protobuf, images - must go out as binary
+// frames, since browsers reject a text frame that is not valid UTF-8.
+//
+// # Codecs
+//
+// With [WithCodecs], each connection can negotiate a message.Codec - by
+// offering its name as a WebSocket subprotocol, or by sending a Router a hello
+// envelope, {"type": "hello", "data": {"codec": "msgpack"}} - and then gets
+// every message a codec can encode (see message.Encodable) in it. Broadcast
+// serializes once per codec among its recipients, so one call reaches browsers
+// as JSON and native clients as MessagePack:
+//
+//	reg := connection.NewRegistry(connection.WithCodecs(message.Msgpack, message.JSON))
+//	reg.Broadcast(message.NewJSONMessage(tick), "ticks")
+//
+// Router replies and reliable deliveries stay JSON.
 //
 // # Groups
 //
@@ -29,19 +89,239 @@
 // Adding a connection that has already been unregistered is a no-op rather than
 // an error: the registry has forgotten it, so nothing would ever remove it again.
 //
+// A group can keep its recent broadcasts, bounded by count, bytes and age, with
+// [Registry.SetHistory]. [Registry.AddToGroupWithHistory] then sends a late
+// joiner the last N of them, those since a time or those after a sequence
+// number before any live traffic, in order and without duplicates however
+// broadcasts interleave with the join:
+//
+//	reg.SetHistory("room-1", connection.History{MaxMessages: 50, MaxAge: time.Hour})
+//	reg.AddToGroupWithHistory("room-1", conn, connection.ReplayLast(20))
+//
+// # Presence
+//
+// [Registry.SetPresence] marks a member present in a group under a key, such as
+// a user ID, with application metadata. The group is sent a presence event as
+// keys join, change their metadata and leave, and [Registry.Presence] lists who
+// is there. A key leaves once its last connection does - after
+// [WithPresenceDebounce], if set, so a quick reconnect goes unnoticed.
+//
+// Presence is opt-in, separate from membership: joining a group with
+// [Registry.AddToGroup] sends no event, and a member is not present until
+// SetPresence is called for it. Its leave is automatic - on RemoveFromGroup,
+// on disconnect, or when the group is deleted - so every join the group sees
+// is paired with a leave.
+//
+// # Direct messages
+//
+// [Registry.SendTo] sends to one connection by its ID, and [Registry.SendToUser]
+// to every connection of an authenticated user - each tab and device. Both
+// return [ErrConnectionNotFound] or [ErrUserNotFound] for a target that is not
+// connected, rather than dropping the message silently. With a backplane,
+// SendTo returns [ErrMaybeRemote] for an ID it published to the other replicas
+// without knowing whether one of them has it.
+//
+// # Lifecycle hooks and events
+//
+// [Registry.Hooks] are called as connections connect and disconnect and as
+// they join and leave groups, and as groups are created and deleted.
+// OnDisconnect is told why, in a [CloseInfo]: the close code and reason, whether
+// the peer or the server closed, and whether the connection was evicted as a
+// slow consumer. Hooks run in order on a goroutine of the Registry's, so they
+// may call back into it. [Registry.Events] delivers the same [Event] values on a
+// bounded channel, for observers that must never hold the Registry up:
+//
+//	reg.Hooks.OnConnect = func(c *connection.Connection) { reg.AddToGroup("lobby", c) }
+//	events, stop := reg.Events(1024)
+//
+// The Close frame a connection is sent carries the same code and reason: 1001
+// when Run's context is canceled, 1008 for a slow consumer, [CloseGroupDeleted]
+// and the other 4000-range codes where no standard code fits.
+// [Connection.CloseWithReason] closes with a code of the application's own, and
+// [Registry.CloseAll] closes every connection - with
+// websocket.CloseServiceRestart before a deploy, say.
+//
+// # Reliable delivery
+//
+// [Registry.Broadcast] is best-effort. [Registry.BroadcastReliable] is the
+// opt-in at-least-once mode for broadcasts that carry state: each copy carries a
+// per-connection sequence number, the client acks it, and unacked copies are
+// retransmitted until acked or the retransmit limit runs out. The returned
+// [Delivery] reports which connections acked and why the rest did not. Acks are
+// read by the [Router], so clients of a reliable broadcast must be served by one.
+//
+// # Session resumption
+//
+// With [WithSessions], a dropped connection's session is kept for a grace
+// period: its groups stay reserved and broadcasts to them are recorded. The
+// first frame of every connection carries the session token; a client that
+// reconnects with ?resume=<token>&last_seq=<n> gets the same connection ID and
+// groups back and every frame after n replayed before anything live. If n is
+// older than the replay buffer reaches, the client is sent a resync frame and
+// should refetch its state. Package github.com/gclluch/go-rtc-lib/client does
+// all of this for a Go client.
+//
+// # Server-sent events
+//
+// [Registry.SSEHandler] serves clients whose proxies break WebSocket upgrades.
+// A GET opens a connection whose frames arrive as server-sent events, and the
+// client sends frames as POSTs to the same URL, naming the connection with the
+// token the stream opened with; they reach the handler, and its replies come
+// back on the stream. The connection is a member of the Registry like any
+// other, so groups, broadcasts and direct sends reach it. With [WithSessions]
+// each event carries an id, and an EventSource reconnecting with
+// Last-Event-ID resumes its session.
+//
+//	http.Handle("/events", reg.SSEHandler(router))
+//
+// # Long polling
+//
+// [Registry.LongPollHandler] serves clients that cannot keep a response open
+// either. A GET opens a session - a connection with an ID and a token - and
+// each GET with the token after that is held until frames are queued for it,
+// or for the ping interval, and answered with them; frames go the other way as
+// POSTs. Frames wait in the connection's queue between polls, under the same
+// slow-consumer policy as a socket's, and a session that goes the pong wait
+// without a poll is closed and unregistered like a socket that stopped
+// answering pings.
+//
+//	http.Handle("/poll", reg.LongPollHandler(router))
+//
 // # What it does not do
 //
-// Delivery is best-effort. Each connection has a 256-message outbound buffer and
-// [Registry.Broadcast] drops - with a log line - to any connection whose buffer
-// is full, rather than blocking the broadcaster. There is no acknowledgement, no
-// retry, and no replay for a client that reconnects.
+// Plain delivery is best-effort. Each connection has a 256-message outbound
+// buffer by default and [Registry.Broadcast] closes any connection whose buffer
+// is full, rather than blocking the broadcaster. Without [WithSessions] there
+// is no replay for a client that reconnects.
+//
+// State lives in one process unless the Registry is given a [Backplane]. With
+// one, broadcasts, group deletion and presence events reach every replica and
+// [Registry.Presence] lists the keys of all of them, but group membership is
+// not replicated: each replica knows only its own members and keeps its own
+// [Registry.History], and [Registry.BroadcastReliable] reaches local
+// connections only.
+//
+// Inbound bytes reach your [MessageHandler] undecoded unless that handler is a
+// [Router], which decodes JSON envelopes only. [github.com/gclluch/go-rtc-lib/message]
+// provides IMessage implementations for the outbound path.
+//
+// # Multiple replicas
+//
+// Replicas behind a load balancer share broadcasts through a [Backplane] given
+// to each Registry with [WithBackplane]. Package
+// github.com/gclluch/go-rtc-lib/redisbackplane implements it over Redis pub/sub;
+// [MemoryBackplane] connects Registries in one process, for tests. A group is
+// the same group on every replica, so a broadcast to it reaches its members
+// wherever they are connected. Each replica drops its own messages when the
+// backplane hands them back.
+//
+// # Configuration
+//
+// Buffer sizes, the inbound read limit and the keepalive timings are set with
+// [Option] values, once for the whole registry and optionally per handler:
+//
+//	reg := connection.NewRegistry(connection.WithSendBuffer(1024))
+//	http.Handle("/feed", reg.RegisterHandler(feed, connection.WithPingInterval(5*time.Second)))
+//
+// The defaults are a 256-message send buffer, a 1 MiB read limit, a ping every
+// 30s, a 60s pong wait, a 10s write wait and 1 KiB upgrader buffers.
+//
+// # Slow consumers
+//
+// A connection whose outbound queue is full is not keeping up, and by default
+// it is closed with 1008, so a client that missed state reconnects rather
+// than carrying on stale. [WithSlowConsumerPolicy] chooses otherwise for a
+// registry or handler, and [Registry.SetGroupSlowConsumerPolicy] for one
+// group's broadcasts: [DropNewest] and [DropOldest] lose a message,
+// [Conflate] keeps only the latest, and [BlockFor] makes the sender wait a
+// bounded time for room.
+//
+//	reg := connection.NewRegistry()
+//	reg.SetGroupSlowConsumerPolicy("chat", connection.DropOldest)
+//	reg.SetGroupSlowConsumerPolicy("telemetry", connection.Conflate)
+//
+// Session control frames and codec switches are never dropped; a connection
+// that cannot take one is closed. Frames queued under the Registry's lock -
+// presence events and history and session replays - never wait either.
+// [Registry.SlowConsumerStats] counts what each policy did, as does
+// [Metrics].
+//
+// # Conflation
+//
+// A message that carries current state for something - a price, a player's
+// position, a dashboard tile - can carry a conflation key, by implementing
+// message.Keyed or through message.WithConflationKey. A keyed message that
+// finds one with the same key still waiting in a connection's queue replaces
+// it there, without taking more room:
+//
+//	reg.Broadcast(message.WithConflationKey(message.NewJSONMessage(tick), tick.Symbol), "ticks")
+//
+// A client that falls behind so catches up with the latest value for each
+// key rather than every step to it, and is only treated as a slow consumer
+// once it lags on more keys than its send buffer holds. The key crosses the
+// backplane with the message.
+//
+// # Priorities
+//
+// A connection's outbound queue has a lane per message.Priority. Mark a
+// message with message.WithPriority, or implement message.Prioritized, to
+// have it overtake what is queued at lower priority:
+//
+//	reg.SendToUser(userID, message.WithPriority(message.NewJSONMessage(alert), message.PriorityHigh))
+//
+// Replies to the client's requests, server calls and session control frames
+// are high priority already. The write pump takes the highest lane first
+// unless [WithPriorityScheduling] asks for [WeightedPriority], and [WithLane]
+// gives a lane its own capacity and slow-consumer policy - to drop
+// low-priority chatter that backs up, say, while still closing a connection
+// that cannot take its high-priority messages.
+//
+// # Compression
+//
+// [WithCompression] negotiates permessage-deflate with clients that offer it
+// and compresses outbound messages of at least a threshold size:
+//
+//	reg := connection.NewRegistry(connection.WithCompression(flate.BestSpeed, 512))
+//
+// A broadcast is compressed once per level, not once per recipient. Messages
+// that are compressed already opt out with message.NoCompression, or by
+// implementing message.Uncompressed; [Registry.SetGroupCompression] opts out a
+// whole group.
+//
+// # Logging
+//
+// Diagnostics go to slog.Default() unless [WithLogger] names another
+// *slog.Logger; [WithNopLogger] discards them. Records about a connection
+// carry its ID, remote address and user ID, and the record written when it
+// closes carries the close code and reason, under the keys [LogConnID] and
+// friends. Normal and going-away closes are logged at debug, so an info-level
+// handler sees only the unusual ones.
+//
+// # Metrics
+//
+// [WithMetrics] reports to a [Metrics] implementation: connections opened and
+// closed, upgrades by result, group sizes, frames and bytes read and written,
+// outbound queue depth, how long each broadcast took to fan out, and what
+// slow-consumer policies did. Package
+// github.com/gclluch/go-rtc-lib/prommetrics implements it and serves the
+// values to Prometheus:
+//
+//	m := prommetrics.New(prommetrics.DefaultNamespace)
+//	reg := connection.NewRegistry(connection.WithMetrics(m))
+//	http.Handle("/metrics", m)
+//
+// # Authentication
 //
-// State lives in one process. A Registry is not shared across replicas, so two
-// instances behind a load balancer do not see each other's connections.
+// [WithAuthenticator] runs an [Authenticator] on each upgrade request before it
+// is upgraded, so an unauthenticated client gets a 401 rather than a socket.
+// The [Principal] it returns - user ID, roles, claims - is available from
+// [Connection.Principal], and the connection is closed when its credential
+// expires. [JWTHMAC] and [JWTRS256] verify JWTs read from the Authorization
+// header, a cookie, a query parameter or the Sec-WebSocket-Protocol header:
 //
-// Inbound bytes reach your [MessageHandler] undecoded. [github.com/gclluch/go-rtc-lib/message]
-// provides IMessage implementations for the outbound path; the library does not
-// deserialize what it receives.
+//	reg := connection.NewRegistry(connection.WithAuthenticator(
+//	    connection.JWTHMAC(secret, connection.FromProtocol("access_token"), connection.FromCookie("session")),
+//	))
 //
 // # Origin checking
 //
@@ -64,7 +344,7 @@
 // once and from either of them.
 //
 // The exported Connection.Send channel and Connection.WS field are part of the
-// v1 API and are kept for compatibility. Prefer [Registry.Broadcast] over sending
-// to Send directly, and treat WS as read-only - writing to the socket from
-// outside the write pump races it.
+// v1 API and are kept for compatibility. Send carries text frames only. Prefer
+// [Registry.Broadcast] over sending to Send directly, and treat WS as read-only -
+// writing to the socket from outside the write pump races it.
 package connection
@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"github.com/gclluch/go-rtc-lib/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame is one WebSocket data message: its payload and the frame type it
+// travels in, websocket.TextMessage or websocket.BinaryMessage.
+type Frame struct {
+	Type int
+	Data []byte
+
+	control bool // a session control frame, outside the session's sequence
+
+	// noCompress keeps the frame uncompressed on a connection that negotiated
+	// compression; see WithCompression. prepared, if set, is the frame
+	// prepared once for every recipient of a broadcast, so it is compressed
+	// once per compression level rather than once per connection.
+	noCompress bool
+	prepared   *websocket.PreparedMessage
+
+	// msg is the message Data was serialized from, if a Codec can encode it,
+	// and codec the codec Data is in, nil for msg's own format. The write pump
+	// re-encodes a frame whose codec is not its connection's. switchTo, if
+	// set, is the codec the connection writes every frame after this one in.
+	// See Connection.SetCodec.
+	msg      message.IMessage
+	codec    message.Codec
+	switchTo message.Codec
+
+	// key is the frame's conflation key, if it has one: a newer frame with
+	// the same key replaces it while it waits in the queue. See outQueue.
+	key string
+
+	priority message.Priority // which of the queue's lanes it waits in
+
+	// seq is a replayed frame's number in its session's sequence, which it
+	// had before it was replayed; see session.go.
+	seq uint64
+}
+
+// TextFrame returns data as a text frame. data must be valid UTF-8.
+func TextFrame(data []byte) Frame {
+	return Frame{Type: websocket.TextMessage, Data: data}
+}
+
+// BinaryFrame returns data as a binary frame.
+func BinaryFrame(data []byte) Frame {
+	return Frame{Type: websocket.BinaryMessage, Data: data}
+}
+
+// IsBinary reports whether f is a binary frame.
+func (f Frame) IsBinary() bool {
+	return f.Type == websocket.BinaryMessage
+}
+
+// newFrame serializes msg into the frame type it declares; see message.Binary.
+func newFrame(msg message.IMessage) (Frame, error) {
+	data, err := msg.Serialize()
+	if err != nil {
+		return Frame{}, err
+	}
+	f := TextFrame(data)
+	if message.IsBinary(msg) {
+		f = BinaryFrame(data)
+	}
+	f.noCompress = message.IsUncompressed(msg)
+	f.key = message.ConflationKey(msg)
+	f.priority = message.PriorityOf(msg)
+	if message.IsEncodable(msg) {
+		f.msg = msg
+	}
+	return f, nil
+}
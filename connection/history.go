@@ -0,0 +1,210 @@
+package connection
+
+import (
+	"log/slog"
+	"time"
+)
+
+// History bounds what a group keeps of its past broadcasts. A zero field
+// leaves that dimension unbounded, but MaxMessages or MaxBytes must be set:
+// history kept by age alone could grow without limit under a burst.
+type History struct {
+	MaxMessages int           // messages kept
+	MaxBytes    int           // total payload bytes kept
+	MaxAge      time.Duration // how long a message is kept
+}
+
+// HistoryEntry is one broadcast a group's history kept.
+type HistoryEntry struct {
+	Seq   uint64 // counts up per group from 1, across the group's lifetime
+	Time  time.Time
+	Frame Frame // shared with every recipient; do not modify Data
+}
+
+// groupHistory is the kept past of one group. It is guarded by the registry's
+// mu, under which Broadcast records to it.
+type groupHistory struct {
+	limits  History
+	seq     uint64
+	entries []HistoryEntry // oldest first
+	bytes   int
+}
+
+func (h *groupHistory) append(f Frame, now time.Time) {
+	h.seq++
+	h.entries = append(h.entries, HistoryEntry{Seq: h.seq, Time: now, Frame: f})
+	h.bytes += len(f.Data)
+	h.prune(now)
+}
+
+// prune drops the oldest entries until the history is within its limits.
+func (h *groupHistory) prune(now time.Time) {
+	n := 0
+	for n < len(h.entries) && h.over(len(h.entries)-n, h.entries[n], now) {
+		h.bytes -= len(h.entries[n].Frame.Data)
+		n++
+	}
+	if n > 0 {
+		// Copy rather than reslice, so dropped frames are not kept alive by
+		// the backing array.
+		h.entries = append([]HistoryEntry(nil), h.entries[n:]...)
+	}
+}
+
+// over reports whether oldest, with kept entries in total, must go.
+func (h *groupHistory) over(kept int, oldest HistoryEntry, now time.Time) bool {
+	l := h.limits
+	return (l.MaxMessages > 0 && kept > l.MaxMessages) ||
+		(l.MaxBytes > 0 && h.bytes > l.MaxBytes) ||
+		(l.MaxAge > 0 && now.Sub(oldest.Time) > l.MaxAge)
+}
+
+// Replay selects which of a group's history a joining member is sent. The
+// zero Replay selects nothing.
+type Replay struct {
+	mode  replayMode
+	last  int
+	since time.Time
+	after uint64
+}
+
+type replayMode int
+
+const (
+	replayNone replayMode = iota
+	replayLast
+	replaySince
+	replayAfter
+)
+
+// ReplayLast selects the last n messages.
+func ReplayLast(n int) Replay {
+	return Replay{mode: replayLast, last: n}
+}
+
+// ReplaySince selects the messages broadcast after t.
+func ReplaySince(t time.Time) Replay {
+	return Replay{mode: replaySince, since: t}
+}
+
+// ReplayAfter selects the messages after seq; see HistoryEntry.
+func ReplayAfter(seq uint64) Replay {
+	return Replay{mode: replayAfter, after: seq}
+}
+
+// selectFrom returns the entries of h that p selects, oldest first.
+func (p Replay) selectFrom(h *groupHistory) []HistoryEntry {
+	entries := h.entries
+	i := 0
+	switch p.mode {
+	case replayLast:
+		if p.last <= 0 {
+			return nil
+		}
+		i = max(len(entries)-p.last, 0)
+	case replaySince:
+		for i < len(entries) && !entries[i].Time.After(p.since) {
+			i++
+		}
+	case replayAfter:
+		for i < len(entries) && entries[i].Seq <= p.after {
+			i++
+		}
+	default:
+		return nil
+	}
+	return entries[i:]
+}
+
+// SetHistory makes groupName keep its recent broadcasts within limits,
+// creating the group if it does not exist, so late joiners can be sent them;
+// see AddToGroupWithHistory. Only Broadcast to the group is kept - not
+// BroadcastToAll, nor reliable broadcasts. Changing the limits keeps what is
+// already there that fits; a zero History turns history off and discards it.
+// It panics if limits are negative, or bound only by age.
+func (r *Registry) SetHistory(groupName string, limits History) {
+	if limits.MaxMessages < 0 || limits.MaxBytes < 0 || limits.MaxAge < 0 {
+		panic("connection: negative history limit")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if limits == (History{}) {
+		delete(r.histories, groupName)
+		return
+	}
+	if limits.MaxMessages == 0 && limits.MaxBytes == 0 {
+		panic("connection: history needs MaxMessages or MaxBytes")
+	}
+
+	if _, exists := r.groups[groupName]; !exists {
+		r.groups[groupName] = make(map[*Connection]bool)
+		r.emit(Event{Kind: EventGroupCreated, Group: groupName})
+	}
+	h, exists := r.histories[groupName]
+	if !exists {
+		h = &groupHistory{}
+		r.histories[groupName] = h
+	}
+	h.limits = limits
+	h.prune(time.Now())
+}
+
+// History returns what groupName's history holds, oldest first. It is empty
+// if the group keeps none.
+func (r *Registry) History(groupName string) []HistoryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, exists := r.histories[groupName]
+	if !exists {
+		return nil
+	}
+	h.prune(time.Now())
+	return append([]HistoryEntry(nil), h.entries...)
+}
+
+// AddToGroupWithHistory adds conn to groupName as AddToGroup does, first
+// queueing the part of the group's history that from selects. The history and
+// the membership change under the same lock Broadcast records under, so each
+// broadcast reaches conn exactly once - replayed or live - and in order.
+//
+// Replay never overflows conn's send buffer: if the selection does not fit in
+// what is free of it, only the newest messages that fit are sent.
+func (r *Registry) AddToGroupWithHistory(groupName string, conn *Connection, from Replay) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.addToGroup(groupName, conn) {
+		return
+	}
+	h, exists := r.histories[groupName]
+	if !exists {
+		return
+	}
+	h.prune(time.Now())
+	replay := from.selectFrom(h)
+	frames := make([]Frame, len(replay))
+	for i, e := range replay {
+		frames[i] = e.Frame
+	}
+	if !conn.out.fits(frames) {
+		sent := frames
+		for len(sent) > 0 && !conn.out.fits(sent) {
+			sent = sent[1:]
+		}
+		conn.logger().Info("History replay trimmed to fit the send buffer", slog.String(LogGroup, groupName), slog.Int("selected", len(frames)), slog.Int("sent", len(sent)))
+		frames = sent
+	}
+	for _, f := range frames {
+		conn.queueHeld(f, r.slowPolicy(groupName))
+	}
+}
+
+// recordHistory keeps f in groupName's history, if it has one. Callers hold
+// r.mu.
+func (r *Registry) recordHistory(f Frame, groupName string) {
+	if h, exists := r.histories[groupName]; exists {
+		h.append(f, time.Now())
+	}
+}
@@ -0,0 +1,132 @@
+package connection
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// drain returns the payloads queued on conn so far.
+func drain(conn *Connection) []string {
+	var got []string
+	for f, ok := conn.out.pop(); ok; f, ok = conn.out.pop() {
+		got = append(got, string(f.Data))
+	}
+	return got
+}
+
+func say(r *Registry, group string, texts ...string) {
+	for _, text := range texts {
+		r.Broadcast(&message.ByteMessage{Data: []byte(text)}, group)
+	}
+}
+
+func TestLateJoinerGetsLastMessagesThenLiveTraffic(t *testing.T) {
+	r := NewRegistry()
+	r.SetHistory("room", History{MaxMessages: 3})
+	say(r, "room", "a", "b", "c", "d")
+
+	conn := registered(r)
+	r.AddToGroupWithHistory("room", conn, ReplayLast(2))
+	say(r, "room", "e")
+
+	if got, want := drain(conn), []string{"c", "d", "e"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestHistoryIsBoundedByBytesAndAge(t *testing.T) {
+	r := NewRegistry()
+	r.SetHistory("room", History{MaxMessages: 10, MaxBytes: 6})
+	say(r, "room", "aaa", "bbb", "ccc")
+	if got := r.History("room"); len(got) != 2 || string(got[0].Frame.Data) != "bbb" {
+		t.Fatalf("got %d entries starting %q, want bbb and ccc", len(got), got[0].Frame.Data)
+	}
+
+	r.SetHistory("room", History{MaxMessages: 10, MaxAge: time.Minute})
+	r.mu.Lock()
+	r.histories["room"].entries[0].Time = time.Now().Add(-time.Hour)
+	r.mu.Unlock()
+	if got := r.History("room"); len(got) != 1 || string(got[0].Frame.Data) != "ccc" {
+		t.Fatalf("got %d entries, want only ccc to be young enough", len(got))
+	}
+}
+
+func TestReplaySinceAndAfter(t *testing.T) {
+	r := NewRegistry()
+	r.SetHistory("room", History{MaxMessages: 10})
+	say(r, "room", "a", "b", "c")
+	entries := r.History("room")
+
+	after := registered(r)
+	r.AddToGroupWithHistory("room", after, ReplayAfter(entries[0].Seq))
+	if got, want := drain(after), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("ReplayAfter: got %q, want %q", got, want)
+	}
+
+	since := registered(r)
+	r.AddToGroupWithHistory("room", since, ReplaySince(entries[1].Time.Add(-time.Nanosecond)))
+	if got, want := drain(since), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("ReplaySince: got %q, want %q", got, want)
+	}
+
+	none := registered(r)
+	r.AddToGroupWithHistory("room", none, Replay{})
+	if got := drain(none); len(got) != 0 {
+		t.Errorf("zero Replay: got %q, want nothing", got)
+	}
+}
+
+func TestHistoryReplayNeverOverflowsTheQueue(t *testing.T) {
+	r := NewRegistry()
+	r.SetHistory("room", History{MaxMessages: 10})
+	say(r, "room", "a", "b", "c", "d")
+
+	conn := registered(r, WithSendBuffer(2))
+	r.AddToGroupWithHistory("room", conn, ReplayLast(4))
+	if got, want := drain(conn), []string{"c", "d"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want the newest that fit, %q", got, want)
+	}
+	select {
+	case <-conn.done:
+		t.Fatal("replaying history closed the connection")
+	default:
+	}
+}
+
+// A member joining mid-stream sees every message exactly once and in order,
+// whichever side of the join each broadcast lands on.
+func TestJoinWithHistoryIsOrderedAgainstConcurrentBroadcasts(t *testing.T) {
+	const n = 200
+	r := NewRegistry()
+	r.SetHistory("room", History{MaxMessages: n})
+	conn := registered(r, WithSendBuffer(2*n))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= n; i++ {
+			say(r, "room", strconv.Itoa(i))
+		}
+	}()
+	for len(r.History("room")) < n/2 {
+		time.Sleep(time.Millisecond)
+	}
+	r.AddToGroupWithHistory("room", conn, ReplayAfter(0))
+	wg.Wait()
+
+	got := drain(conn)
+	if len(got) != n {
+		t.Fatalf("got %d messages, want %d", len(got), n)
+	}
+	for i, text := range got {
+		if text != strconv.Itoa(i+1) {
+			t.Fatalf("message %d is %q, want %d", i, text, i+1)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package connection
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrNoToken is returned by a JWT Authenticator when none of its sources
+// carried a token.
+var ErrNoToken = errors.New("connection: no token in request")
+
+// TokenSource finds a bearer token in an upgrade request. protocol is the
+// Sec-WebSocket-Protocol to answer with, for a source that reads that header.
+type TokenSource func(req *http.Request) (token, protocol string)
+
+// FromHeader reads the token from an "Authorization: Bearer <token>" header.
+// Browsers cannot set it on a WebSocket; other clients can.
+func FromHeader() TokenSource {
+	return func(req *http.Request) (string, string) {
+		auth := req.Header.Get("Authorization")
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return strings.TrimSpace(auth[7:]), ""
+		}
+		return "", ""
+	}
+}
+
+// FromCookie reads the token from the cookie name.
+func FromCookie(name string) TokenSource {
+	return func(req *http.Request) (string, string) {
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value, ""
+		}
+		return "", ""
+	}
+}
+
+// FromQuery reads the token from the query parameter param. URLs end up in
+// access logs, so prefer another source where the client can use one.
+func FromQuery(param string) TokenSource {
+	return func(req *http.Request) (string, string) {
+		return req.URL.Query().Get(param), ""
+	}
+}
+
+// FromProtocol reads the token from the Sec-WebSocket-Protocol header, as the
+// protocol offered right after marker - the one way a browser can send a
+// token without putting it in the URL:
+//
+//	new WebSocket(url, ["access_token", token])
+//
+// The upgrade answers with marker.
+func FromProtocol(marker string) TokenSource {
+	return func(req *http.Request) (string, string) {
+		var offered []string
+		for _, h := range req.Header.Values("Sec-WebSocket-Protocol") {
+			for _, p := range strings.Split(h, ",") {
+				offered = append(offered, strings.TrimSpace(p))
+			}
+		}
+		for i := 0; i+1 < len(offered); i++ {
+			if offered[i] == marker {
+				return offered[i+1], marker
+			}
+		}
+		return "", ""
+	}
+}
+
+// jwtAuthenticator verifies a JWT signed with one fixed algorithm and key.
+type jwtAuthenticator struct {
+	method  string
+	key     any
+	sources []TokenSource
+}
+
+// JWTHMAC returns an Authenticator for HS256 tokens signed with secret, read
+// from the first of sources that has one; FromHeader if none are given.
+func JWTHMAC(secret []byte, sources ...TokenSource) Authenticator {
+	return newJWTAuthenticator(jwt.SigningMethodHS256.Alg(), secret, sources)
+}
+
+// JWTRS256 returns an Authenticator for RS256 tokens signed with the private
+// half of key, read from the first of sources that has one; FromHeader if
+// none are given.
+func JWTRS256(key *rsa.PublicKey, sources ...TokenSource) Authenticator {
+	return newJWTAuthenticator(jwt.SigningMethodRS256.Alg(), key, sources)
+}
+
+func newJWTAuthenticator(method string, key any, sources []TokenSource) *jwtAuthenticator {
+	if len(sources) == 0 {
+		sources = []TokenSource{FromHeader()}
+	}
+	return &jwtAuthenticator{method: method, key: key, sources: sources}
+}
+
+// Authenticate verifies the request's token - its signature, algorithm, and
+// exp and nbf if present - and requires a sub. The principal's user ID is sub,
+// its roles the "roles" claim, and its expiry exp.
+func (a *jwtAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	var token, protocol string
+	for _, source := range a.sources {
+		if token, protocol = source(req); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		return nil, ErrNoToken
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return a.key, nil
+	}, jwt.WithValidMethods([]string{a.method}))
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, errors.New("connection: token has no subject")
+	}
+	p := &Principal{UserID: sub, Roles: roles(claims["roles"]), Claims: claims, Subprotocol: protocol}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		p.ExpiresAt = exp.Time
+	}
+	return p, nil
+}
+
+// roles reads a roles claim given as a list or as one space-separated string.
+func roles(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var out []string
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseInfo is why a connection closed.
+type CloseInfo struct {
+	Code   int    // the WebSocket close code, such as websocket.CloseNormalClosure
+	Reason string // free text, possibly empty
+
+	// ByPeer is true if the peer closed the connection, with a close frame
+	// carrying Code and Reason, and false if the server did.
+	ByPeer bool
+
+	// SlowConsumer is true if the server evicted the connection for not
+	// draining its send buffer or for leaving too many messages unacked.
+	SlowConsumer bool
+}
+
+// Close codes the library closes connections with where RFC 6455 has none
+// that fits. The library reserves 4000-4099; an application's own codes for
+// CloseWithReason should start at 4100.
+//
+// The other server-initiated closes use the standard codes:
+// websocket.CloseGoingAway (1001) when Run's context is canceled,
+// websocket.ClosePolicyViolation (1008) for a slow consumer or an unacked
+// reliable message, websocket.CloseMessageTooBig (1009) for a message over
+// the read limit and websocket.CloseInternalServerErr (1011) for a handler
+// error. Registry.CloseAll takes any code, such as
+// websocket.CloseServiceRestart (1012) ahead of a deploy.
+const (
+	CloseGroupDeleted      = 4000 // Registry.DeleteGroup deleted a group it was in
+	CloseSessionTakenOver  = 4001 // its session resumed on another connection
+	CloseCredentialExpired = 4002 // its Principal's credential lapsed
+)
+
+// maxCloseReason is how many bytes of reason fit in a Close frame, after the
+// two-byte code, within the 125 bytes a control frame may carry.
+const maxCloseReason = 123
+
+// slowConsumerClose is how a connection that stopped draining is closed.
+var slowConsumerClose = CloseInfo{Code: websocket.ClosePolicyViolation, Reason: "slow consumer", SlowConsumer: true}
+
+// noteClose records why c is closing. The first reason recorded wins: once a
+// connection is closing, whatever fails next - the read pump, say - is a
+// consequence, not a cause.
+func (c *Connection) noteClose(info CloseInfo) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeInfo.Code == 0 {
+		c.closeInfo = info
+	}
+}
+
+// CloseWithReason closes the connection as CloseConnection does, with code and
+// reason in the Close frame the peer is sent. reason is cut to the 123 bytes a
+// Close frame has room for. A connection that is already closing keeps the
+// code it was closing with. It panics if code may not be sent in a Close
+// frame: only 1000-1003, 1007-1014 and 3000-4999 may.
+func (c *Connection) CloseWithReason(code int, reason string) {
+	mustSendable(code)
+	c.noteClose(CloseInfo{Code: code, Reason: reason})
+	c.CloseConnection()
+}
+
+// CloseAll closes every connection with code and reason, as CloseWithReason
+// does, and leaves the Registry running. Before a restart, closing with
+// websocket.CloseServiceRestart tells clients to reconnect, to another
+// replica or to this one once it is back.
+func (r *Registry) CloseAll(code int, reason string) {
+	mustSendable(code)
+	r.mu.Lock()
+	conns := make([]*Connection, 0, len(r.connections))
+	for conn := range r.connections {
+		conns = append(conns, conn)
+	}
+	r.mu.Unlock()
+
+	// Outside the lock: each close waits for its write pump's Close frame.
+	for _, conn := range conns {
+		conn.CloseWithReason(code, reason)
+	}
+}
+
+func mustSendable(code int) {
+	if !sendable(code) {
+		panic(fmt.Sprintf("connection: close code %d may not be sent in a Close frame", code))
+	}
+}
+
+// sendable reports whether code may be sent in a Close frame. 1005, 1006 and
+// 1015 are reserved for reporting a close that had no such code.
+func sendable(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// closeMessage is the payload of the Close frame for info: its code and as
+// much of its reason as fits, or nothing if the code may not be sent.
+func closeMessage(info CloseInfo) []byte {
+	if !sendable(info.Code) {
+		return []byte{}
+	}
+	reason := info.Reason
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+		// Do not split a character: the reason must be valid UTF-8.
+		for len(reason) > 0 && !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	return websocket.FormatCloseMessage(info.Code, reason)
+}
+
+// CloseInfo returns why the connection closed, or the zero CloseInfo while it
+// is open.
+func (c *Connection) CloseInfo() CloseInfo {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeInfo
+}
+
+// EventKind is what happened in an Event.
+type EventKind int
+
+const (
+	EventConnect EventKind = iota + 1
+	EventDisconnect
+	EventJoin
+	EventLeave
+	EventGroupCreated
+	EventGroupDeleted
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventConnect:
+		return "connect"
+	case EventDisconnect:
+		return "disconnect"
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventGroupCreated:
+		return "group_created"
+	case EventGroupDeleted:
+		return "group_deleted"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is one change to a Registry's connections or groups.
+type Event struct {
+	Kind  EventKind
+	Time  time.Time
+	Conn  *Connection // nil for group events
+	Group string      // empty for connect and disconnect
+	Close CloseInfo   // for EventDisconnect
+}
+
+// Hooks are functions a Registry calls as its connections and groups change.
+// Any of them may be nil. They run one at a time and in the order the changes
+// happened, on a goroutine of the Registry's rather than the caller's, so they
+// may call back into the Registry - OnConnect adding the connection to a
+// group, say. They should return quickly: a slow hook delays every later one.
+// Every event reaches them, however far behind they fall - the events wait,
+// costing memory rather than an OnDisconnect an application cleans up in.
+// Only an Events subscriber that falls behind misses events.
+type Hooks struct {
+	OnConnect      func(conn *Connection)
+	OnDisconnect   func(conn *Connection, info CloseInfo)
+	OnJoin         func(group string, conn *Connection)
+	OnLeave        func(group string, conn *Connection)
+	OnGroupCreated func(group string)
+	OnGroupDeleted func(group string)
+}
+
+func (h *Hooks) call(ev Event) {
+	switch ev.Kind {
+	case EventConnect:
+		if h.OnConnect != nil {
+			h.OnConnect(ev.Conn)
+		}
+	case EventDisconnect:
+		if h.OnDisconnect != nil {
+			h.OnDisconnect(ev.Conn, ev.Close)
+		}
+	case EventJoin:
+		if h.OnJoin != nil {
+			h.OnJoin(ev.Group, ev.Conn)
+		}
+	case EventLeave:
+		if h.OnLeave != nil {
+			h.OnLeave(ev.Group, ev.Conn)
+		}
+	case EventGroupCreated:
+		if h.OnGroupCreated != nil {
+			h.OnGroupCreated(ev.Group)
+		}
+	case EventGroupDeleted:
+		if h.OnGroupDeleted != nil {
+			h.OnGroupDeleted(ev.Group)
+		}
+	}
+}
+
+// Events returns a channel that receives every Event from now on, buffered to
+// hold buffer of them. A subscriber that falls that far behind misses events
+// rather than holding the Registry up. stop ends the subscription and closes
+// the channel.
+func (r *Registry) Events(buffer int) (events <-chan Event, stop func()) {
+	ch := make(chan Event, buffer)
+	r.subMu.Lock()
+	r.subscribers[ch] = true
+	r.subMu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.subMu.Lock()
+			defer r.subMu.Unlock()
+			delete(r.subscribers, ch)
+			close(ch)
+		})
+	}
+}
+
+// emit queues ev for the hooks and subscribers. Callers hold r.mu, so events
+// queue in the order the changes were made under it. A dispatch goroutine
+// runs while there are events queued.
+func (r *Registry) emit(ev Event) {
+	ev.Time = time.Now()
+	r.measure(ev)
+	r.pending = append(r.pending, ev)
+	if !r.dispatching {
+		r.dispatching = true
+		go r.dispatch()
+	}
+}
+
+// dispatch delivers queued events until there are none left.
+func (r *Registry) dispatch() {
+	for {
+		r.mu.Lock()
+		batch := r.pending
+		r.pending = nil
+		if len(batch) == 0 {
+			r.dispatching = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+
+		for _, ev := range batch {
+			r.Hooks.call(ev)
+			r.subMu.Lock()
+			for ch := range r.subscribers {
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+			r.subMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// nextEvent reads the next event, skipping kinds the test does not care about.
+func nextEvent(t *testing.T, events <-chan Event, kinds ...EventKind) Event {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			for _, k := range kinds {
+				if ev.Kind == k {
+					return ev
+				}
+			}
+		case <-deadline:
+			t.Fatalf("no %v event", kinds)
+			return Event{}
+		}
+	}
+}
+
+func TestHooksFollowAConnectionThroughItsLife(t *testing.T) {
+	r := NewRegistry()
+	disconnected := make(chan CloseInfo, 1)
+	left := make(chan string, 1)
+	r.Hooks = Hooks{
+		OnConnect:    func(conn *Connection) { r.AddToGroup("lobby", conn) }, // hooks may call back in
+		OnLeave:      func(group string, conn *Connection) { left <- group },
+		OnDisconnect: func(conn *Connection, info CloseInfo) { disconnected <- info },
+	}
+	events, stop := r.Events(16)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	srv := httptest.NewServer(r.RegisterHandler(nil))
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	connected := nextEvent(t, events, EventConnect)
+	if ev := nextEvent(t, events, EventGroupCreated, EventJoin); ev.Kind != EventGroupCreated || ev.Group != "lobby" {
+		t.Fatalf("got %v %q, want lobby created first", ev.Kind, ev.Group)
+	}
+	if ev := nextEvent(t, events, EventJoin); ev.Conn != connected.Conn || ev.Group != "lobby" {
+		t.Fatalf("got %+v, want the connection joining lobby", ev)
+	}
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "bye"))
+	ws.Close()
+
+	select {
+	case group := <-left:
+		if group != "lobby" {
+			t.Fatalf("left %q, want lobby", group)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnLeave never ran")
+	}
+	select {
+	case info := <-disconnected:
+		if !info.ByPeer || info.Code != 4001 || info.Reason != "bye" || info.SlowConsumer {
+			t.Fatalf("got %+v, want the peer's 4001 bye", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect never ran")
+	}
+}
+
+func TestDisconnectReportsSlowConsumerEviction(t *testing.T) {
+	r := NewRegistry()
+	events, stop := r.Events(16)
+	defer stop()
+
+	conn := NewConnection(nil, nil, WithSendBuffer(1))
+	r.registerConnection(conn)
+	r.BroadcastToAll(message.NewJSONMessage(1))
+	r.BroadcastToAll(message.NewJSONMessage(2)) // overflows
+	<-conn.done
+	r.unregisterConnection(conn)
+
+	ev := nextEvent(t, events, EventDisconnect)
+	if !ev.Close.SlowConsumer || ev.Close.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("got %+v, want a slow-consumer eviction", ev.Close)
+	}
+}
+
+func TestShutdownReportsGoingAway(t *testing.T) {
+	r := NewRegistry()
+	events, stop := r.Events(16)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { r.Run(ctx); close(done) }()
+	conn := NewConnection(nil, nil)
+	r.register <- conn
+	nextEvent(t, events, EventConnect)
+
+	cancel()
+	<-done
+	if ev := nextEvent(t, events, EventDisconnect); ev.Close.Code != websocket.CloseGoingAway || ev.Close.ByPeer {
+		t.Fatalf("got %+v, want going away from the server", ev.Close)
+	}
+}
+
+func TestGroupEventsAndBoundedSubscription(t *testing.T) {
+	r := NewRegistry()
+	slow, stopSlow := r.Events(1)
+	defer stopSlow()
+	events, stop := r.Events(16)
+	defer stop()
+
+	r.CreateGroup("room")
+	r.CreateGroup("room") // already there; no event
+	r.DeleteGroup("room")
+
+	if ev := nextEvent(t, events, EventGroupCreated, EventGroupDeleted); ev.Kind != EventGroupCreated {
+		t.Fatalf("got %v, want group_created", ev.Kind)
+	}
+	if ev := nextEvent(t, events, EventGroupCreated, EventGroupDeleted); ev.Kind != EventGroupDeleted {
+		t.Fatalf("got %v, want group_deleted", ev.Kind)
+	}
+
+	// The subscriber with room for one kept the first event and missed the
+	// second rather than holding the registry up.
+	if ev := <-slow; ev.Kind != EventGroupCreated {
+		t.Fatalf("got %v, want group_created", ev.Kind)
+	}
+	select {
+	case ev := <-slow:
+		t.Fatalf("got %v, want the overflow dropped", ev.Kind)
+	default:
+	}
+
+	stopSlow()
+	if _, open := <-slow; open {
+		t.Fatal("stop left the channel open")
+	}
+}
+
+// closeCode reads from ws until the server's Close frame arrives.
+func closeCode(t *testing.T, ws *websocket.Conn) (int, string) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("got %v, want a Close frame", err)
+			}
+			return ce.Code, ce.Text
+		}
+	}
+}
+
+func TestCloseWithReasonTellsThePeer(t *testing.T) {
+	r := NewRegistry()
+	disconnected := make(chan CloseInfo, 1)
+	r.Hooks.OnDisconnect = func(conn *Connection, info CloseInfo) { disconnected <- info }
+	ws, conn := dialCaptured(t, r)
+
+	conn.CloseWithReason(4100, "kicked")
+	if code, reason := closeCode(t, ws); code != 4100 || reason != "kicked" {
+		t.Fatalf("peer got %d %q, want 4100 kicked", code, reason)
+	}
+	select {
+	case info := <-disconnected:
+		if info.Code != 4100 || info.Reason != "kicked" || info.ByPeer {
+			t.Fatalf("got %+v, want the server's 4100", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect never ran")
+	}
+}
+
+func TestLibraryClosesCarryTheirCodes(t *testing.T) {
+	r := NewRegistry()
+	ws, conn := dialCaptured(t, r)
+	r.AddToGroup("room", conn)
+	r.DeleteGroup("room")
+	if code, _ := closeCode(t, ws); code != CloseGroupDeleted {
+		t.Fatalf("group deletion: peer got %d, want %d", code, CloseGroupDeleted)
+	}
+
+	r = NewRegistry()
+	ws, _ = dialCaptured(t, r)
+	r.CloseAll(websocket.CloseServiceRestart, "restarting")
+	if code, reason := closeCode(t, ws); code != websocket.CloseServiceRestart || reason != "restarting" {
+		t.Fatalf("CloseAll: peer got %d %q, want 1012 restarting", code, reason)
+	}
+}
+
+func TestCloseMessage(t *testing.T) {
+	long := strings.Repeat("é", 100) // 200 bytes; 123 would split a character
+	payload := closeMessage(CloseInfo{Code: 4100, Reason: long})
+	if len(payload) != 2+122 || !utf8.Valid(payload[2:]) {
+		t.Fatalf("got a %d-byte payload, want the reason cut to 122 bytes of whole characters", len(payload))
+	}
+	if got := closeMessage(CloseInfo{Code: websocket.CloseAbnormalClosure}); len(got) != 0 {
+		t.Fatalf("1006 got payload %v, want none", got)
+	}
+
+	for _, code := range []int{0, 1005, 1006, 1015, 2000, 5000} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("CloseWithReason(%d) did not panic", code)
+				}
+			}()
+			NewConnection(nil, nil).CloseWithReason(code, "")
+		}()
+	}
+}
+
+// A stuck hook delays events but loses none of them, while a subscriber that
+// falls behind misses what its buffer cannot hold.
+func TestHooksGetEveryEvent(t *testing.T) {
+	r := NewRegistry()
+	events, stop := r.Events(1)
+	defer stop()
+	entered, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	r.Hooks.OnGroupCreated = func(string) {
+		if calls.Add(1) == 1 {
+			close(entered)
+			<-release
+		}
+	}
+
+	const n = 2000
+	r.CreateGroup("first")
+	<-entered
+	for i := 0; i < n; i++ {
+		r.CreateGroup(strconv.Itoa(i))
+	}
+	close(release)
+	for deadline := time.Now().Add(2 * time.Second); calls.Load() != n+1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d hook calls, want %d", calls.Load(), n+1)
+		}
+	}
+	if got := len(events); got != 1 {
+		t.Errorf("subscriber holds %d events, want its buffer's 1", got)
+	}
+}
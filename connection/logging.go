@@ -0,0 +1,65 @@
+package connection
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// Attribute keys the package logs with, so records about one connection or
+// group can be found and correlated whatever handler formats them.
+const (
+	LogConnID      = "conn_id"
+	LogUserID      = "user_id"
+	LogRemoteAddr  = "remote_addr"
+	LogGroup       = "group"
+	LogCloseCode   = "close_code"
+	LogCloseReason = "close_reason"
+	LogError       = "error"
+)
+
+// nopHandler discards every record. slog has no such handler before Go 1.24.
+type nopHandler struct{}
+
+func (nopHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (nopHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h nopHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h nopHandler) WithGroup(string) slog.Handler           { return h }
+
+// log returns the logger c was configured with: slog.Default() unless an
+// Option said otherwise.
+func (c config) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+// logger returns the configured logger with c's attributes.
+func (c *Connection) logger() *slog.Logger {
+	l := c.cfg.log().With(slog.String(LogConnID, c.ID))
+	if c.WS != nil {
+		l = l.With(slog.String(LogRemoteAddr, c.WS.RemoteAddr().String()))
+	} else if c.transport != nil {
+		l = l.With(slog.String(LogRemoteAddr, c.transport.remoteAddr()))
+	}
+	if c.principal != nil {
+		l = l.With(slog.String(LogUserID, c.principal.UserID))
+	}
+	return l
+}
+
+// closeLevel is the level a connection's close is logged at: debug for the
+// closes that happen all day long, info for the rest.
+func closeLevel(info CloseInfo) slog.Level {
+	switch info.Code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+func closeAttrs(info CloseInfo) []any {
+	return []any{slog.Int(LogCloseCode, info.Code), slog.String(LogCloseReason, info.Reason)}
+}
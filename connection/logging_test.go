@@ -0,0 +1,96 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// records decodes the JSON lines a slog.JSONHandler wrote to buf.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad record %q: %v", line, err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestNormalCloseLogsAtDebugWithAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	r := NewRegistry(WithLogger(logger))
+	conn := NewConnection(nil, nil, WithLogger(logger))
+	conn.principal = &Principal{UserID: "alice"}
+	r.registerConnection(conn)
+
+	conn.CloseConnection()
+	r.unregisterConnection(conn)
+
+	recs := records(t, &buf)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1: %v", len(recs), recs)
+	}
+	rec := recs[0]
+	if rec["level"] != "DEBUG" || rec["msg"] != "Connection closed" {
+		t.Fatalf("got %v %q, want a debug close", rec["level"], rec["msg"])
+	}
+	if rec[LogConnID] != conn.ID || rec[LogUserID] != "alice" || rec[LogCloseCode] != float64(1000) {
+		t.Fatalf("got %v, want conn_id, user_id and close_code 1000", rec)
+	}
+}
+
+func TestEvictionLogsAtWarn(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	r := NewRegistry(WithLogger(logger))
+	conn := NewConnection(nil, nil, WithLogger(logger), WithSendBuffer(1))
+	r.registerConnection(conn)
+
+	r.BroadcastToAll(message.NewJSONMessage(1))
+	r.BroadcastToAll(message.NewJSONMessage(2)) // overflows
+	<-conn.done
+	r.unregisterConnection(conn)
+
+	var levels []any
+	for _, rec := range records(t, &buf) {
+		if rec[LogConnID] != conn.ID {
+			t.Errorf("record without conn_id: %v", rec)
+		}
+		levels = append(levels, rec["level"])
+	}
+	// The eviction, then the close with its policy-violation code.
+	if len(levels) != 2 || levels[0] != "WARN" || levels[1] != "INFO" {
+		t.Fatalf("got levels %v, want WARN then INFO", levels)
+	}
+}
+
+func TestNopLoggerIsSilent(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	r := NewRegistry(WithNopLogger())
+	conn := NewConnection(nil, nil, WithNopLogger(), WithSendBuffer(1))
+	r.registerConnection(conn)
+	r.BroadcastToAll(message.NewJSONMessage(1))
+	r.BroadcastToAll(message.NewJSONMessage(2))
+	r.Broadcast(message.NewJSONMessage(3), "nowhere")
+	<-conn.done
+	r.unregisterConnection(conn)
+
+	if buf.Len() != 0 {
+		t.Fatalf("nop logger wrote %q", buf.String())
+	}
+}
@@ -0,0 +1,293 @@
+package connection
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Long polling.
+//
+// LongPollHandler serves clients for which neither a WebSocket nor a
+// streaming response survives the network in between. A GET without a token
+// opens a session, a connection of the Registry like any other, and answers
+//
+//	{"id": "<connection ID>", "token": "..."}
+//
+// A GET with ?token=<token> is a poll. It is held until the connection has a
+// frame queued, or for the ping interval if none comes, and answered with
+// every frame queued by then, oldest first:
+//
+//	{"frames": [{"type": "text", "data": "..."}, {"type": "binary", "data": "<base64>"}]}
+//
+// If the connection has closed, the answer says why - {"frames": [], "close":
+// {"code": 1000, "reason": "..."}} - and the client should not poll again;
+// the session is unregistered once a poll has been told, or after the write
+// wait if none comes, as a WebSocket is once its Close frame is written. A
+// session has one poll at a time; a second is answered 409. As on a
+// WebSocket, frames wait in the connection's queue while no poll is held, and
+// a client that stops polling fills it and meets the slow-consumer policy. A
+// session that goes the pong wait without a poll has gone away, and is closed
+// and unregistered. Frames are POSTed, one per request, to the same URL with
+// ?token=<token>; see handlePost.
+//
+// A frame is written once, to the poll it was taken for; if that answer is
+// lost, so is the frame, as one written to a socket that then drops is. With
+// WithSessions, a client can open a new session with ?resume and last_seq to
+// get it back; see session.go.
+
+// Frame types in a poll's answer.
+const (
+	pollText   = "text"
+	pollBinary = "binary"
+)
+
+// pollFrame is one frame in a poll's answer.
+type pollFrame struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// pollAnswer is what a poll is answered with.
+type pollAnswer struct {
+	Frames []pollFrame `json:"frames"`
+	Close  *closeData  `json:"close,omitempty"`
+}
+
+// LongPollHandler returns an http.HandlerFunc that serves connections tracked
+// by r over long polling: a GET opens a session or polls one for the frames
+// it is sent, and a POST is a frame from a session's client, dispatched to
+// customHandler. The ping interval is how long a poll is held, and the pong
+// wait how long a session lasts without one. opts override the registry's
+// settings for the connections this handler accepts only; it panics if they
+// are invalid.
+func (r *Registry) LongPollHandler(customHandler MessageHandler, opts ...Option) http.HandlerFunc {
+	cfg := r.cfg.resolve(opts...)
+	cfg.metrics = r.cfg.metrics
+	r.addCodecs(cfg)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodPost:
+			r.handlePost(w, req)
+		case req.Method != http.MethodGet:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		case req.URL.Query().Has(tokenParam):
+			r.poll(w, req)
+		default:
+			r.openPoll(cfg, customHandler, w, req)
+		}
+	}
+}
+
+// openPoll opens a long-poll session and answers with its ID and token once
+// it is registered.
+func (r *Registry) openPoll(cfg config, customHandler MessageHandler, w http.ResponseWriter, req *http.Request) {
+	principal, ok := authenticate(cfg.authenticator, cfg.log(), w, req)
+	if !ok {
+		cfg.metrics.Upgrade(UpgradeUnauthorized)
+		return
+	}
+
+	p := &longPoll{tok: newToken(), addr: req.RemoteAddr, told: make(chan struct{}), seen: time.Now()}
+	client := newConnection(nil, customHandler, cfg)
+	client.transport = p
+	client.principal = principal
+	if cfg.sessionGrace > 0 {
+		client.resume = parseResume(req)
+	}
+	go r.serve(client, func() { client.expireIdle(p) })
+	select {
+	case <-client.registered:
+	case <-client.done:
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	cfg.metrics.Upgrade(UpgradeOK)
+	writeJSON(w, openData{ID: client.ID, Token: p.tok})
+}
+
+// poll answers one poll of the session req names.
+func (r *Registry) poll(w http.ResponseWriter, req *http.Request) {
+	conn, ok := r.requested(w, req)
+	if !ok {
+		return
+	}
+	p, ok := conn.transport.(*longPoll)
+	if !ok {
+		http.Error(w, "not a long-poll session", http.StatusBadRequest)
+		return
+	}
+	if !p.begin() {
+		http.Error(w, "already polling", http.StatusConflict)
+		return
+	}
+	defer p.end()
+
+	answer := pollAnswer{Frames: []pollFrame{}}
+	if info, closed := conn.pollFrames(req.Context(), p); closed {
+		answer.Close = &closeData{Code: info.Code, Reason: info.Reason}
+	}
+	answer.Frames = append(answer.Frames, p.batch...)
+	p.batch = nil
+	writeJSON(w, answer)
+	if answer.Close != nil {
+		p.toldOnce.Do(func() { close(p.told) })
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// pollFrames is the write pump of a connection on p for the length of one
+// poll: it waits up to the ping interval for a frame, then writes every frame
+// queued into p's batch. It returns c's close info if c has closed.
+func (c *Connection) pollFrames(ctx context.Context, p *longPoll) (info CloseInfo, closed bool) {
+	timer := time.NewTimer(c.cfg.pingInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			// First, since a closing connection's queue is dropped, as the
+			// write pump drops it for the Close frame.
+			return c.CloseInfo(), true
+		default:
+		}
+		select {
+		case <-c.done:
+			return c.CloseInfo(), true
+		case <-ctx.Done():
+			return CloseInfo{}, false
+		case <-timer.C:
+			return CloseInfo{}, false
+		case <-c.out.ready:
+		case data := <-c.Send:
+			if err := c.write(TextFrame(data)); err != nil {
+				return c.pollFailed(err), true
+			}
+		}
+		for {
+			frame, ok := c.out.pop()
+			if !ok {
+				break
+			}
+			if err := c.write(frame); err != nil {
+				return c.pollFailed(err), true
+			}
+		}
+		if len(p.batch) > 0 {
+			return CloseInfo{}, false
+		}
+	}
+}
+
+// pollFailed closes c after a failed write, from the outbound middleware or
+// a re-encode, as the write pump closes a WebSocket, and returns why.
+func (c *Connection) pollFailed(err error) CloseInfo {
+	c.writeFailed(err)
+	c.CloseConnection()
+	return c.CloseInfo()
+}
+
+// expireIdle is the only pump of a connection on p, whose polls do its
+// writing: it closes c once it has gone the pong wait without a poll. When c
+// closes otherwise, it waits for a poll to be told, for up to the write wait.
+func (c *Connection) expireIdle(p *longPoll) {
+	timer := time.NewTimer(c.cfg.pongWait)
+	defer func() {
+		timer.Stop()
+		c.CloseConnection()
+		c.wg.Done()
+	}()
+	for {
+		select {
+		case <-c.done:
+			close(c.writeDone) // no write pump will; see CloseConnection
+			select {
+			case <-p.told:
+			case <-time.After(c.cfg.writeWait):
+			}
+			return
+		case <-timer.C:
+			idle := p.idle()
+			if idle >= c.cfg.pongWait {
+				c.noteClose(CloseInfo{Code: websocket.CloseAbnormalClosure, Reason: "long-poll session expired"})
+				close(c.writeDone)
+				return
+			}
+			timer.Reset(c.cfg.pongWait - idle)
+		}
+	}
+}
+
+// longPoll is the transport of a connection LongPollHandler accepted. Its
+// frames are written into batch by the poll being answered, the only one.
+type longPoll struct {
+	tok   string
+	addr  string
+	batch []pollFrame
+
+	// told is closed once a poll has been answered with the connection's
+	// close.
+	told     chan struct{}
+	toldOnce sync.Once
+
+	mu      sync.Mutex
+	polling bool
+	seen    time.Time // when the last poll began or ended
+}
+
+func (p *longPoll) token() string      { return p.tok }
+func (p *longPoll) remoteAddr() string { return p.addr }
+
+func (p *longPoll) write(_ *Connection, f Frame) error {
+	if f.IsBinary() {
+		p.batch = append(p.batch, pollFrame{Type: pollBinary, Data: base64.StdEncoding.EncodeToString(f.Data)})
+	} else {
+		p.batch = append(p.batch, pollFrame{Type: pollText, Data: string(f.Data)})
+	}
+	return nil
+}
+
+// ping and close have nothing to do: a poll is answered in time by itself,
+// and says if the connection has closed.
+func (p *longPoll) ping() error       { return nil }
+func (p *longPoll) close(_ CloseInfo) {}
+
+// begin marks a poll as held, unless one already is.
+func (p *longPoll) begin() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.polling {
+		return false
+	}
+	p.polling = true
+	p.seen = time.Now()
+	return true
+}
+
+func (p *longPoll) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.polling = false
+	p.seen = time.Now()
+}
+
+// idle returns how long the session has gone without a poll.
+func (p *longPoll) idle() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.polling {
+		return 0
+	}
+	return time.Since(p.seen)
+}
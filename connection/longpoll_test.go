@@ -0,0 +1,195 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// pollServer runs r and serves its LongPollHandler, with h and opts.
+func pollServer(t *testing.T, r *Registry, h MessageHandler, opts ...Option) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	srv := httptest.NewServer(r.LongPollHandler(h, opts...))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// openSession opens a long-poll session at url.
+func openSession(t *testing.T, url string) openData {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer resp.Body.Close()
+	var open openData
+	if err := json.NewDecoder(resp.Body).Decode(&open); err != nil || open.Token == "" {
+		t.Fatalf("open: got %+v (%v)", open, err)
+	}
+	return open
+}
+
+// pollOnce polls token's session at url, and returns the status and answer.
+func pollOnce(t *testing.T, url, token string) (int, pollAnswer) {
+	t.Helper()
+	resp, err := http.Get(url + "?" + tokenParam + "=" + token)
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	defer resp.Body.Close()
+	var answer pollAnswer
+	json.NewDecoder(resp.Body).Decode(&answer)
+	return resp.StatusCode, answer
+}
+
+func TestLongPollSessionIsARegistryMember(t *testing.T) {
+	r := NewRegistry()
+	echo := FrameHandlerFunc(func(_ *Connection, in Frame) (Frame, error) { return in, nil })
+	url := pollServer(t, r, echo)
+	open := openSession(t, url)
+
+	conn, ok := r.Connection(open.ID)
+	if !ok {
+		t.Fatalf("session %s is not registered", open.ID)
+	}
+	r.AddToGroup("room", conn)
+	r.Broadcast(message.NewJSONMessage("one"), "room")
+	r.SendTo(open.ID, &message.ByteMessage{Data: []byte{0, 1}})
+	_, answer := pollOnce(t, url, open.Token)
+	want := []pollFrame{{Type: pollText, Data: `"one"`}, {Type: pollBinary, Data: "AAE="}}
+	if len(answer.Frames) != 2 || answer.Frames[0] != want[0] || answer.Frames[1] != want[1] {
+		t.Fatalf("poll: got %+v, want %+v", answer.Frames, want)
+	}
+
+	if code := postFrame(t, url, open.Token, "text/plain", "ping"); code != http.StatusNoContent {
+		t.Fatalf("POST: status %d", code)
+	}
+	if _, answer := pollOnce(t, url, open.Token); len(answer.Frames) != 1 || answer.Frames[0].Data != "ping" {
+		t.Errorf("reply: got %+v, want ping", answer.Frames)
+	}
+
+	conn.CloseWithReason(4000, "bye")
+	if _, answer := pollOnce(t, url, open.Token); answer.Close == nil || answer.Close.Code != 4000 {
+		t.Errorf("after close: got %+v, want close 4000", answer)
+	}
+}
+
+func TestPollWaitsForFramesOrThePingInterval(t *testing.T) {
+	r := NewRegistry()
+	url := pollServer(t, r, nil, WithPingInterval(100*time.Millisecond))
+	open := openSession(t, url)
+
+	start := time.Now()
+	if code, answer := pollOnce(t, url, open.Token); code != http.StatusOK || len(answer.Frames) != 0 || answer.Close != nil {
+		t.Fatalf("idle poll: got %d %+v, want an empty answer", code, answer)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("idle poll answered after %v, want the ping interval", waited)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		r.SendTo(open.ID, message.NewJSONMessage("late"))
+	}()
+	if _, answer := pollOnce(t, url, open.Token); len(answer.Frames) != 1 || answer.Frames[0].Data != `"late"` {
+		t.Errorf("held poll: got %+v, want late", answer.Frames)
+	}
+
+	go func() {
+		if resp, err := http.Get(url + "?" + tokenParam + "=" + open.Token); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	conn, _ := r.Connection(open.ID)
+	for conn.transport.(*longPoll).idle() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if code, _ := pollOnce(t, url, open.Token); code != http.StatusConflict {
+		t.Errorf("second poll: status %d, want 409", code)
+	}
+}
+
+func TestIdleLongPollSessionExpires(t *testing.T) {
+	r := NewRegistry()
+	events, stop := r.Events(16)
+	defer stop()
+	url := pollServer(t, r, nil, WithPingInterval(20*time.Millisecond), WithPongWait(100*time.Millisecond))
+	open := openSession(t, url)
+
+	// Polling keeps it alive past the pong wait.
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); {
+		pollOnce(t, url, open.Token)
+	}
+	if _, ok := r.Connection(open.ID); !ok {
+		t.Fatal("session expired while polled")
+	}
+
+	ev := nextEvent(t, events, EventDisconnect)
+	if ev.Conn.ID != open.ID || ev.Close.Reason != "long-poll session expired" {
+		t.Errorf("disconnect: got %s %+v, want %s expired", ev.Conn.ID, ev.Close, open.ID)
+	}
+	if code, _ := pollOnce(t, url, open.Token); code != http.StatusNotFound {
+		t.Errorf("poll after expiry: status %d, want 404", code)
+	}
+}
+
+func TestLongPollSessionMeetsTheSlowConsumerPolicy(t *testing.T) {
+	r := NewRegistry(WithSendBuffer(2))
+	url := pollServer(t, r, nil)
+	open := openSession(t, url)
+	conn, _ := r.Connection(open.ID)
+	r.AddToGroup("room", conn)
+
+	for _, text := range []string{"1", "2", "3"} {
+		r.Broadcast(message.NewJSONMessage(text), "room")
+	}
+	if got := r.SlowConsumerStats().Closed; got != 1 {
+		t.Fatalf("closed %d slow consumers, want 1", got)
+	}
+	if !closed(conn) {
+		t.Fatal("slow consumer was not closed")
+	}
+	if _, answer := pollOnce(t, url, open.Token); answer.Close == nil || answer.Close.Code != 1008 {
+		t.Errorf("poll after eviction: got %+v, want close 1008", answer)
+	}
+	if code, _ := pollOnce(t, url, open.Token); code != http.StatusNotFound {
+		t.Errorf("poll after the close was told: status %d, want 404", code)
+	}
+}
+
+// A write the outbound middleware fails closes a long-poll session as it
+// closes a WebSocket, and the poll is told.
+func TestLongPollWriteErrorClosesTheSession(t *testing.T) {
+	refuse := func(next WriteFunc) WriteFunc {
+		return func(c *Connection, f Frame) error {
+			if string(f.Data) == `"secret"` {
+				return errors.New("refused")
+			}
+			return next(c, f)
+		}
+	}
+	r := NewRegistry(WithNopLogger())
+	url := pollServer(t, r, nil, WithOutbound(refuse))
+	open := openSession(t, url)
+
+	r.SendTo(open.ID, message.NewJSONMessage("secret"))
+	_, answer := pollOnce(t, url, open.Token)
+	if answer.Close == nil || answer.Close.Code != websocket.CloseAbnormalClosure || answer.Close.Reason != "refused" {
+		t.Fatalf("got %+v, want close 1006 refused", answer)
+	}
+	conn, _ := r.Connection(open.ID)
+	if conn != nil && !closed(conn) {
+		t.Error("session still open after the failed write")
+	}
+}
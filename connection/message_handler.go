@@ -2,6 +2,16 @@
 package connection
 
 // MessageHandler defines the interface for processing incoming WebSocket messages.
+// A non-nil reply is sent back with the same frame type the message arrived in.
 type MessageHandler interface {
 	HandleMessage(conn *Connection, msg []byte) ([]byte, error)
 }
+
+// FrameHandler is implemented by a MessageHandler that needs to know whether a
+// message arrived as a text or a binary frame, or wants to pick the frame type
+// of its reply. When the handler implements it, HandleFrame is called instead
+// of HandleMessage. A reply with nil Data sends nothing.
+type FrameHandler interface {
+	MessageHandler
+	HandleFrame(conn *Connection, in Frame) (reply Frame, err error)
+}
@@ -0,0 +1,82 @@
+package connection
+
+import "time"
+
+// Upgrade results passed to Metrics.Upgrade.
+const (
+	UpgradeOK           = "ok"
+	UpgradeUnauthorized = "unauthorized" // the Authenticator rejected the request
+	UpgradeOrigin       = "origin"       // CheckOrigin rejected the request
+	UpgradeHandshake    = "handshake"    // the request was not a valid WebSocket handshake
+)
+
+// Metrics receives measurements from a Registry and its connections. Package
+// github.com/gclluch/go-rtc-lib/prommetrics implements it for Prometheus;
+// another implementation can feed any other system.
+//
+// Methods are called on hot paths - per message, and with the Registry's lock
+// held - so they must be quick and must not call back into the Registry.
+type Metrics interface {
+	// Upgrade counts an upgrade request, by one of the Upgrade* results.
+	Upgrade(result string)
+
+	// ConnectionOpened and ConnectionClosed bracket each registered
+	// connection's life; info says why it closed.
+	ConnectionOpened()
+	ConnectionClosed(info CloseInfo)
+
+	// GroupMembers reports how many connections group has after it was
+	// created or a member joined or left; GroupDeleted, that it is gone.
+	GroupMembers(group string, members int)
+	GroupDeleted(group string)
+
+	// MessageReceived and MessageSent count a data frame of frameType
+	// (websocket.TextMessage or websocket.BinaryMessage) and size bytes read
+	// from or written to a connection's socket.
+	MessageReceived(frameType, size int)
+	MessageSent(frameType, size int)
+
+	// QueueDepth reports how many frames a connection's outbound queue held
+	// just after one was queued.
+	QueueDepth(depth int)
+
+	// Broadcast reports how long a broadcast took to queue for its recipients
+	// on this replica.
+	Broadcast(recipients int, elapsed time.Duration)
+
+	// SlowConsumer counts n of one of the SlowConsumer* actions a full
+	// outbound queue led to; see SlowConsumerPolicy.
+	SlowConsumer(action string, n int)
+}
+
+// nopMetrics is the Metrics of a Registry that was given none.
+type nopMetrics struct{}
+
+func (nopMetrics) Upgrade(string)               {}
+func (nopMetrics) ConnectionOpened()            {}
+func (nopMetrics) ConnectionClosed(CloseInfo)   {}
+func (nopMetrics) GroupMembers(string, int)     {}
+func (nopMetrics) GroupDeleted(string)          {}
+func (nopMetrics) MessageReceived(int, int)     {}
+func (nopMetrics) MessageSent(int, int)         {}
+func (nopMetrics) QueueDepth(int)               {}
+func (nopMetrics) Broadcast(int, time.Duration) {}
+func (nopMetrics) SlowConsumer(string, int)     {}
+
+// measure reports what ev changed to the Registry's Metrics. It is called
+// from emit, so under r.mu, and sees the groups as ev left them.
+func (r *Registry) measure(ev Event) {
+	m := r.cfg.metrics
+	switch ev.Kind {
+	case EventConnect:
+		m.ConnectionOpened()
+	case EventDisconnect:
+		m.ConnectionClosed(ev.Close)
+	case EventJoin, EventLeave, EventGroupCreated:
+		if group, ok := r.groups[ev.Group]; ok {
+			m.GroupMembers(ev.Group, len(group))
+		}
+	case EventGroupDeleted:
+		m.GroupDeleted(ev.Group)
+	}
+}
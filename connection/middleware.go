@@ -0,0 +1,173 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a MessageHandler with behavior every message should get -
+// logging, panic recovery, auth checks, rate limits - so it is written once
+// rather than in each HandleMessage. It returns a handler that does its part
+// and calls next, or does not call next to stop the message there.
+type Middleware func(next MessageHandler) MessageHandler
+
+// Chain wraps h in mw, the first outermost: Chain(h, a, b) runs a, then b,
+// then h.
+//
+//	reg.RegisterHandler(connection.Chain(router,
+//	    connection.Recover(),
+//	    connection.LogMessages(slog.LevelDebug),
+//	    connection.MaxMessageSize(64<<10),
+//	))
+func Chain(h MessageHandler, mw ...Middleware) MessageHandler {
+	if h == nil {
+		panic("connection: Chain of a nil handler")
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// HandlerFunc adapts a function to a MessageHandler.
+type HandlerFunc func(conn *Connection, msg []byte) ([]byte, error)
+
+// HandleMessage implements MessageHandler.
+func (f HandlerFunc) HandleMessage(conn *Connection, msg []byte) ([]byte, error) {
+	return f(conn, msg)
+}
+
+// FrameHandlerFunc adapts a function to a FrameHandler. Middleware should
+// return one, calling next through HandleFrame, so that a FrameHandler it
+// wraps still sees frame types and picks its replies' frame types.
+type FrameHandlerFunc func(conn *Connection, in Frame) (Frame, error)
+
+// HandleFrame implements FrameHandler.
+func (f FrameHandlerFunc) HandleFrame(conn *Connection, in Frame) (Frame, error) {
+	return f(conn, in)
+}
+
+// HandleMessage implements MessageHandler for a text message.
+func (f FrameHandlerFunc) HandleMessage(conn *Connection, msg []byte) ([]byte, error) {
+	reply, err := f(conn, TextFrame(msg))
+	return reply.Data, err
+}
+
+// HandleFrame passes in to h the way the read pump does: to HandleFrame if h
+// is a FrameHandler, and otherwise to HandleMessage with the reply going back
+// in the frame type in arrived in.
+func HandleFrame(h MessageHandler, conn *Connection, in Frame) (Frame, error) {
+	if fh, ok := h.(FrameHandler); ok {
+		return fh.HandleFrame(conn, in)
+	}
+	reply, err := h.HandleMessage(conn, in.Data)
+	return Frame{Type: in.Type, Data: reply}, err
+}
+
+// ErrHandlerPanic is returned by a handler wrapped in Recover that panicked.
+var ErrHandlerPanic = errors.New("connection: handler panicked")
+
+// ErrMessageTooBig is returned by a handler wrapped in MaxMessageSize for a
+// message over the limit. The connection is closed with
+// websocket.CloseMessageTooBig, as it is for one over WithReadLimit.
+var ErrMessageTooBig = errors.New("connection: message too big")
+
+// Recover turns a panic in the handler into an ErrHandlerPanic, logged at
+// error with its stack. The connection is closed as for any handler error;
+// the process and every other connection carry on.
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return FrameHandlerFunc(func(conn *Connection, in Frame) (reply Frame, err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					conn.logger().Error("Handler panicked",
+						slog.Any("panic", p), slog.String("stack", string(debug.Stack())))
+					reply, err = Frame{}, fmt.Errorf("%w: %v", ErrHandlerPanic, p)
+				}
+			}()
+			return HandleFrame(next, conn, in)
+		})
+	}
+}
+
+// LogMessages logs each message at level once it is handled, with its frame
+// type and size, the reply's size, how long it took and the error, if any.
+func LogMessages(level slog.Level) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return FrameHandlerFunc(func(conn *Connection, in Frame) (Frame, error) {
+			logger := conn.logger()
+			if !logger.Enabled(context.Background(), level) {
+				return HandleFrame(next, conn, in)
+			}
+			start := time.Now()
+			reply, err := HandleFrame(next, conn, in)
+			attrs := []slog.Attr{
+				slog.Bool("binary", in.IsBinary()),
+				slog.Int("bytes", len(in.Data)),
+				slog.Int("reply_bytes", len(reply.Data)),
+				slog.Duration("elapsed", time.Since(start)),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.Any(LogError, err))
+			}
+			logger.LogAttrs(context.Background(), level, "Message handled", attrs...)
+			return reply, err
+		})
+	}
+}
+
+// Timing calls observe with how long the handler took over each message, for
+// a histogram or a trace span.
+func Timing(observe func(conn *Connection, in Frame, elapsed time.Duration)) Middleware {
+	if observe == nil {
+		panic("connection: Timing with a nil observer")
+	}
+	return func(next MessageHandler) MessageHandler {
+		return FrameHandlerFunc(func(conn *Connection, in Frame) (Frame, error) {
+			start := time.Now()
+			defer func() { observe(conn, in, time.Since(start)) }()
+			return HandleFrame(next, conn, in)
+		})
+	}
+}
+
+// MaxMessageSize rejects messages over n bytes with ErrMessageTooBig, closing
+// the connection. Unlike WithReadLimit it can differ between the handlers of
+// a chain - a tighter limit in front of one route, say - but the message has
+// already been read into memory by the time it applies.
+func MaxMessageSize(n int) Middleware {
+	if n <= 0 {
+		panic(fmt.Sprintf("connection: MaxMessageSize must be positive, got %d", n))
+	}
+	return func(next MessageHandler) MessageHandler {
+		return FrameHandlerFunc(func(conn *Connection, in Frame) (Frame, error) {
+			if len(in.Data) > n {
+				return Frame{}, fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooBig, len(in.Data), n)
+			}
+			return HandleFrame(next, conn, in)
+		})
+	}
+}
+
+// WriteFunc writes one data frame to a connection.
+type WriteFunc func(conn *Connection, f Frame) error
+
+// OutboundMiddleware wraps the write pump's write of each data frame - replies,
+// broadcasts, direct messages and the library's own protocol frames - to
+// transform or audit what is sent. It calls next with the frame, changed or
+// not; returning without calling next drops the frame, and returning an error
+// closes the connection as a failed write does. Pings and the Close frame do
+// not pass through it. See WithOutbound.
+type OutboundMiddleware func(next WriteFunc) WriteFunc
+
+// chainOutbound wraps write in mw, the first outermost.
+func chainOutbound(write WriteFunc, mw []OutboundMiddleware) WriteFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		write = mw[i](write)
+	}
+	return write
+}
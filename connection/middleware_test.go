@@ -0,0 +1,185 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveHandler starts r with h behind it and returns the URL to dial.
+func serveHandler(t *testing.T, r *Registry, h MessageHandler, opts ...Option) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+	srv := httptest.NewServer(r.RegisterHandler(h, opts...))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestChainRunsMiddlewareInOrder(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return FrameHandlerFunc(func(conn *Connection, in Frame) (Frame, error) {
+				order = append(order, name)
+				return HandleFrame(next, conn, in)
+			})
+		}
+	}
+	inner := FrameHandlerFunc(func(_ *Connection, in Frame) (Frame, error) {
+		order = append(order, "handler")
+		return BinaryFrame(in.Data), nil
+	})
+
+	h := Chain(inner, trace("a"), trace("b"), Timing(func(*Connection, Frame, time.Duration) {}))
+	reply, err := HandleFrame(h, nil, TextFrame([]byte("hi")))
+	if err != nil || !reply.IsBinary() {
+		t.Fatalf("got %+v, %v: want the inner FrameHandler's binary reply", reply, err)
+	}
+	if got := strings.Join(order, ","); got != "a,b,handler" {
+		t.Fatalf("ran %s, want a,b,handler", got)
+	}
+
+	// A plain MessageHandler's reply keeps the inbound frame type through the
+	// built-ins.
+	echo := HandlerFunc(func(_ *Connection, msg []byte) ([]byte, error) { return msg, nil })
+	if reply, _ := HandleFrame(Chain(echo, MaxMessageSize(8)), nil, BinaryFrame([]byte{0xff})); !reply.IsBinary() {
+		t.Fatal("echo through middleware turned a binary frame into text")
+	}
+}
+
+func TestRecoverAndMaxMessageSizeCloseOnlyThatConnection(t *testing.T) {
+	r := NewRegistry(WithNopLogger())
+	h := Chain(HandlerFunc(func(_ *Connection, msg []byte) ([]byte, error) {
+		if string(msg) == "boom" {
+			panic("boom")
+		}
+		return msg, nil
+	}), Recover(), MaxMessageSize(8))
+	url := serveHandler(t, r, h)
+
+	for _, tc := range []struct {
+		send string
+		code int
+	}{
+		{"boom", websocket.CloseInternalServerErr},
+		{"much too long", websocket.CloseMessageTooBig},
+	} {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer ws.Close()
+		ws.WriteMessage(websocket.TextMessage, []byte(tc.send))
+		if code, _ := closeCode(t, ws); code != tc.code {
+			t.Errorf("%q: closed with %d, want %d", tc.send, code, tc.code)
+		}
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial after a panic: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte("ok"))
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != "ok" {
+		t.Fatalf("echo after a panic: %q, %v", data, err)
+	}
+}
+
+func TestLogMessages(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRegistry()
+	conn := registered(r, WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	echo := HandlerFunc(func(_ *Connection, msg []byte) ([]byte, error) { return msg, nil })
+
+	HandleFrame(Chain(echo, LogMessages(slog.LevelDebug)), conn, TextFrame([]byte("quiet")))
+	HandleFrame(Chain(echo, LogMessages(slog.LevelInfo)), conn, TextFrame([]byte("hello")))
+	recs := records(t, &buf)
+	if len(recs) != 1 {
+		t.Fatalf("%d records, want the debug one filtered out: %v", len(recs), recs)
+	}
+	rec := recs[0]
+	if rec["msg"] != "Message handled" || rec[LogConnID] != conn.ID || rec["bytes"] != 5.0 || rec["reply_bytes"] != 5.0 {
+		t.Fatalf("got %v", rec)
+	}
+}
+
+func TestOutboundMiddlewareTransformsAndDrops(t *testing.T) {
+	var mu sync.Mutex
+	var audited []string
+	audit := func(next WriteFunc) WriteFunc {
+		return func(conn *Connection, f Frame) error {
+			mu.Lock()
+			audited = append(audited, string(f.Data))
+			mu.Unlock()
+			return next(conn, f)
+		}
+	}
+	upper := func(next WriteFunc) WriteFunc {
+		return func(conn *Connection, f Frame) error {
+			f.Data = bytes.ToUpper(f.Data)
+			return next(conn, f)
+		}
+	}
+	dropSecrets := func(next WriteFunc) WriteFunc {
+		return func(conn *Connection, f Frame) error {
+			if bytes.Contains(f.Data, []byte("SECRET")) {
+				return nil
+			}
+			return next(conn, f)
+		}
+	}
+
+	r := NewRegistry(WithOutbound(audit), WithSessions(time.Minute, 16))
+	conns := make(chan *Connection, 1)
+	r.Hooks.OnConnect = func(c *Connection) {
+		r.AddToGroup("room", c)
+		conns <- c
+	}
+	url := serveHandler(t, r, nil, WithOutbound(upper, dropSecrets), WithNopLogger())
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	conn := <-conns
+	ws.ReadMessage() // the session welcome
+
+	say(r, "room", "a", "secret", "b")
+	for _, want := range []string{"A", "B"} {
+		if _, data, err := ws.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("got %q, %v; want %s", data, err, want)
+		}
+	}
+
+	mu.Lock()
+	got := strings.Join(audited[1:], " ") // after the welcome
+	mu.Unlock()
+	if got != "a secret b" {
+		t.Fatalf("the registry's middleware saw %s, want every frame before the handler's", got)
+	}
+	// The write pump records a frame just after the peer can have read it.
+	s := conn.session
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		seq, buf := s.seq, s.buf
+		s.mu.Unlock()
+		if seq == 2 && string(buf[1].Data) == "b" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session recorded %d frames, want the 2 sent, untransformed", seq)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,371 @@
+package connection
+
+import (
+	"compress/flate"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// Defaults for the settings an Option can change. They are the values the
+// library shipped with before any of them were configurable.
+const (
+	defaultSendBuffer   = 256
+	defaultReadLimit    = 1 << 20 // 1 MiB
+	defaultPingInterval = 30 * time.Second
+	defaultPongWait     = 60 * time.Second
+	defaultWriteWait    = 10 * time.Second
+	defaultBufferSize   = 1024
+)
+
+// Defaults for reliable delivery; see Registry.BroadcastReliable.
+const (
+	defaultAckTimeout     = 5 * time.Second
+	defaultMaxRetransmits = 3
+	defaultUnackedWindow  = 64
+)
+
+// Option configures a Registry, or overrides the Registry's settings for the
+// connections a single handler accepts:
+//
+//	reg := connection.NewRegistry(connection.WithSendBuffer(1024))
+//	http.Handle("/feed", reg.RegisterHandler(feed, connection.WithPingInterval(5*time.Second)))
+//	http.Handle("/chat", reg.RegisterHandler(chat))
+//
+// Invalid values are a programming error, so NewRegistry, RegisterHandler and
+// NewConnection panic on them rather than quietly running with a setting the
+// caller did not ask for.
+type Option func(*config)
+
+// config is the resolved set of Options. A Registry holds one; each handler
+// copies it and applies its own overrides on top, and each Connection keeps the
+// copy it was accepted with.
+type config struct {
+	sendBuffer      int
+	readLimit       int64
+	pingInterval    time.Duration
+	pongWait        time.Duration
+	writeWait       time.Duration
+	readBufferSize  int
+	writeBufferSize int
+
+	// Reliable delivery; see Registry.BroadcastReliable.
+	ackTimeout     time.Duration
+	maxRetransmits int
+	unackedWindow  int
+
+	// Session resumption, off while sessionGrace is zero; see WithSessions.
+	sessionGrace  time.Duration
+	sessionReplay int
+
+	// How long a presence key's leave waits; see WithPresenceDebounce.
+	presenceDebounce time.Duration
+
+	backplane Backplane // nil for a single replica; see WithBackplane
+
+	authenticator Authenticator // nil to accept everyone; see WithAuthenticator
+
+	logger *slog.Logger // nil for slog.Default(); see WithLogger
+
+	metrics Metrics // never nil; see WithMetrics
+
+	// permessage-deflate, negotiated only while compression is set; see
+	// WithCompression.
+	compression          bool
+	compressionLevel     int
+	compressionThreshold int
+
+	outbound []OutboundMiddleware // see WithOutbound
+
+	codecs []message.Codec // offered in negotiation; see WithCodecs
+
+	// What a full outbound queue does; see WithSlowConsumerPolicy. The
+	// counters are the Registry's, shared by every handler's connections.
+	slowConsumer SlowConsumerPolicy
+	slowCounters *slowConsumerCounters
+
+	// The outbound queue's priority lanes, high first; see WithLane.
+	scheduling Scheduling
+	lanes      [numLanes]laneConfig
+}
+
+func defaultConfig() config {
+	return config{
+		sendBuffer:      defaultSendBuffer,
+		readLimit:       defaultReadLimit,
+		pingInterval:    defaultPingInterval,
+		pongWait:        defaultPongWait,
+		writeWait:       defaultWriteWait,
+		readBufferSize:  defaultBufferSize,
+		writeBufferSize: defaultBufferSize,
+		ackTimeout:      defaultAckTimeout,
+		maxRetransmits:  defaultMaxRetransmits,
+		unackedWindow:   defaultUnackedWindow,
+		metrics:         nopMetrics{},
+		slowCounters:    new(slowConsumerCounters),
+	}
+}
+
+// WithSendBuffer sets how many outbound messages a connection may have queued
+// in each priority lane before it counts as not draining; see WithLane. A
+// larger buffer rides out bursts; a smaller one notices a stalled peer
+// sooner.
+func WithSendBuffer(n int) Option {
+	return func(c *config) { c.sendBuffer = n }
+}
+
+// WithReadLimit caps the size in bytes of a single inbound frame. A peer that
+// sends more is disconnected before the frame is allocated.
+func WithReadLimit(n int64) Option {
+	return func(c *config) { c.readLimit = n }
+}
+
+// WithPingInterval sets how often the server pings each connection. It must be
+// shorter than the pong wait, or a healthy peer times out between pings.
+func WithPingInterval(d time.Duration) Option {
+	return func(c *config) { c.pingInterval = d }
+}
+
+// WithPongWait sets how long a connection may go without any inbound traffic -
+// a pong counts - before it is considered dead.
+func WithPongWait(d time.Duration) Option {
+	return func(c *config) { c.pongWait = d }
+}
+
+// WithWriteWait bounds each write to the socket, so a peer that stops reading
+// cannot park the write pump forever.
+func WithWriteWait(d time.Duration) Option {
+	return func(c *config) { c.writeWait = d }
+}
+
+// WithBufferSizes sets the I/O buffer sizes the upgrader allocates per
+// connection. They do not limit message size; see WithReadLimit for that.
+func WithBufferSizes(read, write int) Option {
+	return func(c *config) {
+		c.readBufferSize = read
+		c.writeBufferSize = write
+	}
+}
+
+// WithAckTimeout sets how long a reliable message may go unacknowledged
+// before it is sent again.
+func WithAckTimeout(d time.Duration) Option {
+	return func(c *config) { c.ackTimeout = d }
+}
+
+// WithMaxRetransmits sets how many times an unacknowledged reliable message is
+// resent before the connection is given up on. Zero sends it once only.
+func WithMaxRetransmits(n int) Option {
+	return func(c *config) { c.maxRetransmits = n }
+}
+
+// WithUnackedWindow caps how many reliable messages a connection may leave
+// unacknowledged at once. A connection that reaches the cap is closed, just as
+// one whose send buffer fills is.
+func WithUnackedWindow(n int) Option {
+	return func(c *config) { c.unackedWindow = n }
+}
+
+// WithSessions turns on session resumption: each connection is issued a
+// resume token, and for grace after it drops, its groups are kept and up to
+// replay of the frames it missed are buffered for a client that reconnects
+// with the token. See session.go for the protocol.
+func WithSessions(grace time.Duration, replay int) Option {
+	return func(c *config) {
+		c.sessionGrace = grace
+		c.sessionReplay = replay
+	}
+}
+
+// WithPresenceDebounce delays the leave event for a presence key whose last
+// connection left a group, so a client that drops and reconnects within d
+// never appears to have left. It is read from NewRegistry's options only; the
+// default of zero sends leaves immediately.
+func WithPresenceDebounce(d time.Duration) Option {
+	return func(c *config) { c.presenceDebounce = d }
+}
+
+// WithBackplane connects the Registry to the other replicas sharing b, so
+// broadcasts, group deletion and presence events reach connections on all of
+// them, and Presence lists the keys present on any of them; see
+// Registry.Presence for how far that goes. It is read from NewRegistry's
+// options only.
+func WithBackplane(b Backplane) Option {
+	return func(c *config) { c.backplane = b }
+}
+
+// WithAuthenticator runs a on every upgrade request before it is upgraded. A
+// request it rejects is answered 401 Unauthorized; an accepted one's
+// connection carries the Principal it returned, and is closed when that
+// principal's credential expires.
+func WithAuthenticator(a Authenticator) Option {
+	return func(c *config) { c.authenticator = a }
+}
+
+// WithLogger sends the package's diagnostics to l rather than to
+// slog.Default(). Records about a connection carry its ID, remote address and
+// user ID; see the Log* attribute keys. Normal closes are logged at debug
+// level.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) { c.logger = l }
+}
+
+// WithNopLogger discards the package's diagnostics, for a library that embeds
+// this one and does not want to log on its users' behalf.
+func WithNopLogger() Option {
+	return WithLogger(slog.New(nopHandler{}))
+}
+
+// WithMetrics reports connection, group, message, queue and broadcast
+// measurements to m; see Metrics. It is read from NewRegistry's options only,
+// so every handler's connections are counted together. nil turns metrics off.
+func WithMetrics(m Metrics) Option {
+	return func(c *config) {
+		if m == nil {
+			m = nopMetrics{}
+		}
+		c.metrics = m
+	}
+}
+
+// WithCompression negotiates permessage-deflate with clients that offer it and
+// compresses outbound messages of at least threshold bytes at level, from
+// flate.HuffmanOnly (-2) to flate.BestCompression (9). Smaller messages are not
+// worth the CPU and go out as they are, as do messages marked
+// message.Uncompressed and broadcasts to groups with compression turned off;
+// see Registry.SetGroupCompression. Compression is off by default.
+func WithCompression(level, threshold int) Option {
+	return func(c *config) {
+		c.compression = true
+		c.compressionLevel = level
+		c.compressionThreshold = threshold
+	}
+}
+
+// WithOutbound wraps the write of every data frame in mw, the first
+// outermost. Handler options add to the Registry's rather than replacing them,
+// so a registry-wide audit still sees what a handler's transform sends. A
+// broadcast frame the middleware passes on unchanged is still compressed once
+// for every recipient; one it changes is compressed for its connection alone.
+func WithOutbound(mw ...OutboundMiddleware) Option {
+	return func(c *config) {
+		// The full slice expression makes append copy, so a handler's
+		// middleware never lands in the Registry's or another handler's slice.
+		c.outbound = append(c.outbound[:len(c.outbound):len(c.outbound)], mw...)
+	}
+}
+
+// WithCodecs lets clients negotiate one of codecs, by offering its name as a
+// WebSocket subprotocol or in a hello envelope (see Connection.SetCodec), and
+// then get every message a Codec can encode in it. Subprotocols are matched in
+// the client's order of preference. A client that negotiates nothing gets
+// each message in the message's own format, as before.
+//
+// A handler authenticating with a token in Sec-WebSocket-Protocol answers with
+// that subprotocol, so its clients negotiate with a hello instead.
+func WithCodecs(codecs ...message.Codec) Option {
+	return func(c *config) { c.codecs = codecs }
+}
+
+// WithSlowConsumerPolicy sets what happens to a message for a connection
+// whose outbound buffer is full; see SlowConsumerPolicy. The default,
+// CloseSlowConsumer, closes the connection. Registry.SetGroupSlowConsumerPolicy
+// overrides it for one group's broadcasts.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) Option {
+	return func(c *config) { c.slowConsumer = p }
+}
+
+// WithPriorityScheduling sets how a connection's write pump chooses between
+// its priority lanes: StrictPriority, the default, or WeightedPriority.
+func WithPriorityScheduling(s Scheduling) Option {
+	return func(c *config) { c.scheduling = s }
+}
+
+// WithLane gives priority p's lane of a connection's outbound queue its own
+// capacity, in place of the send buffer, and its own slow-consumer policy, in
+// place of the connection's; a group's policy still overrides it for the
+// group's broadcasts. Low-priority chatter can so be dropped when it backs up
+// while high-priority messages still close a connection that cannot take
+// them.
+func WithLane(p message.Priority, capacity int, policy SlowConsumerPolicy) Option {
+	return func(c *config) { c.lanes[laneOf(p)] = laneConfig{capacity: capacity, policy: &policy} }
+}
+
+// resolve applies opts on top of c and validates the result, panicking on a
+// bad value. c is a copy, so the caller's config is left untouched.
+func (c config) resolve(opts ...Option) config {
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if err := c.validate(); err != nil {
+		panic("connection: " + err.Error())
+	}
+	return c
+}
+
+func (c config) validate() error {
+	switch {
+	case c.sendBuffer <= 0:
+		return fmt.Errorf("send buffer must be positive, got %d", c.sendBuffer)
+	case c.readLimit <= 0:
+		return fmt.Errorf("read limit must be positive, got %d", c.readLimit)
+	case c.pingInterval <= 0:
+		return fmt.Errorf("ping interval must be positive, got %v", c.pingInterval)
+	case c.pongWait <= 0:
+		return fmt.Errorf("pong wait must be positive, got %v", c.pongWait)
+	case c.pingInterval >= c.pongWait:
+		return fmt.Errorf("ping interval (%v) must be shorter than pong wait (%v)", c.pingInterval, c.pongWait)
+	case c.writeWait <= 0:
+		return fmt.Errorf("write wait must be positive, got %v", c.writeWait)
+	case c.readBufferSize < 0 || c.writeBufferSize < 0:
+		return fmt.Errorf("buffer sizes must not be negative, got read=%d write=%d", c.readBufferSize, c.writeBufferSize)
+	case c.ackTimeout <= 0:
+		return fmt.Errorf("ack timeout must be positive, got %v", c.ackTimeout)
+	case c.maxRetransmits < 0:
+		return fmt.Errorf("max retransmits must not be negative, got %d", c.maxRetransmits)
+	case c.unackedWindow <= 0:
+		return fmt.Errorf("unacked window must be positive, got %d", c.unackedWindow)
+	case c.sessionGrace < 0:
+		return fmt.Errorf("session grace must not be negative, got %v", c.sessionGrace)
+	case c.sessionGrace > 0 && c.sessionReplay <= 0:
+		return fmt.Errorf("session replay buffer must be positive, got %d", c.sessionReplay)
+	case c.presenceDebounce < 0:
+		return fmt.Errorf("presence debounce must not be negative, got %v", c.presenceDebounce)
+	case c.compression && (c.compressionLevel < flate.HuffmanOnly || c.compressionLevel > flate.BestCompression):
+		return fmt.Errorf("compression level must be from %d to %d, got %d", flate.HuffmanOnly, flate.BestCompression, c.compressionLevel)
+	case c.compressionThreshold < 0:
+		return fmt.Errorf("compression threshold must not be negative, got %d", c.compressionThreshold)
+	}
+	if err := c.slowConsumer.validate(); err != nil {
+		return err
+	}
+	if err := c.scheduling.validate(); err != nil {
+		return err
+	}
+	for _, l := range c.lanes {
+		if l.policy == nil {
+			continue
+		}
+		if l.capacity <= 0 {
+			return fmt.Errorf("lane capacity must be positive, got %d", l.capacity)
+		}
+		if err := l.policy.validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool, len(c.codecs))
+	for _, codec := range c.codecs {
+		if codec == nil || codec.Name() == "" || names[codec.Name()] {
+			return fmt.Errorf("codecs must be non-nil with distinct, non-empty names")
+		}
+		names[codec.Name()] = true
+	}
+	for _, mw := range c.outbound {
+		if mw == nil {
+			return fmt.Errorf("outbound middleware must not be nil")
+		}
+	}
+	return nil
+}
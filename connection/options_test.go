@@ -0,0 +1,216 @@
+package connection
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// captureHandler hands the server side of each connection to the test on its
+// first inbound message, so a test can inspect what the registry built.
+type captureHandler struct {
+	conns chan *Connection
+}
+
+func (h *captureHandler) HandleMessage(conn *Connection, msg []byte) ([]byte, error) {
+	select {
+	case h.conns <- conn:
+	default:
+	}
+	return nil, nil
+}
+
+// dialCaptured starts r with a capturing handler configured by opts, dials it,
+// and returns both ends of the connection.
+func dialCaptured(t *testing.T, r *Registry, opts ...Option) (*websocket.Conn, *Connection) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	h := &captureHandler{conns: make(chan *Connection, 1)}
+	srv := httptest.NewServer(r.RegisterHandler(h, opts...))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case conn := <-h.conns:
+		return ws, conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler never saw the connection")
+		return nil, nil
+	}
+}
+
+func TestInvalidOptionsPanic(t *testing.T) {
+	cases := []struct {
+		name string
+		opt  Option
+	}{
+		{"zero send buffer", WithSendBuffer(0)},
+		{"negative read limit", WithReadLimit(-1)},
+		{"zero ping interval", WithPingInterval(0)},
+		{"zero pong wait", WithPongWait(0)},
+		{"ping not shorter than pong wait", WithPingInterval(defaultPongWait)},
+		{"zero write wait", WithWriteWait(0)},
+		{"negative buffer size", WithBufferSizes(-1, 1024)},
+		{"zero ack timeout", WithAckTimeout(0)},
+		{"negative max retransmits", WithMaxRetransmits(-1)},
+		{"zero unacked window", WithUnackedWindow(0)},
+		{"negative session grace", WithSessions(-time.Second, 10)},
+		{"sessions without a replay buffer", WithSessions(time.Minute, 0)},
+		{"negative presence debounce", WithPresenceDebounce(-time.Second)},
+		{"compression level too high", WithCompression(10, 0)},
+		{"negative compression threshold", WithCompression(1, -1)},
+		{"nil outbound middleware", WithOutbound(nil)},
+		{"duplicate codec", WithCodecs(message.JSON, message.JSON)},
+		{"zero slow-consumer block timeout", WithSlowConsumerPolicy(BlockFor(0))},
+		{"zero priority weight", WithPriorityScheduling(WeightedPriority(1, 0, 1))},
+		{"zero lane capacity", WithLane(message.PriorityLow, 0, DropNewest)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("NewRegistry accepted an invalid option")
+				}
+			}()
+			NewRegistry(tc.opt)
+		})
+	}
+}
+
+// A handler's overrides apply to its own connections only; the registry's
+// settings - and any other handler's - stay as they were.
+func TestHandlerOptionsOverrideRegistry(t *testing.T) {
+	r := NewRegistry(WithSendBuffer(32))
+
+	_, plain := dialCaptured(t, r)
+	if got := plain.out.capacity(message.PriorityNormal); got != 32 {
+		t.Errorf("registry send buffer: got %d, want 32", got)
+	}
+
+	_, overridden := dialCaptured(t, r, WithSendBuffer(4))
+	if got := overridden.out.capacity(message.PriorityNormal); got != 4 {
+		t.Errorf("handler send buffer: got %d, want 4", got)
+	}
+
+	if r.cfg.sendBuffer != 32 {
+		t.Errorf("a handler override leaked into the registry: send buffer %d", r.cfg.sendBuffer)
+	}
+}
+
+func TestReadLimitOption(t *testing.T) {
+	r := NewRegistry(WithReadLimit(64))
+	ws, conn := dialCaptured(t, r)
+
+	if err := ws.WriteMessage(websocket.TextMessage, make([]byte, 64)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-conn.done:
+		t.Fatal("a frame at the limit closed the connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, make([]byte, 65)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a frame over the limit did not close the connection")
+	}
+}
+
+func TestPingIntervalOption(t *testing.T) {
+	r := NewRegistry(WithPingInterval(50*time.Millisecond), WithPongWait(time.Second))
+	ws, _ := dialCaptured(t, r)
+
+	pinged := make(chan struct{}, 1)
+	ws.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	// Pings are only processed while reading.
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Fatal("no ping within the configured interval")
+	}
+}
+
+// A peer that never reads never answers a ping, so nothing resets the read
+// deadline and the server gives up after the pong wait.
+func TestPongWaitOption(t *testing.T) {
+	r := NewRegistry(WithPingInterval(20*time.Millisecond), WithPongWait(100*time.Millisecond))
+	_, conn := dialCaptured(t, r)
+
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a silent peer outlived the configured pong wait")
+	}
+}
+
+// A peer that stops reading eventually fills the socket buffers, at which
+// point the write pump blocks until its write deadline fires.
+func TestWriteWaitOption(t *testing.T) {
+	r := NewRegistry(WithWriteWait(100 * time.Millisecond))
+	_, conn := dialCaptured(t, r)
+
+	frame := BinaryFrame(make([]byte, 1<<20))
+	deadline := time.After(5 * time.Second)
+	for {
+		conn.out.push(frame)
+		select {
+		case <-conn.out.room:
+		case <-conn.done:
+			return
+		case <-deadline:
+			t.Fatal("the write pump stayed blocked past the configured write wait")
+		}
+	}
+}
+
+func TestBufferSizesOption(t *testing.T) {
+	cfg := defaultConfig().resolve(WithBufferSizes(512, 2048))
+	u := newUpgrader(cfg, nil)
+	if u.ReadBufferSize != 512 || u.WriteBufferSize != 2048 {
+		t.Fatalf("upgrader buffers: got read=%d write=%d, want 512/2048", u.ReadBufferSize, u.WriteBufferSize)
+	}
+}
+
+func TestNewConnectionSendBuffer(t *testing.T) {
+	if got := NewConnection(nil, nil).out.capacity(message.PriorityNormal); got != defaultSendBuffer {
+		t.Errorf("default send buffer: got %d, want %d", got, defaultSendBuffer)
+	}
+	if got := NewConnection(nil, nil, WithSendBuffer(8)).out.capacity(message.PriorityNormal); got != 8 {
+		t.Errorf("send buffer option: got %d, want 8", got)
+	}
+}
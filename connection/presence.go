@@ -0,0 +1,258 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Presence.
+//
+// A group member becomes present with SetPresence, under a key - a user ID,
+// say - and with whatever metadata the application gives it; membership alone
+// is not presence, and AddToGroup sends no event. Everyone in the group is
+// told as it changes:
+//
+//	<- {"type": "presence", "data": {"event": "join", "key": "alice", "meta": {"name": "Alice"}}}
+//	<- {"type": "presence", "data": {"event": "update", "key": "alice", "meta": {"name": "Alice", "status": "away"}}}
+//	<- {"type": "presence", "data": {"event": "leave", "key": "alice"}}
+//
+// Several connections can share a key, one per tab; the key is present while
+// any of them is. When the last one leaves the group, the leave waits out the
+// presence debounce, and a connection that comes back under the key in that
+// time cancels it, so a flapping reconnect shows as no change at all.
+
+// presenceType is the envelope type of presence events.
+const presenceType = "presence"
+
+// Presence event kinds.
+const (
+	PresenceJoin   = "join"
+	PresenceUpdate = "update"
+	PresenceLeave  = "leave"
+)
+
+// ErrNotInGroup is returned by SetPresence for a connection that is not a
+// member of the group.
+var ErrNotInGroup = errors.New("connection: connection is not in the group")
+
+// PresenceMember is one key present in a group.
+type PresenceMember struct {
+	Key  string          `json:"key"`
+	Meta json.RawMessage `json:"meta,omitempty"`
+}
+
+// presenceEvent is the data of a presence frame.
+type presenceEvent struct {
+	Event string          `json:"event"`
+	Key   string          `json:"key"`
+	Meta  json.RawMessage `json:"meta,omitempty"`
+}
+
+// presenceMember is a key's presence in one group. Like the rest of the
+// presence state it is guarded by the registry's mu.
+type presenceMember struct {
+	meta  json.RawMessage
+	conns map[*Connection]bool
+	gen   uint64      // bumped whenever a pending leave is scheduled or canceled
+	leave *time.Timer // the pending debounced leave, if any
+}
+
+// presenceState is what a connection was present as in a group, kept on its
+// session while parked so a resume restores it.
+type presenceState struct {
+	key  string
+	meta json.RawMessage
+}
+
+// SetPresence marks conn present in groupName under key, with meta as its
+// metadata; an empty key is conn's ID. meta is encoded as JSON, once. conn must
+// already be a member of the group. The group is sent a join event if key was
+// not present, or an update if it was with different metadata. Calling it
+// again with new metadata updates it.
+func (r *Registry) SetPresence(groupName string, conn *Connection, key string, meta any) error {
+	var raw json.RawMessage
+	if meta != nil {
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		raw = encoded
+	}
+	if key == "" {
+		key = conn.ID
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if conn.groups == nil {
+		return ErrConnectionClosed
+	}
+	if !conn.groups[groupName] {
+		return ErrNotInGroup
+	}
+	r.setPresence(groupName, conn, presenceState{key: key, meta: raw})
+	return nil
+}
+
+// Presence returns the keys present in groupName, in key order. Keys whose
+// leave is pending are still present. With a backplane, so are the keys
+// present on the other replicas, as their presence events told this one; a
+// key present on several is listed once, with this replica's metadata if it
+// is present here. A replica only knows the keys that changed since it
+// subscribed, and one that stops without leaving is not heard from again, so
+// its keys stay listed until its group is deleted.
+func (r *Registry) Presence(groupName string) []PresenceMember {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := make([]PresenceMember, 0, len(r.presence[groupName]))
+	listed := make(map[string]bool, len(r.presence[groupName]))
+	for key, m := range r.presence[groupName] {
+		members = append(members, PresenceMember{Key: key, Meta: m.meta})
+		listed[key] = true
+	}
+	for _, keys := range r.remotePresence[groupName] {
+		for key, meta := range keys {
+			if !listed[key] {
+				members = append(members, PresenceMember{Key: key, Meta: meta})
+				listed[key] = true
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Key < members[j].Key })
+	return members
+}
+
+// setPresence makes conn present in groupName as p. Callers hold r.mu and have
+// checked conn is in the group.
+func (r *Registry) setPresence(groupName string, conn *Connection, p presenceState) {
+	if old, ok := conn.presence[groupName]; ok && old.key != p.key {
+		r.leavePresence(groupName, conn)
+	}
+	conn.presence[groupName] = p
+
+	group, exists := r.presence[groupName]
+	if !exists {
+		group = make(map[string]*presenceMember)
+		r.presence[groupName] = group
+	}
+	m, exists := group[p.key]
+	if !exists {
+		group[p.key] = &presenceMember{meta: p.meta, conns: map[*Connection]bool{conn: true}}
+		r.presenceEvent(groupName, presenceEvent{Event: PresenceJoin, Key: p.key, Meta: p.meta})
+		return
+	}
+
+	m.conns[conn] = true
+	if m.leave != nil {
+		m.leave.Stop()
+		m.leave = nil
+		m.gen++
+	}
+	if string(m.meta) != string(p.meta) {
+		m.meta = p.meta
+		r.presenceEvent(groupName, presenceEvent{Event: PresenceUpdate, Key: p.key, Meta: p.meta})
+	}
+}
+
+// leavePresence removes conn's presence in groupName, if it had one. If that
+// was the key's last connection, the key leaves, after the debounce. Callers
+// hold r.mu.
+func (r *Registry) leavePresence(groupName string, conn *Connection) {
+	p, ok := conn.presence[groupName]
+	if !ok {
+		return
+	}
+	delete(conn.presence, groupName)
+
+	m, exists := r.presence[groupName][p.key]
+	if !exists {
+		return
+	}
+	delete(m.conns, conn)
+	if len(m.conns) > 0 {
+		return
+	}
+	if r.cfg.presenceDebounce == 0 {
+		r.removePresence(groupName, p.key)
+		return
+	}
+	m.gen++
+	gen := m.gen
+	m.leave = time.AfterFunc(r.cfg.presenceDebounce, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if current := r.presence[groupName][p.key]; current == m && m.gen == gen {
+			r.removePresence(groupName, p.key)
+		}
+	})
+}
+
+// removePresence drops key from groupName and tells the group. Callers hold
+// r.mu.
+func (r *Registry) removePresence(groupName, key string) {
+	delete(r.presence[groupName], key)
+	if len(r.presence[groupName]) == 0 {
+		delete(r.presence, groupName)
+	}
+	r.presenceEvent(groupName, presenceEvent{Event: PresenceLeave, Key: key})
+}
+
+// forgetPresence drops every key in a deleted group, without events: there is
+// nobody left to tell. Callers hold r.mu.
+func (r *Registry) forgetPresence(groupName string) {
+	for _, m := range r.presence[groupName] {
+		if m.leave != nil {
+			m.leave.Stop()
+		}
+	}
+	delete(r.presence, groupName)
+}
+
+// applyRemotePresence records ev, a presence event the replica node published
+// for groupName, for Presence. Callers hold r.mu.
+func (r *Registry) applyRemotePresence(groupName, node string, ev presenceEvent) {
+	nodes := r.remotePresence[groupName]
+	if ev.Event == PresenceLeave {
+		delete(nodes[node], ev.Key)
+		if len(nodes[node]) == 0 {
+			delete(nodes, node)
+		}
+		if len(nodes) == 0 {
+			delete(r.remotePresence, groupName)
+		}
+		return
+	}
+	if nodes == nil {
+		nodes = make(map[string]map[string]json.RawMessage)
+		r.remotePresence[groupName] = nodes
+	}
+	if nodes[node] == nil {
+		nodes[node] = make(map[string]json.RawMessage)
+	}
+	nodes[node][ev.Key] = ev.Meta
+}
+
+// presenceEvent sends ev to every member of groupName, on every replica. It
+// is queued under r.mu, so events reach each member in the order the changes
+// were made. Callers hold r.mu.
+func (r *Registry) presenceEvent(groupName string, ev presenceEvent) {
+	// Cannot fail: the metadata is already valid JSON.
+	encoded, _ := json.Marshal(outEnvelope{Type: presenceType, Data: ev})
+	f := TextFrame(encoded)
+	r.queueToGroup(f, groupName)
+	r.publish(remoteMessage{Kind: remotePresence, Group: groupName, Type: f.Type, Data: f.Data})
+}
+
+// queueToGroup queues f for every member of groupName on this replica, and
+// records it for the group's parked sessions. Callers hold r.mu.
+func (r *Registry) queueToGroup(f Frame, groupName string) {
+	p := r.slowPolicy(groupName)
+	for conn := range r.groups[groupName] {
+		conn.queueHeld(f, p)
+	}
+	r.recordParked(f, groupName)
+}
@@ -0,0 +1,148 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// nextPresence reads the next frame off conn's queue as a presence event.
+func nextPresence(t *testing.T, conn *Connection) presenceEvent {
+	t.Helper()
+	f := next(t, conn)
+	var env struct {
+		Type string        `json:"type"`
+		Data presenceEvent `json:"data"`
+	}
+	if err := json.Unmarshal(f.Data, &env); err != nil || env.Type != presenceType {
+		t.Fatalf("got %s, want a presence frame", f.Data)
+	}
+	return env.Data
+}
+
+func expectQuiet(t *testing.T, conn *Connection) {
+	t.Helper()
+	if f, ok := conn.out.pop(); ok {
+		t.Fatalf("got %s, want nothing queued", f.Data)
+	}
+}
+
+func TestPresenceJoinUpdateAndLeave(t *testing.T) {
+	r := NewRegistry()
+	observer, alice := registered(r), registered(r)
+	r.AddToGroup("room", observer)
+	r.AddToGroup("room", alice)
+
+	if err := r.SetPresence("room", alice, "alice", map[string]string{"status": "online"}); err != nil {
+		t.Fatalf("SetPresence: %v", err)
+	}
+	if ev := nextPresence(t, observer); ev.Event != PresenceJoin || ev.Key != "alice" || string(ev.Meta) != `{"status":"online"}` {
+		t.Fatalf("got %+v, want alice joining with her status", ev)
+	}
+
+	r.SetPresence("room", alice, "alice", map[string]string{"status": "away"})
+	if ev := nextPresence(t, observer); ev.Event != PresenceUpdate || string(ev.Meta) != `{"status":"away"}` {
+		t.Fatalf("got %+v, want an update to away", ev)
+	}
+	// The same metadata again is not a change.
+	r.SetPresence("room", alice, "alice", map[string]string{"status": "away"})
+	expectQuiet(t, observer)
+
+	members := r.Presence("room")
+	if len(members) != 1 || members[0].Key != "alice" || string(members[0].Meta) != `{"status":"away"}` {
+		t.Fatalf("Presence: got %+v, want alice, away", members)
+	}
+
+	r.RemoveFromGroup("room", alice)
+	if ev := nextPresence(t, observer); ev.Event != PresenceLeave || ev.Key != "alice" {
+		t.Fatalf("got %+v, want alice leaving", ev)
+	}
+	if members := r.Presence("room"); len(members) != 0 {
+		t.Fatalf("Presence after leave: got %+v, want nobody", members)
+	}
+}
+
+// Membership alone is not presence: joining and leaving a group without
+// SetPresence sends neither event, and a member made present in between gets
+// both.
+func TestPresenceEventsPairUp(t *testing.T) {
+	r := NewRegistry()
+	observer, member := registered(r), registered(r)
+	r.AddToGroup("room", observer)
+
+	r.AddToGroup("room", member)
+	r.RemoveFromGroup("room", member)
+	expectQuiet(t, observer)
+
+	r.AddToGroup("room", member)
+	r.SetPresence("room", member, "", nil)
+	r.RemoveFromGroup("room", member)
+	if ev := nextPresence(t, observer); ev.Event != PresenceJoin || ev.Key != member.ID {
+		t.Fatalf("got %+v, want the member joining under its ID", ev)
+	}
+	if ev := nextPresence(t, observer); ev.Event != PresenceLeave || ev.Key != member.ID {
+		t.Fatalf("got %+v, want the member leaving", ev)
+	}
+	expectQuiet(t, observer)
+}
+
+// A key is present while any of its connections is.
+func TestPresenceKeySharedByConnections(t *testing.T) {
+	r := NewRegistry()
+	observer, tab1, tab2 := registered(r), registered(r), registered(r)
+	for _, conn := range []*Connection{observer, tab1, tab2} {
+		r.AddToGroup("room", conn)
+	}
+	r.SetPresence("room", tab1, "alice", nil)
+	r.SetPresence("room", tab2, "alice", nil)
+	nextPresence(t, observer) // the one join
+
+	r.unregisterConnection(tab1)
+	expectQuiet(t, observer)
+
+	r.unregisterConnection(tab2)
+	if ev := nextPresence(t, observer); ev.Event != PresenceLeave {
+		t.Fatalf("got %+v, want alice leaving with her last tab", ev)
+	}
+}
+
+func TestPresenceLeaveIsDebounced(t *testing.T) {
+	r := NewRegistry(WithPresenceDebounce(50 * time.Millisecond))
+	observer, first := registered(r), registered(r)
+	r.AddToGroup("room", observer)
+	r.AddToGroup("room", first)
+	r.SetPresence("room", first, "alice", nil)
+	nextPresence(t, observer)
+
+	// Dropping and coming back inside the debounce is no change at all.
+	r.unregisterConnection(first)
+	again := registered(r)
+	r.AddToGroup("room", again)
+	r.SetPresence("room", again, "alice", nil)
+	time.Sleep(100 * time.Millisecond)
+	expectQuiet(t, observer)
+
+	start := time.Now()
+	r.unregisterConnection(again)
+	if ev := nextPresence(t, observer); ev.Event != PresenceLeave {
+		t.Fatalf("got %+v, want alice leaving", ev)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("leave came after %v, want it held for the debounce", waited)
+	}
+}
+
+func TestSetPresenceNeedsMembership(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+	if err := r.SetPresence("room", conn, "", nil); !errors.Is(err, ErrNotInGroup) {
+		t.Errorf("outside the group: got %v, want ErrNotInGroup", err)
+	}
+
+	r.AddToGroup("room", conn)
+	r.unregisterConnection(conn)
+	if err := r.SetPresence("room", conn, "", nil); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("unregistered: got %v, want ErrConnectionClosed", err)
+	}
+}
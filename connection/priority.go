@@ -0,0 +1,83 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// numLanes is how many priority lanes a connection's outbound queue has: one
+// each for message.PriorityHigh, PriorityNormal and PriorityLow, in that
+// order.
+const numLanes = 3
+
+// laneOf returns the lane for priority p, treating anything above high as
+// high and anything below low as low.
+func laneOf(p message.Priority) int {
+	switch {
+	case p >= message.PriorityHigh:
+		return 0
+	case p <= message.PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// Scheduling decides which priority lane a connection's write pump takes its
+// next frame from. See StrictPriority and WeightedPriority.
+type Scheduling struct {
+	weights [numLanes]int // high, normal, low; all zero for strict
+}
+
+// StrictPriority always writes the highest-priority frame queued, so a
+// low-priority frame waits for as long as anything else is queued. It is the
+// default.
+var StrictPriority = Scheduling{}
+
+// WeightedPriority writes up to high high-priority frames for every normal
+// normal-priority and low low-priority ones, so a steady stream of urgent
+// frames cannot starve the rest. A lane with nothing queued gives its turns
+// to the others. Every weight must be positive.
+func WeightedPriority(high, normal, low int) Scheduling {
+	return Scheduling{weights: [numLanes]int{high, normal, low}}
+}
+
+// String returns "strict", or "weighted(high,normal,low)".
+func (s Scheduling) String() string {
+	if s == StrictPriority {
+		return "strict"
+	}
+	return fmt.Sprintf("weighted(%d,%d,%d)", s.weights[0], s.weights[1], s.weights[2])
+}
+
+func (s Scheduling) validate() error {
+	if s == StrictPriority {
+		return nil
+	}
+	for _, w := range s.weights {
+		if w <= 0 {
+			return fmt.Errorf("priority weights must be positive, got %v", s.weights)
+		}
+	}
+	return nil
+}
+
+// laneConfig is one priority lane's settings; see WithLane.
+type laneConfig struct {
+	capacity int                 // 0 for the send buffer
+	policy   *SlowConsumerPolicy // nil for the connection's
+}
+
+// laneCapacity returns lane i's capacity.
+func (c config) laneCapacity(i int) int {
+	if n := c.lanes[i].capacity; n > 0 {
+		return n
+	}
+	return c.sendBuffer
+}
+
+// urgent returns f at high priority, for frames a client is waiting on.
+func urgent(f Frame) Frame {
+	f.priority = message.PriorityHigh
+	return f
+}
@@ -0,0 +1,91 @@
+package connection
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// post broadcasts text to everyone at priority p.
+func post(r *Registry, p message.Priority, texts ...string) {
+	for _, text := range texts {
+		r.BroadcastToAll(message.WithPriority(&message.ByteMessage{Data: []byte(text)}, p))
+	}
+}
+
+func TestStrictPriorityWritesTheHighestLaneFirst(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+	post(r, message.PriorityLow, "l1")
+	post(r, message.PriorityNormal, "n1")
+	post(r, message.PriorityHigh, "h1")
+	post(r, message.PriorityNormal, "n2")
+	post(r, message.PriorityHigh, "h2")
+
+	if got := strings.Join(drain(conn), " "); got != "h1 h2 n1 n2 l1" {
+		t.Fatalf("written in the order %s", got)
+	}
+}
+
+func TestWeightedPriorityDoesNotStarveLowerLanes(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r, WithPriorityScheduling(WeightedPriority(2, 1, 1)))
+	post(r, message.PriorityHigh, "h1", "h2", "h3", "h4", "h5")
+	post(r, message.PriorityNormal, "n1", "n2")
+	post(r, message.PriorityLow, "l1")
+
+	if got := strings.Join(drain(conn), " "); got != "h1 h2 n1 l1 h3 h4 n2 h5" {
+		t.Fatalf("written in the order %s", got)
+	}
+}
+
+func TestLanesHaveTheirOwnCapacityAndPolicy(t *testing.T) {
+	r := NewRegistry(WithNopLogger())
+	conn := newConnection(nil, nil, r.cfg.resolve(WithSendBuffer(4), WithLane(message.PriorityLow, 1, DropNewest)))
+	r.mu.Lock()
+	r.connections[conn] = true
+	r.mu.Unlock()
+
+	post(r, message.PriorityLow, "typing", "typing again")
+	post(r, message.PriorityNormal, "n1", "n2", "n3", "n4")
+	if got := strings.Join(drain(conn), " "); got != "n1 n2 n3 n4 typing" {
+		t.Fatalf("queue held %s, want the low lane's overflow dropped and the normal lane full", got)
+	}
+	if got := r.SlowConsumerStats(); got != (SlowConsumerStats{DroppedNewest: 1}) {
+		t.Fatalf("stats %+v", got)
+	}
+
+	// The other lanes keep the connection's policy.
+	post(r, message.PriorityHigh, "h1", "h2", "h3", "h4", "h5")
+	if !closed(conn) {
+		t.Fatal("an overflowing high lane left the connection open")
+	}
+}
+
+func TestCallsGoAheadOfQueuedBroadcasts(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+	say(r, "", "chatter")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conn.Call(ctx, "ping", nil, nil)
+	for conn.out.len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if f := next(t, conn); !strings.Contains(string(f.Data), `"ping"`) {
+		t.Fatalf("got %s first, want the call", f.Data)
+	}
+}
+
+func TestBackplaneCarriesThePriority(t *testing.T) {
+	rs := replicas(t, 2)
+	conn := registered(rs[1])
+	post(rs[0], message.PriorityHigh, "urgent")
+	if f := next(t, conn); f.priority != message.PriorityHigh {
+		t.Fatalf("frame from the other replica has priority %d, want high", f.priority)
+	}
+}
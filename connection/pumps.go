@@ -2,67 +2,93 @@
 package connection
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
 	"time"
 
+	"github.com/gclluch/go-rtc-lib/message"
 	"github.com/gorilla/websocket"
 )
 
-// maxMessageBytes caps a single inbound frame. See readPump.
-const maxMessageBytes = 1 << 20 // 1 MiB
-
 func (c *Connection) readPump() {
 	defer func() {
 		c.wg.Done()
 		c.CloseConnection() // Ensure connection is closed at the end of readPump.
 	}()
 	// Without a read limit a single peer can force an unbounded allocation with
-	// one oversized frame. 1 MiB is generous for control/JSON traffic; raise it
-	// deliberately if an application needs larger payloads.
-	c.WS.SetReadLimit(maxMessageBytes)
+	// one oversized frame. The 1 MiB default is generous for control/JSON
+	// traffic; raise it deliberately with WithReadLimit if an application needs
+	// larger payloads.
+	c.WS.SetReadLimit(c.cfg.readLimit)
 	c.setupPongHandler()
 
 	for {
-		_, msg, err := c.WS.ReadMessage()
+		frameType, msg, err := c.WS.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			} else {
-				log.Printf("read error: %v", err)
-			}
+			// Every close ends in a read error, so only unusual ones are
+			// worth more than debug; the close itself is logged on unregister.
+			c.noteClose(readCloseInfo(err))
+			c.logger().Debug("Read ended", slog.Any(LogError, err))
 			break // Exit the loop on read error.
 		}
+		c.cfg.metrics.MessageReceived(frameType, len(msg))
 
 		if c.messageHandler == nil {
 			// Fallback or default behavior if no handler is registered.
-			log.Printf("No handler registered. Message received: %s", string(msg))
+			c.logger().Warn("No handler registered; message dropped", slog.Int("bytes", len(msg)))
 			continue
 		}
 
 		// Process the message using the registered handler.
-		response, handlerErr := c.messageHandler.HandleMessage(c, msg)
+		reply, handlerErr := c.handle(Frame{Type: frameType, Data: msg})
 		if handlerErr != nil {
-			log.Printf("Handler error: %v", handlerErr)
+			c.logger().Warn("Handler error; closing connection", slog.Any(LogError, handlerErr))
 			// Optionally, close the connection on handler error.
+			c.noteClose(handlerCloseInfo(handlerErr))
 			break
 		}
-		if response != nil {
-			select {
-			case c.Send <- response:
-			default:
-				// Same policy as Registry.Broadcast: a full buffer is a peer
-				// that stopped draining. Returning runs the deferred
-				// CloseConnection, so the connection is reaped rather than
-				// left believing it got a reply it never will.
-				log.Printf("Connection %s is not draining; closing it.", c.ID)
+		if reply.Data != nil {
+			// Same policy as Registry.Broadcast. Returning after an eviction
+			// runs the deferred CloseConnection at once.
+			if err := c.queue(urgent(reply)); err != nil && !errors.Is(err, ErrMessageDropped) {
 				return
 			}
 		}
 	}
 }
 
+// readCloseInfo says why a read failed: the peer's close frame, an oversized
+// message, or the connection dropping without one.
+func readCloseInfo(err error) CloseInfo {
+	var ce *websocket.CloseError
+	switch {
+	case errors.As(err, &ce):
+		return CloseInfo{Code: ce.Code, Reason: ce.Text, ByPeer: true}
+	case errors.Is(err, websocket.ErrReadLimit):
+		return CloseInfo{Code: websocket.CloseMessageTooBig, Reason: "message too big"}
+	}
+	return CloseInfo{Code: websocket.CloseAbnormalClosure, Reason: err.Error()}
+}
+
+// handle passes an inbound frame to the message handler. A plain
+// MessageHandler's reply goes back in the frame type the message came in, so
+// echoing a binary frame does not turn it into invalid text.
+func (c *Connection) handle(in Frame) (Frame, error) {
+	return HandleFrame(c.messageHandler, c, in)
+}
+
+// handlerCloseInfo says why a handler error closes the connection.
+func handlerCloseInfo(err error) CloseInfo {
+	if errors.Is(err, ErrMessageTooBig) {
+		return CloseInfo{Code: websocket.CloseMessageTooBig, Reason: "message too big"}
+	}
+	return CloseInfo{Code: websocket.CloseInternalServerErr, Reason: "handler error"}
+}
+
 func (c *Connection) writePump() {
-	ticker := time.NewTicker(30 * time.Second) // Adjust the interval as needed.
+	ticker := time.NewTicker(c.cfg.pingInterval)
 	defer func() {
 		ticker.Stop()
 		// Signal before CloseConnection, unconditionally: this is what lets
@@ -82,24 +108,125 @@ func (c *Connection) writePump() {
 			// shutdown); tell the peer and stop pumping. The deadline matters:
 			// without it a wedged peer can block this write forever and strand
 			// the goroutine.
-			c.WS.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			c.WS.WriteMessage(websocket.CloseMessage, []byte{})
+			c.writeClose()
 			return
 
+		case <-c.out.ready:
+			frame, ok := c.out.pop()
+			if !ok {
+				continue
+			}
+			if err := c.write(frame); err != nil {
+				c.writeFailed(err)
+				return
+			}
+
 		case message := <-c.Send:
-			c.WS.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.WS.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Write error: %v", err)
+			if err := c.write(TextFrame(message)); err != nil {
+				c.writeFailed(err)
 				return
 			}
 
 		case <-ticker.C:
-			c.WS.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			// Send a ping message.
-			if err := c.WS.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("Ping error: %v", err)
+			if err := c.ping(); err != nil {
+				c.writeFailed(err)
 				return
 			}
 		}
 	}
 }
+
+// writeClose tells the peer c is closing: a Close frame on a WebSocket,
+// carrying c's close info.
+func (c *Connection) writeClose() {
+	if c.transport != nil {
+		c.transport.close(c.CloseInfo())
+		return
+	}
+	c.WS.SetWriteDeadline(time.Now().Add(c.cfg.writeWait))
+	c.WS.WriteMessage(websocket.CloseMessage, closeMessage(c.CloseInfo()))
+}
+
+// ping keeps the connection alive, and finds out if it is not.
+func (c *Connection) ping() error {
+	if c.transport != nil {
+		return c.transport.ping()
+	}
+	c.WS.SetWriteDeadline(time.Now().Add(c.cfg.writeWait))
+	return c.WS.WriteMessage(websocket.PingMessage, nil)
+}
+
+// writeFailed records a failed write as the reason c is closing. A write
+// failing because c was already closing is no news, so it logs at debug.
+func (c *Connection) writeFailed(err error) {
+	level := slog.LevelInfo
+	select {
+	case <-c.done:
+		level = slog.LevelDebug
+	default:
+	}
+	c.logger().Log(context.Background(), level, "Write failed", slog.Any(LogError, err))
+	c.noteClose(CloseInfo{Code: websocket.CloseAbnormalClosure, Reason: err.Error()})
+}
+
+// write puts one data frame on the wire through the outbound middleware and,
+// if the connection carries a session, records it in the session's sequence.
+func (c *Connection) write(f Frame) error {
+	if f.msg != nil && !sameCodec(f.codec, c.wire) {
+		// Encoded just before a codec switch; see SetCodec.
+		data, err := message.Encode(f.msg, c.wire)
+		if err != nil {
+			c.logger().Error("Encoding message for the connection's codec failed; dropped", slog.Any(LogError, err))
+			return nil
+		}
+		f = f.encodedAs(c.wire, data)
+	}
+	c.writing = &f
+	defer func() { c.writing = nil }()
+	if err := c.writer(c, f); err != nil {
+		return err
+	}
+	if f.switchTo != nil {
+		c.wire = f.switchTo
+	}
+	return nil
+}
+
+// writeSocket is the innermost WriteFunc, writing to the socket or to c's
+// transport. It records the frame as write was given it, so a replay passes
+// through the middleware once, like any write, and a frame the middleware
+// dropped is not recorded at all.
+func (c *Connection) writeSocket(f Frame) error {
+	if orig := c.writing; f.prepared != nil && (orig == nil || f.Type != orig.Type || !bytes.Equal(f.Data, orig.Data)) {
+		f.prepared = nil // the middleware changed the bytes it was prepared from
+	}
+	var err error
+	if c.transport != nil {
+		err = c.transport.write(c, f)
+	} else {
+		err = c.writeWebSocket(f)
+	}
+	if err != nil {
+		return err
+	}
+	c.cfg.metrics.MessageSent(f.Type, len(f.Data))
+	if orig := c.writing; orig != nil && c.session != nil && !orig.control && orig.seq == 0 {
+		c.writing = nil // once, even if a middleware writes twice
+		rec := *orig
+		rec.prepared = nil // a replay is written to one connection
+		c.session.record(c, rec)
+	}
+	return nil
+}
+
+func (c *Connection) writeWebSocket(f Frame) error {
+	c.WS.SetWriteDeadline(time.Now().Add(c.cfg.writeWait))
+	if c.cfg.compression {
+		// A no-op unless the peer negotiated compression.
+		c.WS.EnableWriteCompression(!f.noCompress && len(f.Data) >= c.cfg.compressionThreshold)
+	}
+	if f.prepared != nil {
+		return c.WS.WritePreparedMessage(f.prepared)
+	}
+	return c.WS.WriteMessage(f.Type, f.Data)
+}
@@ -0,0 +1,232 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// outQueue is a connection's outbound queue: the frames waiting for its write
+// pump, in a lane per priority, each in order and up to its own capacity. The
+// write pump takes from the lanes as the connection's Scheduling says. A frame
+// with a conflation key replaces the queued frame in its lane with the same
+// key, if there is one, in that frame's place and without taking more room;
+// see message.Keyed. The write pump is the only consumer.
+type outQueue struct {
+	mu    sync.Mutex
+	lanes [numLanes]lane
+
+	// weights are the Scheduling's, all zero for strict priority; credit is
+	// what is left of them in the current round.
+	weights [numLanes]int
+	credit  [numLanes]int
+
+	// ready holds a token while frames may be queued, and room one while
+	// there may be room; a receiver must check, since a token can be stale.
+	ready chan struct{}
+	room  chan struct{}
+}
+
+// lane is one priority's frames.
+type lane struct {
+	frames   []Frame
+	capacity int
+
+	// keys holds the position of each keyed frame queued, counted from the
+	// first frame ever queued; popped is how many have been taken since.
+	keys   map[string]uint64
+	popped uint64
+}
+
+func newOutQueue(cfg config) *outQueue {
+	q := &outQueue{
+		weights: cfg.scheduling.weights,
+		ready:   make(chan struct{}, 1),
+		room:    make(chan struct{}, 1),
+	}
+	for i := range q.lanes {
+		q.lanes[i] = lane{capacity: cfg.laneCapacity(i), keys: make(map[string]uint64)}
+	}
+	return q
+}
+
+// push queues f, or has it replace the queued frame with its key, and
+// reports whether it did: it does not if f's lane is full and f replaces
+// nothing.
+func (q *outQueue) push(f Frame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushLocked(f)
+}
+
+func (q *outQueue) pushLocked(f Frame) bool {
+	if !q.lanes[laneOf(f.priority)].push(f) {
+		return false
+	}
+	signal(q.ready)
+	return true
+}
+
+func (l *lane) push(f Frame) bool {
+	if f.key != "" {
+		if pos, ok := l.keys[f.key]; ok {
+			l.frames[pos-l.popped] = f
+			return true
+		}
+	}
+	if len(l.frames) >= l.capacity {
+		return false
+	}
+	if f.key != "" {
+		l.keys[f.key] = l.popped + uint64(len(l.frames))
+	}
+	l.frames = append(l.frames, f)
+	return true
+}
+
+// pop takes the next frame off q, if there is one: the oldest in the lane
+// the Scheduling picks.
+func (q *outQueue) pop() (Frame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.pick()
+	if i < 0 {
+		return Frame{}, false
+	}
+	f := q.lanes[i].pop()
+	if q.lenLocked() > 0 {
+		signal(q.ready)
+	}
+	signal(q.room)
+	return f, true
+}
+
+// pick returns the lane to take the next frame from, or -1 if q is empty.
+// Under strict priority it is the highest lane with a frame. Under weighted
+// scheduling each lane may take as many frames in a round as its weight,
+// highest first, and a lane with nothing queued gives up its turn.
+func (q *outQueue) pick() int {
+	for refilled := false; ; refilled = true {
+		for i := range q.lanes {
+			if len(q.lanes[i].frames) > 0 && (q.weights[i] == 0 || q.credit[i] > 0) {
+				if q.weights[i] > 0 {
+					q.credit[i]--
+				}
+				return i
+			}
+		}
+		if refilled || q.weights[0] == 0 || q.lenLocked() == 0 {
+			return -1
+		}
+		q.credit = q.weights
+	}
+}
+
+func (l *lane) pop() Frame {
+	f := l.frames[0]
+	l.frames[0] = Frame{} // for the garbage collector
+	l.frames = l.frames[1:]
+	if f.key != "" && l.keys[f.key] == l.popped {
+		delete(l.keys, f.key)
+	}
+	l.popped++
+	return f
+}
+
+// pushDropping makes room for f in its lane by dropping the oldest droppable
+// frame there, or every one if all is set, and queues it. It returns how many
+// frames it dropped, and whether f was queued; if it was not, nothing was
+// dropped.
+func (q *outQueue) pushDropping(f Frame, all bool) (dropped int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pushLocked(f) {
+		return 0, true
+	}
+	l := &q.lanes[laneOf(f.priority)]
+	kept := l.frames[:0]
+	for _, old := range l.frames {
+		if old.droppable() && (all || dropped == 0) {
+			dropped++
+		} else {
+			kept = append(kept, old)
+		}
+	}
+	if dropped == 0 {
+		return 0, false
+	}
+	clear(l.frames[len(kept):])
+	l.frames = kept
+	l.reindex()
+	return dropped, q.pushLocked(f)
+}
+
+// reindex rebuilds keys after frames were removed from the middle of l.
+func (l *lane) reindex() {
+	clear(l.keys)
+	for i, f := range l.frames {
+		if f.key != "" {
+			l.keys[f.key] = l.popped + uint64(i)
+		}
+	}
+}
+
+// drain takes every frame off q, highest lane first.
+func (q *outQueue) drain() []Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var frames []Frame
+	for i := range q.lanes {
+		l := &q.lanes[i]
+		frames = append(frames, l.frames...)
+		l.popped += uint64(len(l.frames))
+		l.frames = nil
+		clear(l.keys)
+	}
+	signal(q.room)
+	return frames
+}
+
+// len returns how many frames are queued, in every lane.
+func (q *outQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+func (q *outQueue) lenLocked() int {
+	n := 0
+	for i := range q.lanes {
+		n += len(q.lanes[i].frames)
+	}
+	return n
+}
+
+// fits reports whether q has room for every one of frames, each in its lane.
+func (q *outQueue) fits(frames []Frame) bool {
+	var need [numLanes]int
+	for _, f := range frames {
+		need[laneOf(f.priority)]++
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.lanes {
+		if need[i] > q.lanes[i].capacity-len(q.lanes[i].frames) {
+			return false
+		}
+	}
+	return true
+}
+
+// capacity returns the capacity of priority p's lane.
+func (q *outQueue) capacity(p message.Priority) int {
+	return q.lanes[laneOf(p)].capacity
+}
+
+// signal leaves a token in ch unless it holds one already.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,67 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// price broadcasts symbol's price, keyed by symbol.
+func price(r *Registry, symbol string, p int) {
+	r.BroadcastToAll(message.WithConflationKey(&message.ByteMessage{Data: []byte(fmt.Sprintf("%s=%d", symbol, p))}, symbol))
+}
+
+func TestKeyedFramesReplaceQueuedOnes(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+
+	price(r, "ACME", 1)
+	say(r, "", "news")
+	price(r, "XYZZ", 1)
+	price(r, "ACME", 2)
+	if got := strings.Join(drain(conn), " "); got != "ACME=2 news XYZZ=1" {
+		t.Fatalf("queue held %s, want ACME's latest price in its first one's place", got)
+	}
+
+	// Once written, a keyed frame is history: the next update queues anew.
+	price(r, "ACME", 3)
+	next(t, conn)
+	price(r, "ACME", 4)
+	if got := strings.Join(drain(conn), " "); got != "ACME=4" {
+		t.Fatalf("queue held %s, want the update after the write", got)
+	}
+}
+
+func TestKeyedUpdatesKeepALaggingClientConnected(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r, WithSendBuffer(2))
+	for i := 1; i <= 100; i++ {
+		price(r, "ACME", i)
+		price(r, "XYZZ", -i)
+	}
+	if got := strings.Join(drain(conn), " "); got != "ACME=100 XYZZ=-100" {
+		t.Fatalf("queue held %s, want the latest of each", got)
+	}
+	if conn.CloseInfo().SlowConsumer {
+		t.Fatal("a client behind on two keys was evicted")
+	}
+
+	// A third key does not fit, and the usual policy applies.
+	price(r, "ACME", 1)
+	price(r, "XYZZ", 1)
+	price(r, "QQQQ", 1)
+	if !closed(conn) {
+		t.Fatal("a third key overflowing the queue left the connection open")
+	}
+}
+
+func TestBackplaneCarriesTheConflationKey(t *testing.T) {
+	rs := replicas(t, 2)
+	conn := registered(rs[1])
+	price(rs[0], "ACME", 1)
+	if f := next(t, conn); f.key != "ACME" {
+		t.Fatalf("frame from the other replica has key %q, want ACME", f.key)
+	}
+}
@@ -2,13 +2,22 @@ package connection
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
+// ErrGroupNotFound is returned for an operation on a group that does not exist.
+var ErrGroupNotFound = errors.New("connection: group not found")
+
 // Registry manages active WebSocket connections and supports broadcasting to groups.
 type Registry struct {
 	connections map[*Connection]bool            // Global list of all connections
@@ -26,25 +35,93 @@ type Registry struct {
 	// allowed. It defaults to same-origin-only (see defaultCheckOrigin).
 	// Override it to allow specific additional origins.
 	CheckOrigin func(r *http.Request) bool
+
+	// Hooks are called as connections and groups change. Set them before Run.
+	Hooks Hooks
+
+	cfg config // Defaults for every handler; see Option.
+
+	// Resumable sessions by token, and the subset whose connection has gone.
+	// See session.go.
+	sessions map[string]*session
+	parked   map[*session]bool
+
+	histories map[string]*groupHistory // by group name; see history.go
+
+	presence map[string]map[string]*presenceMember // by group, then key; see presence.go
+	// Keys present on other replicas, by group, then origin node, then key,
+	// with their metadata; see applyRemotePresence.
+	remotePresence map[string]map[string]map[string]json.RawMessage
+
+	// Registered connections by ID, and by their principal's user ID; see
+	// direct.go.
+	byID   map[string]*Connection
+	byUser map[string]map[*Connection]bool
+
+	transports map[string]*Connection // by transport token; see transport.go
+
+	// Events waiting for the hooks and subscribers, and whether a goroutine
+	// is delivering them; see lifecycle.go. subMu guards subscribers.
+	pending     []Event
+	dispatching bool
+	subMu       sync.Mutex
+	subscribers map[chan Event]bool
+
+	// Groups whose broadcasts go out uncompressed, and whether any handler
+	// compresses at all; see compression.go.
+	uncompressed map[string]bool
+	compressing  atomic.Bool
+
+	codecs map[string]message.Codec // every handler's, by name; see codec.go
+
+	slowPolicies map[string]SlowConsumerPolicy // by group; see slowconsumer.go
+
+	// node tells this Registry's backplane messages from other replicas';
+	// outbox holds them until they are published. See backplane.go.
+	node   string
+	outbox chan remoteMessage
 }
 
 // NewRegistry creates a new Registry instance. Each Registry is independent,
-// so a process can run multiple isolated servers (or one per test).
-func NewRegistry() *Registry {
+// so a process can run multiple isolated servers (or one per test). opts
+// replace the defaults for every connection it accepts; it panics if they are
+// invalid.
+func NewRegistry(opts ...Option) *Registry {
 	return &Registry{
-		connections: make(map[*Connection]bool),
-		groups:      make(map[string]map[*Connection]bool),
-		register:    make(chan *Connection),
-		unregister:  make(chan *Connection),
-		stopped:     make(chan struct{}),
-		CheckOrigin: defaultCheckOrigin,
+		connections:    make(map[*Connection]bool),
+		groups:         make(map[string]map[*Connection]bool),
+		register:       make(chan *Connection),
+		unregister:     make(chan *Connection),
+		stopped:        make(chan struct{}),
+		CheckOrigin:    defaultCheckOrigin,
+		cfg:            defaultConfig().resolve(opts...),
+		sessions:       make(map[string]*session),
+		parked:         make(map[*session]bool),
+		histories:      make(map[string]*groupHistory),
+		presence:       make(map[string]map[string]*presenceMember),
+		remotePresence: make(map[string]map[string]map[string]json.RawMessage),
+		byID:           make(map[string]*Connection),
+		byUser:         make(map[string]map[*Connection]bool),
+		transports:     make(map[string]*Connection),
+		subscribers:    make(map[chan Event]bool),
+		uncompressed:   make(map[string]bool),
+		codecs:         make(map[string]message.Codec),
+		slowPolicies:   make(map[string]SlowConsumerPolicy),
+		node:           uuid.NewString(),
+		outbox:         make(chan remoteMessage, backplaneOutbox),
 	}
 }
 
 // Run processes connection registration and unregistration until ctx is
 // canceled. On cancellation it closes every active connection (draining the
-// server) and returns. Callers start it with `go registry.Run(ctx)`.
+// server) and returns. Callers start it with `go registry.Run(ctx)`. With a
+// backplane, Run also keeps the Registry subscribed to it and publishes to it
+// until ctx is canceled.
 func (r *Registry) Run(ctx context.Context) {
+	if r.cfg.backplane != nil {
+		go r.subscribe(ctx)
+		go r.publishLoop(ctx)
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -55,9 +132,7 @@ func (r *Registry) Run(ctx context.Context) {
 			return
 
 		case conn := <-r.register:
-			r.mu.Lock()
-			r.connections[conn] = true
-			r.mu.Unlock()
+			r.registerConnection(conn)
 
 		case conn := <-r.unregister:
 			r.unregisterConnection(conn)
@@ -65,19 +140,46 @@ func (r *Registry) Run(ctx context.Context) {
 	}
 }
 
+// registerConnection adds conn to the registry, attaching its session if
+// sessions are on, and releases its pumps.
+func (r *Registry) registerConnection(conn *Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer close(conn.registered)
+
+	r.connections[conn] = true
+	if conn.cfg.sessionGrace > 0 {
+		r.attachSession(conn)
+	}
+	r.index(conn)
+	r.emit(Event{Kind: EventConnect, Conn: conn})
+}
+
 // unregisterConnection removes conn from the registry and from every group
 // it had joined. It's called once a connection's pumps have exited for good.
+// A session conn carried is parked rather than forgotten.
 func (r *Registry) unregisterConnection(conn *Connection) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if conn.session != nil && conn.groups != nil {
+		r.detachSession(conn)
+	}
 	delete(r.connections, conn)
+	r.unindex(conn)
 	for groupName := range conn.groups {
 		if group, exists := r.groups[groupName]; exists {
 			delete(group, conn)
+			r.emit(Event{Kind: EventLeave, Conn: conn, Group: groupName})
 		}
 	}
+	for groupName := range conn.presence {
+		r.leavePresence(groupName, conn)
+	}
 	conn.groups = nil
+	info := conn.CloseInfo()
+	conn.logger().Log(context.Background(), closeLevel(info), "Connection closed", closeAttrs(info)...)
+	r.emit(Event{Kind: EventDisconnect, Conn: conn, Close: info})
 }
 
 // closeAll closes and removes every currently registered connection.
@@ -85,9 +187,18 @@ func (r *Registry) closeAll() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// Run is returning, so nothing will unregister these: their disconnects
+	// are reported here.
 	for conn := range r.connections {
 		delete(r.connections, conn)
+		r.unindex(conn)
+		conn.noteClose(CloseInfo{Code: websocket.CloseGoingAway, Reason: "server shutting down"})
 		conn.CloseConnection()
+		r.emit(Event{Kind: EventDisconnect, Conn: conn, Close: conn.CloseInfo()})
+	}
+	// Nor will any session be resumed, so what they have unacked fails now.
+	for _, s := range r.sessions {
+		s.reliable.fail(s.connID, ErrConnectionClosed)
 	}
 }
 
@@ -98,23 +209,41 @@ func (r *Registry) CreateGroup(name string) {
 
 	if _, exists := r.groups[name]; !exists {
 		r.groups[name] = make(map[*Connection]bool)
+		r.emit(Event{Kind: EventGroupCreated, Group: name})
 	}
 }
 
-// DeleteGroup removes a group and closes all connections within it.
+// DeleteGroup removes a group and closes all connections within it, on every
+// replica sharing the backplane.
 func (r *Registry) DeleteGroup(name string) {
+	r.deleteGroup(name)
+	r.publish(remoteMessage{Kind: remoteDeleteGroup, Group: name})
+}
+
+// deleteGroup deletes name on this replica.
+func (r *Registry) deleteGroup(name string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// Other replicas' keys go with the group, members here or not.
+	delete(r.remotePresence, name)
 	group, exists := r.groups[name]
 	if !exists {
 		return
 	}
 	for conn := range group {
 		delete(r.connections, conn)
+		conn.noteClose(CloseInfo{Code: CloseGroupDeleted, Reason: "group deleted"})
 		conn.CloseConnection()
+		r.emit(Event{Kind: EventLeave, Conn: conn, Group: name})
 	}
 	delete(r.groups, name)
+	r.emit(Event{Kind: EventGroupDeleted, Group: name})
+	delete(r.histories, name)
+	delete(r.uncompressed, name)
+	delete(r.slowPolicies, name)
+	r.forgetPresence(name)
+	r.forgetParkedGroup(name)
 }
 
 // AddToGroup adds a connection to a specific group. Adding a connection the
@@ -122,24 +251,34 @@ func (r *Registry) DeleteGroup(name string) {
 func (r *Registry) AddToGroup(groupName string, conn *Connection) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.addToGroup(groupName, conn)
+}
 
+// addToGroup adds conn to groupName and reports whether it did. Callers hold
+// r.mu.
+func (r *Registry) addToGroup(groupName string, conn *Connection) bool {
 	// unregisterConnection nils this map once a connection's pumps have exited.
 	// Writing to a nil map panics, and the panic is unrecoverable - so an
 	// application that calls AddToGroup on a peer that just disconnected would
 	// take the whole process down. Re-adding it would be wrong anyway: nothing
 	// will unregister it a second time, so it would sit in the group forever.
 	if conn.groups == nil {
-		log.Printf("AddToGroup: connection %s is unregistered; not adding to %q", conn.ID, groupName)
-		return
+		conn.logger().Warn("AddToGroup: connection is unregistered; not adding it", slog.String(LogGroup, groupName))
+		return false
 	}
 
 	group, exists := r.groups[groupName]
 	if !exists {
 		group = make(map[*Connection]bool)
 		r.groups[groupName] = group
+		r.emit(Event{Kind: EventGroupCreated, Group: groupName})
+	}
+	if !group[conn] {
+		group[conn] = true
+		r.emit(Event{Kind: EventJoin, Conn: conn, Group: groupName})
 	}
-	group[conn] = true
 	conn.groups[groupName] = true
+	return true
 }
 
 // RemoveFromGroup removes a connection from a specific group.
@@ -147,10 +286,12 @@ func (r *Registry) RemoveFromGroup(groupName string, conn *Connection) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if group, exists := r.groups[groupName]; exists {
+	if group, exists := r.groups[groupName]; exists && group[conn] {
 		delete(group, conn)
+		r.emit(Event{Kind: EventLeave, Conn: conn, Group: groupName})
 	}
 	delete(conn.groups, groupName)
+	r.leavePresence(groupName, conn)
 }
 
 // BroadcastToAll sends a message to all connections.
@@ -158,7 +299,10 @@ func (r *Registry) BroadcastToAll(msg message.IMessage) {
 	r.Broadcast(msg, "")
 }
 
-// Broadcast sends a message to all connections or to a specific group.
+// Broadcast sends a message to all connections or to a specific group, as a
+// binary frame if msg implements message.Binary and as text otherwise. With a
+// backplane, it reaches the connections of every replica; a group need only
+// exist on one of them.
 //
 // Serialization and the fan-out both happen outside the registry lock. Holding
 // it across them serialized every register, unregister, and group operation
@@ -166,54 +310,86 @@ func (r *Registry) BroadcastToAll(msg message.IMessage) {
 // non-trivial Serialize, that is the whole server's throughput ceiling. The
 // lock now covers only the snapshot of who to send to.
 func (r *Registry) Broadcast(msg message.IMessage, groupName string) {
-	serializedMsg, err := msg.Serialize()
+	set, err := newFrameSet(msg)
 	if err != nil {
-		log.Printf("Error serializing message: %v", err)
+		r.cfg.log().Error("Broadcast: serializing message failed", slog.String(LogGroup, groupName), slog.Any(LogError, err))
 		return
 	}
 
+	found := r.fanOut(set, groupName)
+	if r.cfg.backplane != nil {
+		r.publish(r.remote(remoteMessage{Kind: remoteBroadcast, Group: groupName}, set))
+	} else if !found {
+		r.cfg.log().Warn("Broadcast: group not found", slog.String(LogGroup, groupName))
+	}
+}
+
+// fanOut queues set for this replica's connections in groupName, or all of
+// them if it is empty, each in the codec it negotiated, and reports whether
+// the group exists here.
+func (r *Registry) fanOut(set *frameSet, groupName string) bool {
+	start := time.Now()
+	targets, policy, ok := r.targets(groupName, &set.base)
+	if !ok {
+		return false
+	}
+
+	// A connection that's mid-close just has a queue nobody drains, and only
+	// a BlockFor policy makes the broadcaster wait on it.
+	//
+	// A full queue means the peer is not keeping up. By default the
+	// connection is closed, and the existing unregister path reaps it: where
+	// broadcasts carry state rather than chatter, dropping the message would
+	// leave the client silently stale with no error anywhere. A chat room or
+	// telemetry stream can drop or conflate instead; see SlowConsumerPolicy.
+	for _, batch := range byCodec(targets) {
+		frame, err := set.frame(batch.codec)
+		if err != nil {
+			r.cfg.log().Error("Broadcast: encoding message failed", slog.String(LogGroup, groupName), slog.String("codec", batch.codec.Name()), slog.Any(LogError, err))
+			continue
+		}
+		r.prepare(&frame, len(batch.conns))
+		for _, conn := range batch.conns {
+			conn.offer(frame, policy, true)
+		}
+	}
+	r.cfg.metrics.Broadcast(len(targets), time.Since(start))
+	return true
+}
+
+// targets snapshots the connections in groupName, or every connection if it is
+// empty, and the group's slow-consumer policy, if it has one. ok is false if
+// the group does not exist. A non-nil record is recorded for the parked
+// sessions the snapshot would have included, and in the group's history, in
+// the same critical section, so a session resuming or a member joining with
+// history concurrently gets it exactly once.
+func (r *Registry) targets(groupName string, record *Frame) (targets []*Connection, policy *SlowConsumerPolicy, ok bool) {
 	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	var source map[*Connection]bool
 	if groupName == "" {
 		source = r.connections
-	} else if group, ok := r.groups[groupName]; ok {
+	} else if group, exists := r.groups[groupName]; exists {
 		source = group
 	} else {
-		r.mu.Unlock()
-		log.Printf("Group %s not found.", groupName)
-		return
+		return nil, nil, false
 	}
 	// Copy rather than range outside the lock: the maps are mutated by
 	// register/unregister, and ranging one concurrently is a fatal runtime
 	// throw, not a recoverable race.
-	targets := make([]*Connection, 0, len(source))
+	targets = make([]*Connection, 0, len(source))
 	for conn := range source {
 		targets = append(targets, conn)
 	}
-	r.mu.Unlock()
-
-	// Send is never closed (see Connection.CloseConnection), so this can never
-	// panic - a connection that's mid-close just has a queue nobody drains, and
-	// the default case below keeps that from blocking the broadcaster.
-	for _, conn := range targets {
-		select {
-		case conn.Send <- serializedMsg:
-			// Message successfully queued to send.
-		default:
-			// A backlog this deep means the peer stopped draining, not that it
-			// is briefly slow. Dropping the message used to be the response,
-			// which is only defensible for a chat hub: where broadcasts carry
-			// state rather than chatter, the client is left silently stale with
-			// no error anywhere. Closing is the truthful reading, and the
-			// existing unregister path reaps it from here.
-			//
-			// Closed off the broadcast goroutine because CloseConnection waits
-			// for the write pump's close frame, and the broadcaster - often a
-			// game or event loop - must not pay that latency per dead peer.
-			log.Printf("Connection %s is not draining; closing it.", conn.ID)
-			go conn.CloseConnection()
+	if record != nil {
+		if r.uncompressed[groupName] {
+			record.noCompress = true
 		}
+		r.recordParked(*record, groupName)
+		r.recordHistory(*record, groupName)
 	}
+	return targets, r.slowPolicy(groupName), true
 }
 
 // ClearConnections closes and removes all active connections. For testing use only.
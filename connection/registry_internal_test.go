@@ -73,12 +73,13 @@ func TestConcurrentBroadcastDuringDisconnect(t *testing.T) {
 		r.connections[c] = true
 		r.mu.Unlock()
 
-		// Drain Send so the broadcaster doesn't just fill the buffer and
+		// Drain the queue so the broadcaster doesn't just fill the buffer and
 		// hit the default case every time. Stops once the connection closes.
 		go func(c *Connection) {
 			for {
 				select {
-				case <-c.Send:
+				case <-c.out.ready:
+					c.out.pop()
 				case <-c.done:
 					return
 				}
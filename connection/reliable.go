@@ -0,0 +1,386 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// Reliable delivery.
+//
+// A reliable message goes out wrapped in a deliver frame carrying a sequence
+// number that counts up per connection - per session, with WithSessions:
+//
+//	<- {"type": "deliver", "seq": 7, "data": {...}}
+//
+// and the client acknowledges it, cumulatively - acking 7 acks everything up
+// to and including 7:
+//
+//	-> {"type": "ack", "seq": 7}
+//
+// A message that is not acked within the ack timeout is sent again, with the
+// same seq, up to the retransmit limit; clients must therefore tolerate
+// duplicates and can drop any seq they have already seen. A deliver frame the
+// connection's slow-consumer policy drops is sent again the same way. Acks are
+// read by the Router, so the connection's handler must be one.
+//
+// With WithSessions, what is unacked when a connection drops waits with its
+// parked session rather than failing. On resume it is replayed with the rest
+// of the sequence, keeping its seq, and retransmitted on the new connection
+// until acked; if the session expires instead, it fails with
+// ErrConnectionClosed.
+
+// Envelope types for reliable delivery. ackType cannot be routed.
+const (
+	deliverType = "deliver"
+	ackType     = "ack"
+)
+
+var (
+	// ErrAckTimeout is a reliable message's outcome when it went unacked
+	// through every retransmit. The connection is closed.
+	ErrAckTimeout = errors.New("connection: message not acknowledged")
+
+	// ErrUnackedWindow is a reliable message's outcome when its connection
+	// already had the maximum number of messages awaiting an ack. The
+	// connection is closed, as one that stopped draining is.
+	ErrUnackedWindow = errors.New("connection: too many unacknowledged messages; connection closed")
+
+	// ErrBinaryReliable is returned by BroadcastReliable for a binary message,
+	// which cannot travel inside a JSON deliver frame.
+	ErrBinaryReliable = errors.New("connection: reliable delivery needs a text message")
+)
+
+// DeliveryReport is the outcome of a reliable broadcast: which connections
+// acknowledged it and why the others did not.
+type DeliveryReport struct {
+	Acked  []string         // connection IDs
+	Failed map[string]error // connection ID to ErrAckTimeout, ErrUnackedWindow, ErrConnectionClosed, ErrSlowConsumer or the error encoding the deliver frame
+}
+
+// Delivery tracks a reliable broadcast until every target has acked it or
+// failed.
+type Delivery struct {
+	mu      sync.Mutex
+	pending int
+	report  DeliveryReport
+	done    chan struct{}
+}
+
+func newDelivery(targets int) *Delivery {
+	d := &Delivery{
+		pending: targets,
+		report:  DeliveryReport{Failed: make(map[string]error)},
+		done:    make(chan struct{}),
+	}
+	if targets == 0 {
+		close(d.done)
+	}
+	return d
+}
+
+// Done is closed once every target's outcome is known.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until every target's outcome is known or ctx ends, and returns
+// the report so far. The error is ctx's if it ended first.
+func (d *Delivery) Wait(ctx context.Context) (DeliveryReport, error) {
+	var err error
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return d.Report(), err
+}
+
+// Report returns the outcomes known so far.
+func (d *Delivery) Report() DeliveryReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := DeliveryReport{
+		Acked:  append([]string(nil), d.report.Acked...),
+		Failed: make(map[string]error, len(d.report.Failed)),
+	}
+	for id, err := range d.report.Failed {
+		report.Failed[id] = err
+	}
+	return report
+}
+
+// settle records connID's outcome: acked if err is nil.
+func (d *Delivery) settle(connID string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		d.report.Acked = append(d.report.Acked, connID)
+	} else {
+		d.report.Failed[connID] = err
+	}
+	if d.pending--; d.pending == 0 {
+		close(d.done)
+	}
+}
+
+// unacked is one reliable message a connection has not acknowledged yet.
+type unacked struct {
+	seq      uint64
+	frame    Frame
+	sentAt   time.Time
+	resends  int
+	delivery *Delivery
+}
+
+// reliableState is a connection's side of reliable delivery, or its session's,
+// which hands it on to each connection that resumes it. A retransmit goroutine
+// runs while there is anything unacked and settles whatever is left when the
+// connection closes, unless a session keeps it.
+type reliableState struct {
+	mu      sync.Mutex
+	nextSeq uint64
+	unacked []*unacked  // in seq order
+	loop    *Connection // whose retransmit goroutine is watching unacked, if any
+}
+
+// watch starts c's retransmit goroutine, unless one is already watching.
+// Callers hold mu.
+func (s *reliableState) watch(c *Connection) {
+	if s.loop == nil {
+		s.loop = c
+		go c.retransmitLoop()
+	}
+}
+
+// BroadcastReliable sends msg to every connection in groupName - or every
+// connection, if it is empty - with at-least-once delivery: each connection
+// must ack it, and unacked copies are retransmitted on a timer. The returned
+// Delivery reports each connection's outcome.
+//
+// It fans out exactly as Broadcast does; only the framing and the bookkeeping
+// differ. msg must serialize to text. JSON is embedded as the deliver frame's
+// data and any other text as a JSON string.
+func (r *Registry) BroadcastReliable(msg message.IMessage, groupName string) (*Delivery, error) {
+	frame, err := newFrame(msg)
+	if err != nil {
+		return nil, err
+	}
+	if frame.IsBinary() {
+		return nil, ErrBinaryReliable
+	}
+	var data any = json.RawMessage(frame.Data)
+	if !json.Valid(frame.Data) {
+		data = string(frame.Data)
+	}
+
+	targets, _, ok := r.targets(groupName, nil)
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+
+	d := newDelivery(len(targets))
+	for _, conn := range targets {
+		conn.sendReliable(data, d)
+	}
+	return d, nil
+}
+
+// sendReliable queues data for conn as the next reliable message and settles
+// d for conn if that fails outright.
+func (c *Connection) sendReliable(data any, d *Delivery) {
+	c.reliable.mu.Lock()
+	if len(c.reliable.unacked) >= c.cfg.unackedWindow {
+		c.reliable.mu.Unlock()
+		c.logger().Warn("Too many unacknowledged messages; closing connection", slog.Int("unacked", c.cfg.unackedWindow))
+		d.settle(c.ID, ErrUnackedWindow)
+		c.noteClose(CloseInfo{Code: websocket.ClosePolicyViolation, Reason: "too many unacknowledged messages", SlowConsumer: true})
+		go c.CloseConnection()
+		return
+	}
+
+	seq := c.reliable.nextSeq + 1
+	encoded, err := json.Marshal(outEnvelope{Type: deliverType, Seq: seq, Data: data})
+	if err != nil {
+		c.reliable.mu.Unlock()
+		d.settle(c.ID, err)
+		return
+	}
+	c.reliable.nextSeq = seq
+	m := &unacked{seq: seq, frame: TextFrame(encoded), sentAt: time.Now(), delivery: d}
+	c.reliable.unacked = append(c.reliable.unacked, m)
+	c.reliable.watch(c)
+	c.reliable.mu.Unlock()
+
+	// A message the connection's slow-consumer policy drops stays unacked,
+	// and the retransmit timer sends it again.
+	if err := c.queue(m.frame); err != nil && !errors.Is(err, ErrMessageDropped) {
+		// The retransmit loop may have settled it already, if the connection
+		// closed in the meantime; a Delivery must hear about each target once.
+		c.reliable.mu.Lock()
+		removed := c.reliable.remove(seq)
+		c.reliable.mu.Unlock()
+		if removed {
+			d.settle(c.ID, err)
+		}
+	}
+}
+
+// remove drops seq from unacked and reports whether it was there. Callers
+// hold mu.
+func (s *reliableState) remove(seq uint64) bool {
+	for i, m := range s.unacked {
+		if m.seq == seq {
+			s.unacked = append(s.unacked[:i], s.unacked[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ack settles every unacked message up to and including seq.
+func (c *Connection) ack(seq uint64) {
+	c.reliable.mu.Lock()
+	n := 0
+	for n < len(c.reliable.unacked) && c.reliable.unacked[n].seq <= seq {
+		n++
+	}
+	acked := c.reliable.unacked[:n:n]
+	c.reliable.unacked = c.reliable.unacked[n:]
+	c.reliable.mu.Unlock()
+
+	for _, m := range acked {
+		m.delivery.settle(c.ID, nil)
+	}
+}
+
+// retransmitLoop resends overdue messages until nothing is unacked, or
+// another connection has taken over c's session, and settles everything still
+// unacked once the connection closes; see handOff for a session's.
+func (c *Connection) retransmitLoop() {
+	// Checking at a fraction of the timeout bounds how late a resend can be.
+	ticker := time.NewTicker(c.cfg.ackTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			if c.session != nil {
+				c.handOff()
+				return
+			}
+			c.reliable.fail(c.ID, ErrConnectionClosed)
+			return
+		case now := <-ticker.C:
+			if !c.retransmit(now) {
+				return
+			}
+		}
+	}
+}
+
+// retransmit resends every message older than the ack timeout and reports
+// whether the loop should keep running. A message out of resends means the
+// peer is not acknowledging, so the connection is closed.
+func (c *Connection) retransmit(now time.Time) bool {
+	c.reliable.mu.Lock()
+	if c.reliable.loop != c {
+		c.reliable.mu.Unlock()
+		return false // the session moved on, and its new connection watches
+	}
+	if len(c.reliable.unacked) == 0 {
+		c.reliable.loop = nil
+		c.reliable.mu.Unlock()
+		return false
+	}
+
+	var resend []Frame
+	var expired *unacked
+	for _, m := range c.reliable.unacked {
+		if now.Sub(m.sentAt) < c.cfg.ackTimeout {
+			continue
+		}
+		if m.resends >= c.cfg.maxRetransmits {
+			expired = m
+			break
+		}
+		m.resends++
+		m.sentAt = now
+		resend = append(resend, m.frame)
+	}
+	if expired != nil {
+		c.reliable.remove(expired.seq)
+	}
+	c.reliable.mu.Unlock()
+
+	if expired != nil {
+		c.logger().Warn("Message not acknowledged; closing connection", slog.Uint64("seq", expired.seq))
+		expired.delivery.settle(c.ID, ErrAckTimeout)
+		c.noteClose(CloseInfo{Code: websocket.ClosePolicyViolation, Reason: "message not acknowledged"})
+		go c.CloseConnection()
+		return true // done fires next and settles the rest
+	}
+	for _, f := range resend {
+		if c.queue(f) != nil {
+			break // closing; done settles the rest
+		}
+	}
+	return true
+}
+
+// handOff lets go of c's session's unacked messages once c has closed. If
+// another connection has taken the session over, its retransmit goroutine
+// watches them from now on; otherwise they wait with the parked session.
+func (c *Connection) handOff() {
+	s := c.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.reliable.mu.Lock()
+	defer c.reliable.mu.Unlock()
+
+	if c.reliable.loop != c {
+		return
+	}
+	c.reliable.loop = nil
+	if next := s.conn; next != nil && len(c.reliable.unacked) > 0 {
+		c.reliable.watch(next)
+	}
+}
+
+// resumed has c watch the unacked messages of the session it has just
+// resumed. The replay queued with them sends each again, so each one's ack
+// timeout starts over.
+func (s *reliableState) resumed(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unacked) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, m := range s.unacked {
+		m.sentAt = now
+	}
+	s.loop = nil // a taken-over connection's goroutine stops at its next tick
+	s.watch(c)
+}
+
+// fail settles every unacked message with err, as connID's outcome.
+func (s *reliableState) fail(connID string, err error) {
+	s.mu.Lock()
+	failed := s.unacked
+	s.unacked = nil
+	s.loop = nil
+	s.mu.Unlock()
+
+	for _, m := range failed {
+		m.delivery.settle(connID, err)
+	}
+}
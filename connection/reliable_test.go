@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// registered returns a connection with a nil socket, registered with r so
+// broadcasts reach it. Its queue is read directly in place of a write pump.
+func registered(r *Registry, opts ...Option) *Connection {
+	conn := NewConnection(nil, nil, opts...)
+	r.mu.Lock()
+	r.connections[conn] = true
+	r.mu.Unlock()
+	return conn
+}
+
+// nextDeliver reads the next frame off conn's queue as a deliver envelope.
+func nextDeliver(t *testing.T, conn *Connection) Envelope {
+	t.Helper()
+	f := next(t, conn)
+	var env Envelope
+	if err := json.Unmarshal(f.Data, &env); err != nil || env.Type != deliverType {
+		t.Fatalf("got %s, want a deliver frame", f.Data)
+	}
+	return env
+}
+
+func waitDelivery(t *testing.T, d *Delivery) DeliveryReport {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	report, err := d.Wait(ctx)
+	if err != nil {
+		t.Fatalf("delivery never settled: %v", err)
+	}
+	return report
+}
+
+func TestReliableBroadcastIsAcked(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+
+	d, err := r.BroadcastReliable(message.NewJSONMessage(map[string]int{"x": 1}), "")
+	if err != nil {
+		t.Fatalf("BroadcastReliable: %v", err)
+	}
+	env := nextDeliver(t, conn)
+	if env.Seq != 1 || string(env.Data) != `{"x":1}` {
+		t.Fatalf("got seq %d data %s, want seq 1 with the message as data", env.Seq, env.Data)
+	}
+
+	// The ack arrives the way a client sends it, through the router.
+	NewRouter().HandleMessage(conn, []byte(`{"type":"ack","seq":1}`))
+
+	report := waitDelivery(t, d)
+	if len(report.Acked) != 1 || report.Acked[0] != conn.ID || len(report.Failed) != 0 {
+		t.Fatalf("got %+v, want only %s acked", report, conn.ID)
+	}
+}
+
+// Acks are cumulative: acking a later seq settles every earlier one too.
+func TestReliableAckIsCumulative(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r)
+
+	var deliveries []*Delivery
+	for i := 0; i < 3; i++ {
+		d, _ := r.BroadcastReliable(message.NewJSONMessage(i), "")
+		deliveries = append(deliveries, d)
+	}
+	conn.ack(3)
+
+	for i, d := range deliveries {
+		if report := waitDelivery(t, d); len(report.Acked) != 1 {
+			t.Errorf("message %d: got %+v, want it acked", i+1, report)
+		}
+	}
+}
+
+func TestUnackedMessagesAreRetransmittedThenGivenUp(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r, WithAckTimeout(40*time.Millisecond), WithMaxRetransmits(2))
+
+	d, _ := r.BroadcastReliable(message.NewJSONMessage("state"), "")
+
+	// The original and both retransmits, all under the same seq.
+	for i := 0; i < 3; i++ {
+		if env := nextDeliver(t, conn); env.Seq != 1 {
+			t.Fatalf("send %d: got seq %d, want 1", i, env.Seq)
+		}
+	}
+
+	report := waitDelivery(t, d)
+	if !errors.Is(report.Failed[conn.ID], ErrAckTimeout) {
+		t.Fatalf("got %+v, want ErrAckTimeout for %s", report, conn.ID)
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a connection that never acks was left open")
+	}
+}
+
+// A deliver frame the slow-consumer policy drops is not lost: it stays unacked
+// and is retransmitted once there is room.
+func TestDroppedReliableMessageIsRetransmitted(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r, WithSendBuffer(1), WithSlowConsumerPolicy(DropNewest), WithAckTimeout(40*time.Millisecond))
+	conn.queue(TextFrame([]byte("filler")))
+
+	d, _ := r.BroadcastReliable(message.NewJSONMessage("state"), "")
+	if f := next(t, conn); string(f.Data) != "filler" {
+		t.Fatalf("got %s, want the filler", f.Data)
+	}
+	env := nextDeliver(t, conn)
+	if env.Seq != 1 {
+		t.Fatalf("retransmit: got seq %d, want 1", env.Seq)
+	}
+	conn.ack(env.Seq)
+	if report := waitDelivery(t, d); len(report.Acked) != 1 {
+		t.Fatalf("got %+v, want the message acked", report)
+	}
+}
+
+// A connection that lets too many messages go unacked is treated exactly like
+// one whose send buffer filled: it is closed.
+func TestUnackedWindowClosesConnection(t *testing.T) {
+	r := NewRegistry()
+	conn := registered(r, WithUnackedWindow(2))
+
+	first, _ := r.BroadcastReliable(message.NewJSONMessage(1), "")
+	r.BroadcastReliable(message.NewJSONMessage(2), "")
+	third, _ := r.BroadcastReliable(message.NewJSONMessage(3), "")
+
+	if report := waitDelivery(t, third); !errors.Is(report.Failed[conn.ID], ErrUnackedWindow) {
+		t.Fatalf("third message: got %+v, want ErrUnackedWindow", report)
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a connection over its unacked window was left open")
+	}
+	// What it still owed is settled by the close.
+	if report := waitDelivery(t, first); !errors.Is(report.Failed[conn.ID], ErrConnectionClosed) {
+		t.Fatalf("first message: got %+v, want ErrConnectionClosed", report)
+	}
+}
+
+func TestReliableBroadcastRejectsBinaryAndUnknownGroups(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.BroadcastReliable(&message.ByteMessage{Data: []byte{1}}, ""); !errors.Is(err, ErrBinaryReliable) {
+		t.Errorf("binary message: got %v, want ErrBinaryReliable", err)
+	}
+	if _, err := r.BroadcastReliable(message.NewJSONMessage(1), "nope"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("unknown group: got %v, want ErrGroupNotFound", err)
+	}
+}
@@ -0,0 +1,241 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// Envelope is the JSON wrapper a [Router] reads and writes:
+//
+//	{"type": "join", "data": {"group": "room-1"}}
+//
+// Type picks the route; Data is decoded into that route's request type. ID is
+// optional and makes the envelope a request whose answer carries the same ID;
+// see [HandleAsync] and [Connection.Call]. Error is set only on error frames,
+// whose Type is "error".
+type Envelope struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Seq   uint64          `json:"seq,omitempty"` // reliable delivery only; see Registry.BroadcastReliable
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *Error          `json:"error,omitempty"`
+}
+
+// Error codes a Router puts in the error frames it sends.
+const (
+	CodeBadEnvelope  = "bad_envelope"  // the frame was not an envelope at all
+	CodeUnknownType  = "unknown_type"  // no route for the envelope's type
+	CodeBadRequest   = "bad_request"   // data did not decode into the route's request type
+	CodeHandlerError = "handler_error" // the route returned an error that was not an *Error
+)
+
+// errorType is the envelope type of error frames. It cannot be routed.
+const errorType = "error"
+
+// Error is the body of an error frame. A route can return one to choose the
+// code and message its client sees; any other error is reported as
+// CodeHandlerError with the error's text.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// outEnvelope is Envelope with the data still unencoded, for the send side.
+type outEnvelope struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"`
+	Data  any    `json:"data,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// NewEnvelope returns a message in the Router's envelope format, for sending
+// through Registry.Broadcast and friends so clients can dispatch server pushes
+// the same way they dispatch replies.
+func NewEnvelope(typ string, data any) message.IMessage {
+	return message.NewJSONMessage(outEnvelope{Type: typ, Data: data})
+}
+
+// route decodes an envelope's data, runs the route, and returns the reply data.
+// A nil reply means there is nothing to send back, or nothing yet.
+type route func(conn *Connection, env Envelope) (any, error)
+
+// Router is a MessageHandler that decodes each inbound frame as an [Envelope]
+// once and dispatches it by type to a route registered with [Handle]. It
+// replaces the hand-rolled unmarshal-and-switch every handler otherwise repeats:
+//
+//	router := connection.NewRouter()
+//	connection.Handle(router, "join", func(c *connection.Connection, req JoinReq) (*JoinResp, error) {
+//	    reg.AddToGroup(req.Group, c)
+//	    return &JoinResp{Group: req.Group}, nil
+//	})
+//	http.Handle("/ws", reg.RegisterHandler(router))
+//
+// A route's reply goes back as an envelope of the same type. Frames that are
+// not envelopes, name no route, or carry data that does not decode get an error
+// frame instead, and so does a route that returns an error:
+//
+//	{"type": "error", "error": {"code": "unknown_type", "message": "no route for \"jion\""}}
+//
+// None of these close the connection; they are the client's mistake to report,
+// not a reason to drop it.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]route
+}
+
+// NewRouter returns a Router with no routes.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]route)}
+}
+
+// Handle registers fn as the route for envelopes of type typ. Each envelope's
+// data is decoded into a fresh Req; a nil Resp (a nil pointer, map, slice or
+// interface) sends no reply. It panics if typ is empty, reserved, or already
+// registered.
+//
+// Handle is a function rather than a Router method because Go methods cannot
+// take type parameters.
+func Handle[Req, Resp any](rt *Router, typ string, fn func(conn *Connection, req Req) (Resp, error)) {
+	rt.add(typ, func(conn *Connection, env Envelope) (any, error) {
+		var req Req
+		if err := decodeData(env.Data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := fn(conn, req)
+		if err != nil {
+			return nil, err
+		}
+		if isNil(resp) {
+			return nil, nil
+		}
+		return resp, nil
+	})
+}
+
+// decodeData decodes an envelope's data into v, leaving v zero if there is
+// none.
+func decodeData(data json.RawMessage, v any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &Error{Code: CodeBadRequest, Message: err.Error()}
+	}
+	return nil
+}
+
+func (rt *Router) add(typ string, r route) {
+	if typ == "" || typ == errorType || typ == cancelType || typ == ackType {
+		panic(fmt.Sprintf("connection: cannot route envelope type %q", typ))
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, exists := rt.routes[typ]; exists {
+		panic(fmt.Sprintf("connection: route %q registered twice", typ))
+	}
+	rt.routes[typ] = r
+}
+
+// HandleMessage implements MessageHandler.
+func (rt *Router) HandleMessage(conn *Connection, msg []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil || env.Type == "" {
+		return errorFrame("", &Error{Code: CodeBadEnvelope, Message: "expected a JSON object with a \"type\""})
+	}
+
+	// Protocol frames are for the connection, not for a route.
+	switch env.Type {
+	case cancelType:
+		conn.cancelRequest(env.ID)
+		return nil, nil
+	case ackType:
+		conn.ack(env.Seq)
+		return nil, nil
+	}
+	if env.Type == helloType && len(conn.cfg.codecs) > 0 {
+		// Only with codecs to negotiate, so an application's own "hello"
+		// route keeps working without them.
+		var hello helloData
+		if err := json.Unmarshal(env.Data, &hello); err != nil {
+			return errorFrame(env.ID, &Error{Code: CodeBadRequest, Message: err.Error()})
+		}
+		if err := conn.SetCodec(hello.Codec); err != nil {
+			return errorFrame(env.ID, &Error{Code: CodeUnknownCodec, Message: err.Error()})
+		}
+		return nil, nil
+	}
+	if strings.HasPrefix(env.ID, serverIDPrefix) {
+		// An answer to a Call. One that arrives after the Call gave up has
+		// nobody to go to and is dropped.
+		conn.resolveCall(env)
+		return nil, nil
+	}
+
+	rt.mu.RLock()
+	r, ok := rt.routes[env.Type]
+	rt.mu.RUnlock()
+	if !ok {
+		return errorFrame(env.ID, &Error{Code: CodeUnknownType, Message: fmt.Sprintf("no route for %q", env.Type)})
+	}
+
+	resp, err := r(conn, env)
+	if err != nil {
+		return errorFrame(env.ID, asRouteError(err))
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	reply, err := json.Marshal(outEnvelope{Type: env.Type, ID: env.ID, Data: resp})
+	if err != nil {
+		return errorFrame(env.ID, &Error{Code: CodeHandlerError, Message: err.Error()})
+	}
+	return reply, nil
+}
+
+// HandleFrame implements FrameHandler so that replies are always text frames,
+// even to a client that sent its envelope in a binary one.
+func (rt *Router) HandleFrame(conn *Connection, in Frame) (Frame, error) {
+	reply, err := rt.HandleMessage(conn, in.Data)
+	if reply == nil {
+		return Frame{}, err
+	}
+	return TextFrame(reply), err
+}
+
+func errorFrame(id string, e *Error) ([]byte, error) {
+	return json.Marshal(outEnvelope{Type: errorType, ID: id, Error: e})
+}
+
+// asRouteError returns err as the *Error a client is sent for it.
+func asRouteError(err error) *Error {
+	var routeErr *Error
+	if !errors.As(err, &routeErr) {
+		routeErr = &Error{Code: CodeHandlerError, Message: err.Error()}
+	}
+	return routeErr
+}
+
+// isNil reports whether v is nil or a typed nil, which encoding/json would
+// otherwise send as "null".
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface, reflect.Chan, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
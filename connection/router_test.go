@@ -0,0 +1,113 @@
+package connection_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+)
+
+type joinReq struct {
+	Group string `json:"group"`
+}
+
+type joinResp struct {
+	Joined string `json:"joined"`
+}
+
+func newJoinRouter() *connection.Router {
+	router := connection.NewRouter()
+	connection.Handle(router, "join", func(_ *connection.Connection, req joinReq) (*joinResp, error) {
+		switch req.Group {
+		case "":
+			return nil, &connection.Error{Code: "missing_group", Message: "group is required"}
+		case "boom":
+			return nil, errors.New("exploded")
+		case "quiet":
+			return nil, nil
+		}
+		return &joinResp{Joined: req.Group}, nil
+	})
+	return router
+}
+
+// decodeEnvelope parses a Router reply, failing the test if it is not one.
+func decodeEnvelope(t *testing.T, reply []byte) connection.Envelope {
+	t.Helper()
+	var env connection.Envelope
+	if err := json.Unmarshal(reply, &env); err != nil {
+		t.Fatalf("reply %q is not an envelope: %v", reply, err)
+	}
+	return env
+}
+
+func TestRouterDispatchesByType(t *testing.T) {
+	reply, err := newJoinRouter().HandleMessage(nil, []byte(`{"type":"join","data":{"group":"room-1"}}`))
+	if err != nil {
+		t.Fatalf("HandleMessage: %v", err)
+	}
+
+	env := decodeEnvelope(t, reply)
+	if env.Type != "join" {
+		t.Errorf("reply type: got %q, want join", env.Type)
+	}
+	var resp joinResp
+	if err := json.Unmarshal(env.Data, &resp); err != nil {
+		t.Fatalf("reply data: %v", err)
+	}
+	if resp.Joined != "room-1" {
+		t.Errorf("reply data: got %+v", resp)
+	}
+}
+
+func TestRouterNilResponseSendsNothing(t *testing.T) {
+	reply, err := newJoinRouter().HandleMessage(nil, []byte(`{"type":"join","data":{"group":"quiet"}}`))
+	if err != nil || reply != nil {
+		t.Fatalf("got reply %q, err %v; want neither", reply, err)
+	}
+}
+
+// Every failure becomes an error frame and none of them returns an error, which
+// would close the connection over what is only a bad request.
+func TestRouterErrorFrames(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		code string
+	}{
+		{"not JSON", `hello`, connection.CodeBadEnvelope},
+		{"no type", `{"data":{}}`, connection.CodeBadEnvelope},
+		{"unknown type", `{"type":"jion"}`, connection.CodeUnknownType},
+		{"data of the wrong shape", `{"type":"join","data":{"group":7}}`, connection.CodeBadRequest},
+		{"route returns *Error", `{"type":"join","data":{}}`, "missing_group"},
+		{"route returns a plain error", `{"type":"join","data":{"group":"boom"}}`, connection.CodeHandlerError},
+	}
+
+	router := newJoinRouter()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := router.HandleMessage(nil, []byte(tc.in))
+			if err != nil {
+				t.Fatalf("HandleMessage returned %v; the connection would be closed", err)
+			}
+			env := decodeEnvelope(t, reply)
+			if env.Type != "error" || env.Error == nil {
+				t.Fatalf("got %s, want an error frame", reply)
+			}
+			if env.Error.Code != tc.code {
+				t.Errorf("error code: got %q, want %q", env.Error.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestRouterRejectsDuplicateRoutes(t *testing.T) {
+	router := newJoinRouter()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a route twice did not panic")
+		}
+	}()
+	connection.Handle(router, "join", func(*connection.Connection, joinReq) (any, error) { return nil, nil })
+}
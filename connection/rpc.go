@@ -0,0 +1,247 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Request/response over a Router.
+//
+// An envelope that carries an "id" is a request, and whatever answers it -
+// a reply envelope or an error frame - carries the same id back, so a client
+// can have many requests in flight and match the answers as they arrive, in
+// any order:
+//
+//	-> {"type": "quote", "id": "7", "data": {"symbol": "ACME"}}
+//	<- {"type": "quote", "id": "7", "data": {"price": 12.5}}
+//
+// Either side may abandon a request it sent with a cancel frame:
+//
+//	-> {"type": "cancel", "id": "7"}
+//
+// The server calls the client the same way (see Connection.Call), using ids
+// that start with "srv:". Clients must not use that prefix for their own ids.
+
+// cancelType is the envelope type of cancel frames. It cannot be routed.
+const cancelType = "cancel"
+
+// serverIDPrefix marks ids the server chose for its own calls.
+const serverIDPrefix = "srv:"
+
+// CodeDuplicateID is sent when a client reuses the id of a request the server
+// is still answering.
+const CodeDuplicateID = "duplicate_id"
+
+// ErrAlreadyAnswered is returned by Request.Reply and Request.Fail after the
+// request has been answered once.
+var ErrAlreadyAnswered = errors.New("connection: request already answered")
+
+// rpcState is a connection's request bookkeeping: the server's calls still
+// waiting on the client, and the client's requests still being answered.
+// Both maps lose their entries when the call or request finishes, and
+// everything in them is released when the connection's context is canceled,
+// so nothing outlives the connection.
+type rpcState struct {
+	mu       sync.Mutex
+	calls    map[string]chan Envelope      // by id; see Connection.Call
+	inflight map[string]context.CancelFunc // by id; see HandleAsync
+	nextID   atomic.Uint64
+}
+
+// Request is a client request being answered by an asynchronous route. Answer
+// it exactly once, with Reply or Fail, from any goroutine; answers to different
+// requests may go out in any order.
+type Request struct {
+	conn   *Connection
+	typ    string
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// Conn returns the connection the request arrived on.
+func (r *Request) Conn() *Connection { return r.conn }
+
+// ID returns the request's id, or "" if the client sent none and so expects
+// no correlated answer.
+func (r *Request) ID() string { return r.id }
+
+// Context is canceled when the client cancels the request, when the
+// connection closes, or once the request has been answered.
+func (r *Request) Context() context.Context { return r.ctx }
+
+// Reply answers the request with data, sent as an envelope of the request's
+// type and id.
+func (r *Request) Reply(data any) error {
+	return r.answer(outEnvelope{Type: r.typ, ID: r.id, Data: data})
+}
+
+// Fail answers the request with an error frame. An *Error is sent as is; any
+// other error as CodeHandlerError.
+func (r *Request) Fail(err error) error {
+	return r.answer(outEnvelope{Type: errorType, ID: r.id, Error: asRouteError(err)})
+}
+
+func (r *Request) answer(env outEnvelope) error {
+	err := ErrAlreadyAnswered
+	r.once.Do(func() {
+		defer r.finish()
+		var data []byte
+		if data, err = json.Marshal(env); err != nil {
+			return
+		}
+		err = r.conn.queue(urgent(TextFrame(data)))
+	})
+	return err
+}
+
+// finish releases the request's context and bookkeeping.
+func (r *Request) finish() {
+	r.cancel()
+	if r.id == "" {
+		return
+	}
+	r.conn.rpc.mu.Lock()
+	delete(r.conn.rpc.inflight, r.id)
+	r.conn.rpc.mu.Unlock()
+}
+
+// HandleAsync registers fn as the route for envelopes of type typ, like
+// [Handle], but fn answers through the *Request it is given rather than by
+// returning - later, and from any goroutine:
+//
+//	connection.HandleAsync(router, "quote", func(req *connection.Request, q QuoteReq) {
+//	    go func() {
+//	        price, err := pricer.Quote(req.Context(), q.Symbol)
+//	        if err != nil {
+//	            req.Fail(err)
+//	            return
+//	        }
+//	        req.Reply(Quote{Price: price})
+//	    }()
+//	})
+//
+// fn runs on the connection's read goroutine, so it must hand slow work off
+// rather than block. It panics if typ is empty, reserved, or already
+// registered.
+func HandleAsync[Req any](rt *Router, typ string, fn func(req *Request, data Req)) {
+	rt.add(typ, func(conn *Connection, env Envelope) (any, error) {
+		var data Req
+		if err := decodeData(env.Data, &data); err != nil {
+			return nil, err
+		}
+		req, err := conn.startRequest(env)
+		if err != nil {
+			return nil, err
+		}
+		fn(req, data)
+		return nil, nil
+	})
+}
+
+// startRequest registers an inbound request so a cancel frame can find it.
+func (c *Connection) startRequest(env Envelope) (*Request, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	req := &Request{conn: c, typ: env.Type, id: env.ID, ctx: ctx, cancel: cancel}
+	if env.ID == "" {
+		return req, nil
+	}
+
+	c.rpc.mu.Lock()
+	defer c.rpc.mu.Unlock()
+	if _, exists := c.rpc.inflight[env.ID]; exists {
+		cancel()
+		return nil, &Error{Code: CodeDuplicateID, Message: "request " + strconv.Quote(env.ID) + " is still in flight"}
+	}
+	if c.rpc.inflight == nil {
+		c.rpc.inflight = make(map[string]context.CancelFunc)
+	}
+	c.rpc.inflight[env.ID] = cancel
+	return req, nil
+}
+
+// cancelRequest handles a cancel frame from the client. It cancels the
+// request's context only; the route still owns answering it, and an answer to
+// a canceled request is harmless.
+func (c *Connection) cancelRequest(id string) {
+	c.rpc.mu.Lock()
+	cancel, ok := c.rpc.inflight[id]
+	c.rpc.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// Call sends a request of type typ carrying params to the client, waits for
+// the client's answer, and decodes its data into result unless result is nil.
+// The client answers with an envelope carrying the same id, as the server does
+// for client requests; an error frame comes back from Call as an *Error.
+//
+// If ctx ends first, Call sends the client a cancel frame and returns ctx's
+// error; if the connection closes first, it returns ErrConnectionClosed.
+// Replies only reach Call when the connection's handler is a Router.
+func (c *Connection) Call(ctx context.Context, typ string, params, result any) error {
+	id := serverIDPrefix + strconv.FormatUint(c.rpc.nextID.Add(1), 10)
+	data, err := json.Marshal(outEnvelope{Type: typ, ID: id, Data: params})
+	if err != nil {
+		return err
+	}
+
+	// Buffered so the read pump never waits on a caller that has given up.
+	reply := make(chan Envelope, 1)
+	c.rpc.mu.Lock()
+	if c.rpc.calls == nil {
+		c.rpc.calls = make(map[string]chan Envelope)
+	}
+	c.rpc.calls[id] = reply
+	c.rpc.mu.Unlock()
+	defer func() {
+		c.rpc.mu.Lock()
+		delete(c.rpc.calls, id)
+		c.rpc.mu.Unlock()
+	}()
+
+	if err := c.queue(urgent(TextFrame(data))); err != nil {
+		return err
+	}
+
+	select {
+	case env := <-reply:
+		if env.Type == errorType {
+			if env.Error == nil {
+				return &Error{Code: CodeHandlerError, Message: "error frame without an error"}
+			}
+			return env.Error
+		}
+		if result == nil || len(env.Data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(env.Data, result)
+
+	case <-ctx.Done():
+		if cancel, err := json.Marshal(outEnvelope{Type: cancelType, ID: id}); err == nil {
+			c.queue(urgent(TextFrame(cancel)))
+		}
+		return ctx.Err()
+
+	case <-c.done:
+		return ErrConnectionClosed
+	}
+}
+
+// resolveCall delivers env to the Call waiting on its id, if there still is
+// one.
+func (c *Connection) resolveCall(env Envelope) {
+	c.rpc.mu.Lock()
+	reply, ok := c.rpc.calls[env.ID]
+	delete(c.rpc.calls, env.ID)
+	c.rpc.mu.Unlock()
+	if ok {
+		reply <- env
+	}
+}
@@ -0,0 +1,224 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialRouter serves rt from a fresh registry and dials it.
+func dialRouter(t *testing.T, rt *Router) *websocket.Conn {
+	t.Helper()
+	r := NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	srv := httptest.NewServer(r.RegisterHandler(rt))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func writeEnvelope(t *testing.T, ws *websocket.Conn, env string) {
+	t.Helper()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(env)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func readEnvelope(t *testing.T, ws *websocket.Conn) Envelope {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var env Envelope
+	if err := ws.ReadJSON(&env); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return env
+}
+
+func TestSyncRouteEchoesRequestID(t *testing.T) {
+	rt := NewRouter()
+	Handle(rt, "double", func(_ *Connection, n int) (int, error) { return 2 * n, nil })
+	ws := dialRouter(t, rt)
+
+	writeEnvelope(t, ws, `{"type":"double","id":"a","data":21}`)
+	writeEnvelope(t, ws, `{"type":"nope","id":"b"}`)
+
+	if env := readEnvelope(t, ws); env.ID != "a" || string(env.Data) != "42" {
+		t.Errorf("reply: got id %q data %s, want id a data 42", env.ID, env.Data)
+	}
+	if env := readEnvelope(t, ws); env.ID != "b" || env.Type != errorType {
+		t.Errorf("error frame: got type %q id %q, want an error for b", env.Type, env.ID)
+	}
+}
+
+// Async answers go out whenever the route gets to them, from whichever
+// goroutine, and each carries its own request's id.
+func TestAsyncRepliesOutOfOrder(t *testing.T) {
+	pending := make(chan *Request, 2)
+	rt := NewRouter()
+	HandleAsync(rt, "slow", func(req *Request, _ struct{}) { pending <- req })
+	ws := dialRouter(t, rt)
+
+	writeEnvelope(t, ws, `{"type":"slow","id":"first"}`)
+	writeEnvelope(t, ws, `{"type":"slow","id":"second"}`)
+	first, second := <-pending, <-pending
+
+	go second.Reply("two")
+	if env := readEnvelope(t, ws); env.ID != "second" || string(env.Data) != `"two"` {
+		t.Fatalf("got id %q data %s, want the second request's reply", env.ID, env.Data)
+	}
+	go first.Fail(&Error{Code: "nope", Message: "no"})
+	if env := readEnvelope(t, ws); env.ID != "first" || env.Error == nil || env.Error.Code != "nope" {
+		t.Fatalf("got %+v, want the first request's error", env)
+	}
+
+	if err := first.Reply("again"); !errors.Is(err, ErrAlreadyAnswered) {
+		t.Errorf("answering twice: got %v, want ErrAlreadyAnswered", err)
+	}
+}
+
+func TestClientCancelCancelsRequestContext(t *testing.T) {
+	pending := make(chan *Request, 1)
+	rt := NewRouter()
+	HandleAsync(rt, "slow", func(req *Request, _ struct{}) { pending <- req })
+	ws := dialRouter(t, rt)
+
+	writeEnvelope(t, ws, `{"type":"slow","id":"x"}`)
+	req := <-pending
+	writeEnvelope(t, ws, `{"type":"cancel","id":"x"}`)
+
+	select {
+	case <-req.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("a cancel frame did not cancel the request's context")
+	}
+}
+
+// serverConn returns the server side of the connection behind ws.
+func serverConn(t *testing.T, ws *websocket.Conn, conns <-chan *Connection) *Connection {
+	t.Helper()
+	writeEnvelope(t, ws, `{"type":"hello"}`)
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("hello route never ran")
+		return nil
+	}
+}
+
+func helloRouter() (*Router, chan *Connection) {
+	conns := make(chan *Connection, 1)
+	rt := NewRouter()
+	Handle(rt, "hello", func(c *Connection, _ struct{}) (any, error) {
+		conns <- c
+		return nil, nil
+	})
+	return rt, conns
+}
+
+func TestServerCallsClient(t *testing.T) {
+	rt, conns := helloRouter()
+	ws := dialRouter(t, rt)
+	conn := serverConn(t, ws, conns)
+
+	// Play the client: answer the call with its own id.
+	go func() {
+		var env Envelope
+		if err := ws.ReadJSON(&env); err != nil {
+			return
+		}
+		ws.WriteJSON(outEnvelope{Type: env.Type, ID: env.ID, Data: "pong"})
+	}()
+
+	var got string
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := conn.Call(ctx, "ping", nil, &got); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if got != "pong" {
+		t.Errorf("result: got %q, want pong", got)
+	}
+}
+
+// A call the client never answers ends at its deadline, tells the client to
+// stop, and leaves nothing behind in the connection's bookkeeping.
+func TestCallTimeoutSendsCancelAndCleansUp(t *testing.T) {
+	rt, conns := helloRouter()
+	ws := dialRouter(t, rt)
+	conn := serverConn(t, ws, conns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.Call(ctx, "ping", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call: got %v, want DeadlineExceeded", err)
+	}
+
+	call := readEnvelope(t, ws)
+	if cancelFrame := readEnvelope(t, ws); cancelFrame.Type != cancelType || cancelFrame.ID != call.ID {
+		t.Errorf("got %+v, want a cancel frame for %q", cancelFrame, call.ID)
+	}
+
+	conn.rpc.mu.Lock()
+	defer conn.rpc.mu.Unlock()
+	if n := len(conn.rpc.calls); n != 0 {
+		t.Errorf("%d call(s) left pending after the timeout", n)
+	}
+}
+
+func TestCallFailsWhenConnectionCloses(t *testing.T) {
+	conn := NewConnection(nil, nil)
+	result := make(chan error, 1)
+	go func() { result <- conn.Call(context.Background(), "ping", nil, nil) }()
+
+	time.Sleep(20 * time.Millisecond)
+	conn.CloseConnection()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("got %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Call outlived its connection")
+	}
+
+	conn.rpc.mu.Lock()
+	defer conn.rpc.mu.Unlock()
+	if n := len(conn.rpc.calls); n != 0 {
+		t.Errorf("%d call(s) left pending after close", n)
+	}
+}
+
+// A client's error frame comes back from Call as an *Error.
+func TestCallReturnsClientError(t *testing.T) {
+	conn := NewConnection(nil, nil)
+	rt := NewRouter()
+	result := make(chan error, 1)
+	go func() { result <- conn.Call(context.Background(), "ping", nil, nil) }()
+
+	// The call frame is on the queue; answer it through the router as the
+	// read pump would.
+	var call Envelope
+	json.Unmarshal(next(t, conn).Data, &call)
+	rt.HandleMessage(conn, []byte(`{"type":"error","id":"`+call.ID+`","error":{"code":"busy","message":"later"}}`))
+
+	var clientErr *Error
+	if err := <-result; !errors.As(err, &clientErr) || clientErr.Code != "busy" {
+		t.Fatalf("got %v, want the client's busy error", err)
+	}
+}
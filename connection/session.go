@@ -0,0 +1,347 @@
+package connection
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session resumption.
+//
+// With WithSessions, every connection belongs to a session, and the first
+// frame it receives names it:
+//
+//	<- {"type": "session", "data": {"token": "...", "id": "<connection ID>", "resumed": false}}
+//
+// Every data frame written to the connection after that counts as one step in
+// the session's sequence, starting at 1 and carrying on across resumes;
+// session and resync frames do not count. When the connection drops, the
+// session is parked for the grace period: it keeps its groups, and it keeps
+// recording what is broadcast to them. A client that reconnects in time with
+//
+//	/ws?resume=<token>&last_seq=<data frames received in the session so far>
+//
+// gets the same connection ID and groups back, and "resumed": true, followed by
+// every frame after last_seq. If the session has already expired, the welcome
+// says "resumed": false and the client starts over; if it is still there but
+// last_seq is further back than the replay buffer reaches, the groups are
+// restored and the welcome is followed by
+//
+//	<- {"type": "resync"}
+//
+// telling the client to fetch full state instead.
+
+// Envelope types of session control frames.
+const (
+	sessionType = "session"
+	resyncType  = "resync"
+)
+
+// Query parameters a reconnecting client resumes with.
+const (
+	resumeParam  = "resume"
+	lastSeqParam = "last_seq"
+)
+
+// sessionInfo is the data of a session frame.
+type sessionInfo struct {
+	Token   string `json:"token"`
+	ID      string `json:"id"`
+	Resumed bool   `json:"resumed"`
+}
+
+// resumeRequest is what a reconnecting client asked for, read off the upgrade
+// request.
+type resumeRequest struct {
+	token   string
+	lastSeq uint64
+}
+
+func parseResume(req *http.Request) *resumeRequest {
+	q := req.URL.Query()
+	token := q.Get(resumeParam)
+	if token == "" {
+		return nil
+	}
+	lastSeq, _ := strconv.ParseUint(q.Get(lastSeqParam), 10, 64)
+	return &resumeRequest{token: token, lastSeq: lastSeq}
+}
+
+// session outlives the connections that carry it. While one is attached, the
+// write pump records each frame it writes; while none is, broadcasts to the
+// session's groups are recorded in its place. Either way buf holds the last
+// frames of the sequence, up to the replay limit.
+type session struct {
+	token  string
+	connID string
+	userID string // the principal's, if the connection was authenticated
+
+	mu       sync.Mutex
+	conn     *Connection              // nil while parked
+	groups   map[string]bool          // while parked; the connection's own while attached
+	presence map[string]presenceState // while parked, likewise
+	seq      uint64                   // sequence number of the last frame recorded
+	buf      []Frame                  // the frames ending at seq, oldest first
+	limit    int
+	grace    time.Duration
+	gen      uint64 // bumped on every park, so a stale expiry timer is a no-op
+	timer    *time.Timer
+
+	// reliable is the reliable delivery state of every connection that
+	// carries the session, so its seqs carry on across resumes and what is
+	// unacked when one drops goes on to the next.
+	reliable *reliableState
+}
+
+func newSession(conn *Connection) *session {
+	s := &session{
+		token:    newToken(),
+		connID:   conn.ID,
+		limit:    conn.cfg.sessionReplay,
+		grace:    conn.cfg.sessionGrace,
+		reliable: conn.reliable,
+	}
+	if conn.principal != nil {
+		s.userID = conn.principal.UserID
+	}
+	return s
+}
+
+// record appends a frame c wrote to the sequence, unless c no longer owns the
+// session.
+func (s *session) record(c *Connection, f Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == c {
+		s.append(f)
+	}
+}
+
+// append adds f as the next frame of the sequence. Callers hold mu.
+func (s *session) append(f Frame) {
+	s.seq++
+	s.buf = append(s.buf, f)
+	if len(s.buf) > s.limit {
+		s.buf = s.buf[len(s.buf)-s.limit:]
+	}
+}
+
+// since returns the frames after lastSeq, or ok false if they are no longer
+// all buffered. Callers hold mu.
+func (s *session) since(lastSeq uint64) (frames []Frame, ok bool) {
+	first := s.seq - uint64(len(s.buf)) + 1
+	if lastSeq > s.seq || lastSeq+1 < first {
+		return nil, false
+	}
+	return s.buf[lastSeq+1-first:], true
+}
+
+// attachSession gives a newly registered connection its session: the one it
+// asked to resume if that is still parked here, otherwise a new one. Restoring
+// groups and queueing the replay happen under r.mu, the same lock Broadcast
+// snapshots its targets under, so each broadcast reaches the client exactly
+// once: recorded and replayed, or live.
+func (r *Registry) attachSession(conn *Connection) {
+	var s *session
+	if conn.resume != nil {
+		s = r.sessions[conn.resume.token]
+	}
+	if s != nil && s.userID != "" && (conn.principal == nil || conn.principal.UserID != s.userID) {
+		// A leaked token does not let someone else take the session over.
+		conn.logger().Warn("Resume refused: session belongs to another user", slog.String("session_conn_id", s.connID))
+		s = nil
+	}
+	if s == nil {
+		s = newSession(conn)
+		r.sessions[s.token] = s
+		s.conn = conn
+		conn.session = s
+		conn.queueHeld(sessionFrame(s, false), nil)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old := s.conn; old != nil {
+		// The client came back before its previous connection was noticed
+		// dead. Take the session over; the old connection is closed, and its
+		// unregister finds the session no longer its own.
+		r.park(s, old)
+		old.noteClose(CloseInfo{Code: CloseSessionTakenOver, Reason: "session resumed on another connection"})
+		go old.CloseConnection()
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(r.parked, s)
+
+	conn.ID = s.connID
+	for groupName := range s.groups {
+		r.addToGroup(groupName, conn)
+	}
+	presence := s.presence
+	s.groups = nil
+	s.presence = nil
+	s.conn = conn
+	conn.session = s
+	conn.reliable = s.reliable
+	defer s.reliable.resumed(conn) // once the replay is queued
+
+	// Presence comes back after the welcome and any replay, as the live
+	// change it is; a key whose leave is still pending sees no change at all.
+	defer func() {
+		for groupName, p := range presence {
+			if conn.groups[groupName] {
+				r.setPresence(groupName, conn, p)
+			}
+		}
+	}()
+
+	conn.queueHeld(sessionFrame(s, true), nil)
+	replay, ok := s.since(conn.resume.lastSeq)
+	if !ok || !conn.out.fits(replay) {
+		// Too far behind to replay, or too much to replay without the queue
+		// overflowing and closing the connection we just restored.
+		conn.queueHeld(controlFrame(resyncType, nil), nil)
+		return
+	}
+	for i, f := range replay {
+		f.seq = conn.resume.lastSeq + uint64(i) + 1 // not recorded again
+		conn.queueHeld(f, nil)
+	}
+}
+
+// park detaches s from conn, which is going away, and keeps it for the grace
+// period. Frames still queued on conn were never written, so they become the
+// next frames of the sequence and are replayed on resume. Callers hold r.mu
+// and s.mu.
+func (r *Registry) park(s *session, conn *Connection) {
+	s.conn = nil
+	s.groups = make(map[string]bool, len(conn.groups))
+	for groupName := range conn.groups {
+		if _, exists := r.groups[groupName]; exists {
+			s.groups[groupName] = true
+		}
+	}
+	s.presence = make(map[string]presenceState, len(conn.presence))
+	for groupName, p := range conn.presence {
+		if s.groups[groupName] {
+			s.presence[groupName] = p
+		}
+	}
+
+	// A frame the write pump takes after s.conn changed above is written
+	// but not recorded; the window is the length of one write.
+	for _, f := range conn.out.drain() {
+		if !f.control {
+			s.append(f)
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case data := <-conn.Send:
+			s.append(TextFrame(data))
+		default:
+			drained = true
+		}
+	}
+
+	s.gen++
+	gen := s.gen
+	s.timer = time.AfterFunc(s.grace, func() { r.expireSession(s, gen) })
+	r.parked[s] = true
+}
+
+// detachSession parks conn's session when conn is unregistered, unless
+// another connection has already taken it over. Callers hold r.mu.
+func (r *Registry) detachSession(conn *Connection) {
+	s := conn.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == conn {
+		r.park(s, conn)
+	}
+}
+
+// expireSession forgets s once its grace period is over, unless it has been
+// resumed - or parked again - since the timer was set.
+func (r *Registry) expireSession(s *session, gen uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil && s.gen == gen {
+		r.cfg.log().Debug("Session expired", slog.String(LogConnID, s.connID))
+		delete(r.sessions, s.token)
+		delete(r.parked, s)
+		s.reliable.fail(s.connID, ErrConnectionClosed)
+	}
+}
+
+// recordParked records f for every parked session that would have received a
+// broadcast to groupName. Callers hold r.mu.
+func (r *Registry) recordParked(f Frame, groupName string) {
+	for s := range r.parked {
+		s.mu.Lock()
+		if groupName == "" || s.groups[groupName] {
+			s.append(f)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// recordParkedConn records f for the parked session of connID, if there is
+// one, and reports whether there was. Callers hold r.mu.
+func (r *Registry) recordParkedConn(f Frame, connID string) bool {
+	for s := range r.parked {
+		if s.connID == connID {
+			s.mu.Lock()
+			s.append(f)
+			s.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// forgetParkedGroup drops a deleted group from every parked session. Callers
+// hold r.mu.
+func (r *Registry) forgetParkedGroup(groupName string) {
+	for s := range r.parked {
+		s.mu.Lock()
+		delete(s.groups, groupName)
+		delete(s.presence, groupName)
+		s.mu.Unlock()
+	}
+}
+
+// newToken returns a random token, unguessable enough to stand for a
+// credential.
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("connection: reading random token: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sessionFrame(s *session, resumed bool) Frame {
+	return controlFrame(sessionType, sessionInfo{Token: s.token, ID: s.connID, Resumed: resumed})
+}
+
+// controlFrame builds a session control frame, which is not counted in the
+// sequence.
+func controlFrame(typ string, data any) Frame {
+	// Cannot fail: the data is always one of this file's plain structs.
+	encoded, _ := json.Marshal(outEnvelope{Type: typ, Data: data})
+	f := urgent(TextFrame(encoded))
+	f.control = true
+	return f
+}
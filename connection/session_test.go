@@ -0,0 +1,268 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gorilla/websocket"
+)
+
+// sessionServer runs a registry with sessions on and a capturing handler.
+type sessionServer struct {
+	r     *Registry
+	url   string
+	conns chan *Connection
+}
+
+func newSessionServer(t *testing.T, opts ...Option) *sessionServer {
+	t.Helper()
+	r := NewRegistry(opts...)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	h := &captureHandler{conns: make(chan *Connection, 1)}
+	srv := httptest.NewServer(r.RegisterHandler(h))
+	t.Cleanup(srv.Close)
+	return &sessionServer{r: r, url: "ws" + strings.TrimPrefix(srv.URL, "http"), conns: h.conns}
+}
+
+// dial connects, resuming token from lastSeq if token is set, and returns the
+// socket and the session frame it was greeted with.
+func (s *sessionServer) dial(t *testing.T, token string, lastSeq int) (*websocket.Conn, sessionInfo) {
+	t.Helper()
+	u := s.url
+	if token != "" {
+		u += "?" + url.Values{resumeParam: {token}, lastSeqParam: {strconv.Itoa(lastSeq)}}.Encode()
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	var env Envelope
+	var info sessionInfo
+	if err := ws.ReadJSON(&env); err != nil || env.Type != sessionType {
+		t.Fatalf("first frame: got %+v (%v), want a session frame", env, err)
+	}
+	json.Unmarshal(env.Data, &info)
+	return ws, info
+}
+
+// join makes the connection behind ws a member of group.
+func (s *sessionServer) join(t *testing.T, ws *websocket.Conn, group string) {
+	t.Helper()
+	ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	select {
+	case conn := <-s.conns:
+		s.r.AddToGroup(group, conn)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler never saw the connection")
+	}
+}
+
+// waitParked blocks until n sessions are parked.
+func (s *sessionServer) waitParked(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.r.mu.Lock()
+		parked := len(s.r.parked)
+		s.r.mu.Unlock()
+		if parked == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d session(s) parked, want %d", parked, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readText(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(data)
+}
+
+func TestSessionResumeRestoresGroupsAndReplays(t *testing.T) {
+	s := newSessionServer(t, WithSessions(time.Minute, 16))
+
+	ws, first := s.dial(t, "", 0)
+	if first.Resumed || first.Token == "" {
+		t.Fatalf("new connection: got %+v, want a fresh session", first)
+	}
+	s.join(t, ws, "room")
+
+	s.r.Broadcast(&message.ByteMessage{Data: []byte("one")}, "room")
+	if got := readText(t, ws); got != "one" {
+		t.Fatalf("got %q, want one", got)
+	}
+
+	ws.Close()
+	s.waitParked(t, 1)
+	s.r.Broadcast(&message.ByteMessage{Data: []byte("two")}, "room")
+	s.r.Broadcast(&message.ByteMessage{Data: []byte("three")}, "room")
+
+	ws, resumed := s.dial(t, first.Token, 1)
+	if !resumed.Resumed || resumed.ID != first.ID {
+		t.Fatalf("resume: got %+v, want session %s resumed", resumed, first.ID)
+	}
+	for _, want := range []string{"two", "three"} {
+		if got := readText(t, ws); got != want {
+			t.Fatalf("replay: got %q, want %q", got, want)
+		}
+	}
+
+	// The group membership came back too, so live traffic follows the replay.
+	s.r.Broadcast(&message.ByteMessage{Data: []byte("four")}, "room")
+	if got := readText(t, ws); got != "four" {
+		t.Fatalf("live after resume: got %q, want four", got)
+	}
+}
+
+func TestSessionResumeTooFarBehindAsksForResync(t *testing.T) {
+	s := newSessionServer(t, WithSessions(time.Minute, 2))
+
+	ws, first := s.dial(t, "", 0)
+	s.join(t, ws, "room")
+	ws.Close()
+	s.waitParked(t, 1)
+
+	for i := 0; i < 3; i++ {
+		s.r.Broadcast(message.NewJSONMessage(i), "room")
+	}
+
+	ws, resumed := s.dial(t, first.Token, 0)
+	if !resumed.Resumed {
+		t.Fatalf("resume: got %+v, want resumed", resumed)
+	}
+	var env Envelope
+	if err := json.Unmarshal([]byte(readText(t, ws)), &env); err != nil || env.Type != resyncType {
+		t.Fatalf("got %+v, want a resync frame", env)
+	}
+
+	s.r.Broadcast(&message.ByteMessage{Data: []byte("live")}, "room")
+	if got := readText(t, ws); got != "live" {
+		t.Fatalf("groups not restored: got %q, want live", got)
+	}
+}
+
+func TestExpiredSessionStartsOver(t *testing.T) {
+	s := newSessionServer(t, WithSessions(20*time.Millisecond, 16))
+
+	ws, first := s.dial(t, "", 0)
+	ws.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		s.r.mu.Lock()
+		live := len(s.r.sessions)
+		s.r.mu.Unlock()
+		if live == 0 {
+			break // parked, then expired
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the session outlived its grace period")
+		}
+	}
+
+	_, again := s.dial(t, first.Token, 0)
+	if again.Resumed || again.Token == first.Token || again.ID == first.ID {
+		t.Fatalf("got %+v, want a brand new session", again)
+	}
+}
+
+// Frames still queued when a connection drops were never written, so they
+// belong to the replay rather than to the void.
+func TestParkingKeepsUnwrittenFrames(t *testing.T) {
+	r := NewRegistry()
+	conn := NewConnection(nil, nil, WithSessions(time.Minute, 16))
+	r.registerConnection(conn)
+	next(t, conn) // the session frame
+
+	conn.queue(TextFrame([]byte("unwritten")))
+	r.unregisterConnection(conn)
+
+	s := conn.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil || s.seq != 1 || string(s.buf[0].Data) != "unwritten" {
+		t.Fatalf("parked session: conn %v seq %d buf %v; want the queued frame recorded as seq 1", s.conn, s.seq, s.buf)
+	}
+}
+
+// A reliable message unacked when the connection drops waits with the session,
+// comes back in the replay with its seq, and is acked on the new connection;
+// the session's seqs carry on from there.
+func TestSessionResumeCarriesReliableDelivery(t *testing.T) {
+	s := newSessionServer(t, WithSessions(time.Minute, 16))
+	deliver := func(ws *websocket.Conn) Envelope {
+		t.Helper()
+		var env Envelope
+		if err := json.Unmarshal([]byte(readText(t, ws)), &env); err != nil || env.Type != deliverType {
+			t.Fatalf("got %+v, want a deliver frame", env)
+		}
+		return env
+	}
+
+	ws, first := s.dial(t, "", 0)
+	s.join(t, ws, "room")
+	conn, _ := s.r.Connection(first.ID)
+	one, _ := s.r.BroadcastReliable(message.NewJSONMessage("one"), "room")
+	conn.ack(deliver(ws).Seq)
+	waitDelivery(t, one)
+
+	two, _ := s.r.BroadcastReliable(message.NewJSONMessage("two"), "room")
+	if env := deliver(ws); env.Seq != 2 {
+		t.Fatalf("second deliver: seq %d, want 2", env.Seq)
+	}
+	ws.Close()
+	s.waitParked(t, 1)
+	select {
+	case <-two.Done():
+		t.Fatalf("delivery settled while the session was parked: %+v", two.Report())
+	default:
+	}
+
+	ws, _ = s.dial(t, first.Token, 1)
+	if env := deliver(ws); env.Seq != 2 || string(env.Data) != `"two"` {
+		t.Fatalf("replay: got %+v, want two with seq 2", env)
+	}
+	conn, _ = s.r.Connection(first.ID)
+	conn.ack(2)
+	if report := waitDelivery(t, two); len(report.Acked) != 1 || report.Acked[0] != first.ID {
+		t.Fatalf("got %+v, want two acked by %s", report, first.ID)
+	}
+
+	three, _ := s.r.BroadcastReliable(message.NewJSONMessage("three"), "room")
+	if env := deliver(ws); env.Seq != 3 {
+		t.Fatalf("deliver after resume: seq %d, want 3", env.Seq)
+	}
+	conn.ack(3)
+	waitDelivery(t, three)
+}
+
+func TestExpiredSessionFailsItsReliableDelivery(t *testing.T) {
+	s := newSessionServer(t, WithSessions(20*time.Millisecond, 16))
+
+	ws, first := s.dial(t, "", 0)
+	s.join(t, ws, "room")
+	d, _ := s.r.BroadcastReliable(message.NewJSONMessage("one"), "room")
+	readText(t, ws)
+	ws.Close()
+
+	if report := waitDelivery(t, d); report.Failed[first.ID] != ErrConnectionClosed {
+		t.Fatalf("got %+v, want %s failed with ErrConnectionClosed", report, first.ID)
+	}
+}
@@ -0,0 +1,266 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMessageDropped is returned for a message a DropNewest policy dropped
+// because the connection's outbound buffer was full. The connection stays
+// open.
+var ErrMessageDropped = errors.New("connection: outbound buffer full; message dropped")
+
+// Actions a slow-consumer policy takes, as counted by SlowConsumerStats and
+// passed to Metrics.SlowConsumer.
+const (
+	SlowConsumerClosed        = "closed"         // a connection was closed
+	SlowConsumerDroppedNewest = "dropped_newest" // a message that did not fit was dropped
+	SlowConsumerDroppedOldest = "dropped_oldest" // a queued message was dropped to make room
+	SlowConsumerConflated     = "conflated"      // a queued message was discarded by conflation
+	SlowConsumerBlocked       = "blocked"        // a sender waited for room
+	SlowConsumerTimedOut      = "timed_out"      // a sender gave up waiting, and closed the connection
+)
+
+type policyKind int
+
+const (
+	policyClose policyKind = iota
+	policyDropNewest
+	policyDropOldest
+	policyBlock
+	policyConflate
+)
+
+// SlowConsumerPolicy says what happens to a message for a connection whose
+// outbound buffer is full - a peer reading slower than it is sent to. Set one
+// for a Registry or handler with WithSlowConsumerPolicy, and for one group's
+// broadcasts with Registry.SetGroupSlowConsumerPolicy. The zero value is
+// CloseSlowConsumer.
+type SlowConsumerPolicy struct {
+	kind    policyKind
+	timeout time.Duration
+}
+
+var (
+	// CloseSlowConsumer closes the connection, with ClosePolicyViolation. It
+	// is the default, and right wherever a message carries state: a client
+	// that missed one is stale, and is better off reconnecting and
+	// refetching than carrying on.
+	CloseSlowConsumer = SlowConsumerPolicy{kind: policyClose}
+
+	// DropNewest drops the message that did not fit. The sender gets
+	// ErrMessageDropped; Broadcast carries on with the other recipients.
+	DropNewest = SlowConsumerPolicy{kind: policyDropNewest}
+
+	// DropOldest drops the oldest queued message to make room, for streams
+	// where recent messages matter more than old ones.
+	DropOldest = SlowConsumerPolicy{kind: policyDropOldest}
+
+	// Conflate discards everything queued and queues the message alone, for
+	// feeds where each message supersedes the ones before it. The library's
+	// own control frames are kept.
+	Conflate = SlowConsumerPolicy{kind: policyConflate}
+)
+
+// BlockFor makes the sender wait up to timeout for room, and closes the
+// connection as CloseSlowConsumer does if none comes. A broadcast waits for
+// each slow recipient in turn, so keep timeout short. Frames queued with the
+// Registry's lock held - presence events and history and session replays -
+// cannot wait, and close the connection at once.
+func BlockFor(timeout time.Duration) SlowConsumerPolicy {
+	return SlowConsumerPolicy{kind: policyBlock, timeout: timeout}
+}
+
+// String returns the policy's name: "close", "drop_newest", "drop_oldest",
+// "conflate", or "block(timeout)".
+func (p SlowConsumerPolicy) String() string {
+	switch p.kind {
+	case policyDropNewest:
+		return "drop_newest"
+	case policyDropOldest:
+		return "drop_oldest"
+	case policyConflate:
+		return "conflate"
+	case policyBlock:
+		return fmt.Sprintf("block(%v)", p.timeout)
+	}
+	return "close"
+}
+
+func (p SlowConsumerPolicy) validate() error {
+	if p.kind == policyBlock && p.timeout <= 0 {
+		return fmt.Errorf("slow-consumer block timeout must be positive, got %v", p.timeout)
+	}
+	return nil
+}
+
+// SlowConsumerStats counts what slow-consumer policies have done to a
+// Registry's connections, by action; see the SlowConsumer* constants.
+type SlowConsumerStats struct {
+	Closed        uint64
+	DroppedNewest uint64
+	DroppedOldest uint64
+	Conflated     uint64
+	Blocked       uint64
+	TimedOut      uint64 // each also counted in Closed
+}
+
+// slowConsumerCounters is shared by a Registry and every connection it
+// accepts; see config.slowCounters.
+type slowConsumerCounters struct {
+	closed, droppedNewest, droppedOldest, conflated, blocked, timedOut atomic.Uint64
+}
+
+// SlowConsumerStats returns the counts of what slow-consumer policies have
+// done to r's connections since r was created.
+func (r *Registry) SlowConsumerStats() SlowConsumerStats {
+	c := r.cfg.slowCounters
+	return SlowConsumerStats{
+		Closed:        c.closed.Load(),
+		DroppedNewest: c.droppedNewest.Load(),
+		DroppedOldest: c.droppedOldest.Load(),
+		Conflated:     c.conflated.Load(),
+		Blocked:       c.blocked.Load(),
+		TimedOut:      c.timedOut.Load(),
+	}
+}
+
+// SetGroupSlowConsumerPolicy sets the policy for broadcasts and presence
+// events to groupName, overriding its members' own. The override is
+// forgotten when the group is deleted.
+func (r *Registry) SetGroupSlowConsumerPolicy(groupName string, p SlowConsumerPolicy) {
+	if err := p.validate(); err != nil {
+		panic("connection: " + err.Error())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slowPolicies[groupName] = p
+}
+
+// count records n of action.
+func (c *Connection) count(action string, n int) {
+	counters := c.cfg.slowCounters
+	var counter *atomic.Uint64
+	switch action {
+	case SlowConsumerClosed:
+		counter = &counters.closed
+	case SlowConsumerDroppedNewest:
+		counter = &counters.droppedNewest
+	case SlowConsumerDroppedOldest:
+		counter = &counters.droppedOldest
+	case SlowConsumerConflated:
+		counter = &counters.conflated
+	case SlowConsumerBlocked:
+		counter = &counters.blocked
+	case SlowConsumerTimedOut:
+		counter = &counters.timedOut
+	}
+	counter.Add(uint64(n))
+	c.cfg.metrics.SlowConsumer(action, n)
+}
+
+// offer puts f on c's outbound queue, applying p, or c's own policy if it is
+// nil, if the queue is full. Callers holding r.mu pass wait false: a blocking
+// policy must not stall the whole Registry, so for them it closes the
+// connection at once.
+func (c *Connection) offer(f Frame, p *SlowConsumerPolicy, wait bool) error {
+	select {
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+	if c.tryQueue(f) {
+		return nil
+	}
+	if p == nil {
+		p = c.cfg.lanes[laneOf(f.priority)].policy
+	}
+	if p == nil {
+		p = &c.cfg.slowConsumer
+	}
+
+	switch {
+	case !f.droppable():
+		// Losing one of the library's own frames would break the protocol
+		// it is part of; only closing is safe.
+
+	case p.kind == policyDropNewest:
+		c.count(SlowConsumerDroppedNewest, 1)
+		return ErrMessageDropped
+
+	case p.kind == policyDropOldest, p.kind == policyConflate:
+		conflate := p.kind == policyConflate
+		dropped, ok := c.out.pushDropping(f, conflate)
+		if conflate {
+			c.count(SlowConsumerConflated, dropped)
+		} else {
+			c.count(SlowConsumerDroppedOldest, dropped)
+		}
+		if ok {
+			c.cfg.metrics.QueueDepth(c.out.len())
+			return nil
+		}
+
+	case p.kind == policyBlock && wait:
+		c.count(SlowConsumerBlocked, 1)
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		for !c.tryQueue(f) {
+			select {
+			case <-c.out.room:
+			case <-c.done:
+				return ErrConnectionClosed
+			case <-timer.C:
+				c.count(SlowConsumerTimedOut, 1)
+				return c.evict()
+			}
+		}
+		signal(c.out.room) // for the next sender waiting, if there is room
+		return nil
+	}
+	return c.evict()
+}
+
+// queueHeld is queue for callers holding r.mu, applying p, or c's own policy
+// if it is nil, without waiting; see offer.
+func (c *Connection) queueHeld(f Frame, p *SlowConsumerPolicy) error {
+	return c.offer(f, p, false)
+}
+
+// droppable reports whether a slow-consumer policy may drop f: a data frame,
+// not a session control frame or a codec switch.
+func (f Frame) droppable() bool {
+	return !f.control && f.switchTo == nil
+}
+
+// slowPolicy returns groupName's policy, or nil if it has none and each
+// member's own applies. Callers hold r.mu.
+func (r *Registry) slowPolicy(groupName string) *SlowConsumerPolicy {
+	if p, ok := r.slowPolicies[groupName]; ok {
+		return &p
+	}
+	return nil
+}
+
+// tryQueue puts f on c's outbound queue if there is room, or if it replaces
+// a queued frame with its conflation key.
+func (c *Connection) tryQueue(f Frame) bool {
+	if !c.out.push(f) {
+		return false
+	}
+	c.cfg.metrics.QueueDepth(c.out.len())
+	return true
+}
+
+// evict closes c for not draining - off the caller's goroutine, since
+// CloseConnection waits for the write pump's close frame and whoever is
+// sending must not pay that latency per dead peer.
+func (c *Connection) evict() error {
+	c.logger().Warn("Connection is not draining; closing it")
+	c.noteClose(slowConsumerClose)
+	c.count(SlowConsumerClosed, 1)
+	go c.CloseConnection()
+	return ErrSlowConsumer
+}
@@ -0,0 +1,232 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server-sent events.
+//
+// SSEHandler serves clients that cannot keep a WebSocket open - behind a
+// proxy that breaks the upgrade, say - as connections of the same Registry. A
+// GET opens a stream, which starts with
+//
+//	<- event: open
+//	   data: {"id": "<connection ID>", "token": "..."}
+//
+// after which each frame the connection is sent arrives as one event: a text
+// frame as its data, a line of data per line of text, and a binary frame
+// base64-encoded in an event named "binary". A comment every ping interval
+// keeps proxies from timing the stream out. The client sends frames by
+// POSTing them, one per request, to the same URL with ?token=<token>; see
+// handlePost. A stream that the server closes ends with
+//
+//	<- event: close
+//	   data: {"code": 1000, "reason": "..."}
+//
+// and a client that gets it should not reconnect.
+//
+// With WithSessions, each data frame's event carries an id, "<session
+// token>.<sequence number>", as does the session frame of a sequence that
+// has not started, with 0. A client that reconnects with the last one in
+// Last-Event-ID, as EventSource does on its own, resumes the session as a
+// WebSocket client does with ?resume and last_seq; see session.go. Those
+// query parameters work here too.
+
+// Names of the events that are not frames.
+const (
+	sseOpen   = "open"
+	sseBinary = "binary"
+	sseClose  = "close"
+)
+
+// SSEHandler returns an http.HandlerFunc that serves connections tracked by r
+// over server-sent events: a GET opens a connection's event stream, and a
+// POST is a frame from a connection's client, dispatched to customHandler.
+// opts override the registry's settings for the connections this handler
+// accepts only; it panics if they are invalid.
+func (r *Registry) SSEHandler(customHandler MessageHandler, opts ...Option) http.HandlerFunc {
+	cfg := r.cfg.resolve(opts...)
+	cfg.metrics = r.cfg.metrics
+	r.addCodecs(cfg)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			r.stream(cfg, customHandler, w, req)
+		case http.MethodPost:
+			r.handlePost(w, req)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// stream serves a connection's event stream for as long as it is open.
+func (r *Registry) stream(cfg config, customHandler MessageHandler, w http.ResponseWriter, req *http.Request) {
+	principal, ok := authenticate(cfg.authenticator, cfg.log(), w, req)
+	if !ok {
+		cfg.metrics.Upgrade(UpgradeUnauthorized)
+		return
+	}
+
+	s := &sseStream{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		tok:       newToken(),
+		addr:      req.RemoteAddr,
+		writeWait: cfg.writeWait,
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // or nginx holds events back
+	if err := s.rc.Flush(); err != nil {
+		cfg.log().Error("Event stream cannot be flushed", slog.String(LogRemoteAddr, req.RemoteAddr), slog.Any(LogError, err))
+		cfg.metrics.Upgrade(UpgradeHandshake)
+		if errors.Is(err, http.ErrNotSupported) {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		}
+		return
+	}
+	cfg.metrics.Upgrade(UpgradeOK)
+
+	client := newConnection(nil, customHandler, cfg)
+	client.transport = s
+	client.principal = principal
+	if cfg.sessionGrace > 0 {
+		client.resume = parseLastEventID(req)
+	}
+	r.serve(client, func() { client.streamPump(s) }, func() { client.watch(req.Context()) })
+	s.rc.SetWriteDeadline(time.Time{}) // the next request on the connection gets its own
+}
+
+// parseLastEventID reads the session an EventSource asks to resume off its
+// Last-Event-ID, or failing that off ?resume and last_seq.
+func parseLastEventID(req *http.Request) *resumeRequest {
+	token, seq, ok := strings.Cut(req.Header.Get("Last-Event-ID"), ".")
+	lastSeq, err := strconv.ParseUint(seq, 10, 64)
+	if !ok || token == "" || err != nil {
+		return parseResume(req)
+	}
+	return &resumeRequest{token: token, lastSeq: lastSeq}
+}
+
+// streamPump is the write pump of a connection on s. The open event goes
+// first, once registration has settled the connection's ID.
+func (c *Connection) streamPump(s *sseStream) {
+	data, _ := json.Marshal(openData{ID: c.ID, Token: s.tok})
+	if err := s.event(sseOpen, "", data); err != nil {
+		c.writeFailed(err)
+		go c.CloseConnection() // the write pump below finishes it
+	}
+	c.writePump()
+}
+
+// watch is the read pump of a connection on a stream, which has nothing to
+// read: it closes c when ctx, the stream request's, ends.
+func (c *Connection) watch(ctx context.Context) {
+	defer func() {
+		c.wg.Done()
+		c.CloseConnection()
+	}()
+	select {
+	case <-ctx.Done():
+		c.noteClose(CloseInfo{Code: websocket.CloseGoingAway, Reason: "event stream closed", ByPeer: true})
+	case <-c.done:
+	}
+}
+
+// eventID returns the id of the event the frame c is writing goes out in: its
+// session's token and the frame's sequence number. It is empty without
+// sessions, and for a control frame once the sequence has started, since a
+// client resuming from a welcome after a replay was queued would skip it.
+func (c *Connection) eventID() string {
+	s := c.session
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	seq := s.seq
+	s.mu.Unlock()
+	switch f := c.writing; {
+	case f != nil && f.seq != 0:
+		seq = f.seq // a replay
+	case f != nil && !f.control:
+		seq++ // writeSocket records it once written
+	case seq > 0:
+		return ""
+	}
+	return s.token + "." + strconv.FormatUint(seq, 10)
+}
+
+// sseStream is the transport of a connection SSEHandler accepted: the
+// response to the GET that opened it.
+type sseStream struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	tok       string
+	addr      string
+	writeWait time.Duration
+}
+
+func (s *sseStream) token() string      { return s.tok }
+func (s *sseStream) remoteAddr() string { return s.addr }
+
+func (s *sseStream) write(c *Connection, f Frame) error {
+	if f.IsBinary() {
+		return s.event(sseBinary, c.eventID(), base64.StdEncoding.AppendEncode(nil, f.Data))
+	}
+	return s.event("", c.eventID(), f.Data)
+}
+
+func (s *sseStream) ping() error {
+	return s.send([]byte(":\n\n"))
+}
+
+func (s *sseStream) close(info CloseInfo) {
+	data, _ := json.Marshal(closeData{Code: info.Code, Reason: info.Reason})
+	s.event(sseClose, "", data)
+}
+
+// event writes one event. Every line break in data - CR, LF or CRLF - ends a
+// data line, and the client joins them with LF.
+func (s *sseStream) event(name, id string, data []byte) error {
+	var b bytes.Buffer
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	if name != "" {
+		b.WriteString("event: " + name + "\n")
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return s.send(b.Bytes())
+}
+
+func (s *sseStream) send(b []byte) error {
+	// Not every ResponseWriter can set one; without it only the server's
+	// own timeouts apply.
+	s.rc.SetWriteDeadline(time.Now().Add(s.writeWait))
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
@@ -0,0 +1,229 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/message"
+)
+
+// sseEvent is one event off a stream.
+type sseEvent struct {
+	id, name, data string
+}
+
+// sseServer runs r and serves its SSEHandler, with h and opts.
+func sseServer(t *testing.T, r *Registry, h MessageHandler, opts ...Option) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+
+	srv := httptest.NewServer(r.SSEHandler(h, opts...))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// openStream GETs url with header and returns its events as they arrive,
+// the open event's data, and a func that drops the stream.
+func openStream(t *testing.T, url string, header http.Header) (events <-chan sseEvent, open openData, drop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+
+	ch := make(chan sseEvent, 64)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+		var ev sseEvent
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "":
+				if data != nil {
+					ev.data = strings.Join(data, "\n")
+					ch <- ev
+				}
+				ev, data = sseEvent{}, nil
+			case "id":
+				ev.id = value
+			case "event":
+				ev.name = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}()
+
+	ev := nextSSE(t, ch)
+	if ev.name != sseOpen {
+		t.Fatalf("first event: got %+v, want open", ev)
+	}
+	json.Unmarshal([]byte(ev.data), &open)
+	return ch, open, cancel
+}
+
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	return sseEvent{}
+}
+
+// post sends body to url's connection token as a frame of contentType.
+func postFrame(t *testing.T, url, token, contentType, body string) int {
+	t.Helper()
+	resp, err := http.Post(url+"?"+tokenParam+"="+token, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStreamIsARegistryMember(t *testing.T) {
+	r := NewRegistry()
+	url := sseServer(t, r, nil)
+	events, open, _ := openStream(t, url, nil)
+
+	conn, ok := r.Connection(open.ID)
+	if !ok || open.Token == "" {
+		t.Fatalf("open event %+v does not name a registered connection", open)
+	}
+	r.AddToGroup("room", conn)
+	r.Broadcast(message.NewJSONMessage("line one\nline two"), "room")
+	if ev := nextSSE(t, events); ev.data != `"line one\nline two"` {
+		t.Errorf("broadcast: got %+v", ev)
+	}
+	conn.queue(TextFrame([]byte("two\r\nlines")))
+	if ev := nextSSE(t, events); ev.data != "two\nlines" {
+		t.Errorf("multi-line text: got %+v", ev)
+	}
+	r.SendTo(open.ID, &message.ByteMessage{Data: []byte{0, 1, 2}})
+	if ev := nextSSE(t, events); ev.name != sseBinary || ev.data != base64.StdEncoding.EncodeToString([]byte{0, 1, 2}) {
+		t.Errorf("binary: got %+v", ev)
+	}
+
+	conn.CloseWithReason(4000, "bye")
+	if ev := nextSSE(t, events); ev.name != sseClose || ev.data != `{"code":4000,"reason":"bye"}` {
+		t.Errorf("close: got %+v", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Error("stream still open after the close event")
+	}
+}
+
+func TestPostsReachTheHandler(t *testing.T) {
+	r := NewRegistry()
+	echo := FrameHandlerFunc(func(_ *Connection, in Frame) (Frame, error) {
+		if string(in.Data) == "fail" {
+			return Frame{}, errors.New("boom")
+		}
+		return in, nil
+	})
+	url := sseServer(t, r, echo)
+	events, open, _ := openStream(t, url, nil)
+
+	if code := postFrame(t, url, open.Token, "text/plain", "ping"); code != http.StatusNoContent {
+		t.Fatalf("POST: status %d", code)
+	}
+	if ev := nextSSE(t, events); ev.name != "" || ev.data != "ping" {
+		t.Errorf("reply: got %+v, want ping", ev)
+	}
+	postFrame(t, url, open.Token, "application/octet-stream", "\x00")
+	if ev := nextSSE(t, events); ev.name != sseBinary || ev.data != "AA==" {
+		t.Errorf("binary reply: got %+v", ev)
+	}
+
+	if code := postFrame(t, url, "nobody", "text/plain", "ping"); code != http.StatusNotFound {
+		t.Errorf("unknown token: status %d, want 404", code)
+	}
+	if code := postFrame(t, url, open.Token, "text/plain", "fail"); code != http.StatusGone {
+		t.Errorf("handler error: status %d, want 410", code)
+	}
+	if ev := nextSSE(t, events); ev.name != sseClose || !strings.Contains(ev.data, "1011") {
+		t.Errorf("handler error: got %+v, want the stream closed with 1011", ev)
+	}
+}
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	r := NewRegistry(WithSessions(time.Minute, 16))
+	url := sseServer(t, r, nil)
+	events, open, drop := openStream(t, url, nil)
+
+	welcome := nextSSE(t, events)
+	var info sessionInfo
+	var env struct{ Data *sessionInfo }
+	env.Data = &info
+	json.Unmarshal([]byte(welcome.data), &env)
+	if info.Token == "" || welcome.id != info.Token+".0" {
+		t.Fatalf("welcome: got %+v, want id %s.0", welcome, info.Token)
+	}
+	conn, _ := r.Connection(open.ID)
+	r.AddToGroup("room", conn)
+	r.Broadcast(message.NewJSONMessage("one"), "room")
+	one := nextSSE(t, events)
+	if one.data != `"one"` || one.id != info.Token+".1" {
+		t.Fatalf("got %+v, want one with id %s.1", one, info.Token)
+	}
+
+	drop()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		parked := len(r.parked)
+		r.mu.Unlock()
+		if parked == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session never parked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.Broadcast(message.NewJSONMessage("two"), "room")
+
+	events, reopened, _ := openStream(t, url, http.Header{"Last-Event-Id": {one.id}})
+	if reopened.ID != open.ID || reopened.Token == open.Token {
+		t.Errorf("resumed open event %+v, want connection %s with a new token", reopened, open.ID)
+	}
+	if ev := nextSSE(t, events); ev.id != "" || !strings.Contains(ev.data, `"resumed":true`) {
+		t.Errorf("welcome: got %+v, want a resumed session frame without an id", ev)
+	}
+	if ev := nextSSE(t, events); ev.data != `"two"` || ev.id != info.Token+".2" {
+		t.Errorf("replay: got %+v, want two with id %s.2", ev, info.Token)
+	}
+	// The replay kept its place in the sequence rather than taking another.
+	r.Broadcast(message.NewJSONMessage("three"), "room")
+	if ev := nextSSE(t, events); ev.data != `"three"` || ev.id != info.Token+".3" {
+		t.Errorf("live: got %+v, want three with id %s.3", ev, info.Token)
+	}
+}
@@ -0,0 +1,142 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// transport carries a connection that is not a WebSocket, for clients whose
+// network will not let one through; see sse.go and longpoll.go. Whatever
+// pumps the connection's queue writes to it as it would to the socket, so a
+// connection on a transport is a connection like any other: it joins groups,
+// receives broadcasts and direct sends, and is held to the same queue and
+// slow-consumer policy. What the client sends arrives as HTTP POSTs naming
+// the connection by its transport's token.
+type transport interface {
+	// token is the secret a client's POSTs name the connection by. It is
+	// only ever told to the client the connection is for.
+	token() string
+	remoteAddr() string
+
+	write(c *Connection, f Frame) error
+	ping() error
+	close(info CloseInfo) // tells the client c is closing, and why
+}
+
+// tokenParam is the query parameter a request names its connection's
+// transport token in.
+const tokenParam = "token"
+
+// openData tells a client on a transport its connection's ID and the token
+// to name it by.
+type openData struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// closeData tells a client on a transport why its connection closed.
+type closeData struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// byToken returns the registered connection whose transport has token.
+func (r *Registry) byToken(token string) (*Connection, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conn, ok := r.transports[token]
+	return conn, ok
+}
+
+// requested returns the connection req names by its transport token. It
+// answers the request itself, and returns ok false, if there is no such
+// connection or req does not authenticate as its user.
+func (r *Registry) requested(w http.ResponseWriter, req *http.Request) (conn *Connection, ok bool) {
+	conn, ok = r.byToken(req.URL.Query().Get(tokenParam))
+	if !ok {
+		http.Error(w, "unknown connection", http.StatusNotFound)
+		return nil, false
+	}
+	if conn.principal != nil {
+		p, ok := authenticate(conn.cfg.authenticator, conn.cfg.log(), w, req)
+		if !ok {
+			return nil, false
+		}
+		if p.UserID != conn.principal.UserID {
+			conn.logger().Warn("Request refused: connection belongs to another user", slog.String(LogRemoteAddr, req.RemoteAddr))
+			http.Error(w, "unknown connection", http.StatusNotFound)
+			return nil, false
+		}
+	}
+	return conn, true
+}
+
+// handlePost answers a POST of one inbound frame for a connection on a
+// transport: it is passed to the connection's MessageHandler as a frame read
+// off a socket would be, and a reply is queued like a read pump's. The body
+// is a binary frame if its Content-Type is application/octet-stream, and a
+// text frame otherwise. A POST must authenticate as the connection's user if
+// its handler has an Authenticator.
+func (r *Registry) handlePost(w http.ResponseWriter, req *http.Request) {
+	conn, ok := r.requested(w, req)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, conn.cfg.readLimit))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "message too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "reading message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	in := TextFrame(data)
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/octet-stream") {
+		in = BinaryFrame(data)
+	}
+	conn.cfg.metrics.MessageReceived(in.Type, len(in.Data))
+
+	if err := conn.receive(in); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receive handles one inbound frame for c, as the read pump does for a
+// WebSocket, one at a time. It returns an error if c is closed, or closed as
+// a result.
+func (c *Connection) receive(in Frame) error {
+	c.inbound.Lock()
+	defer c.inbound.Unlock()
+	select {
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+
+	if c.messageHandler == nil {
+		c.logger().Warn("No handler registered; message dropped", slog.Int("bytes", len(in.Data)))
+		return nil
+	}
+	reply, err := c.handle(in)
+	if err != nil {
+		c.logger().Warn("Handler error; closing connection", slog.Any(LogError, err))
+		c.noteClose(handlerCloseInfo(err))
+		c.CloseConnection()
+		return ErrConnectionClosed
+	}
+	if reply.Data != nil {
+		if err := c.queue(urgent(reply)); err != nil && !errors.Is(err, ErrMessageDropped) {
+			return err
+		}
+	}
+	return nil
+}
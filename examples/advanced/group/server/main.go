@@ -2,66 +2,52 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 
 	"github.com/gclluch/go-rtc-lib/connection"
-	"github.com/gclluch/go-rtc-lib/message"
 )
 
-// Custom WebSocket message handler that supports join/leave group operations and messaging
-type GroupMessageHandler struct {
-	registry *connection.Registry
+// Requests the clients send. The Router decodes each envelope's data into
+// one of these before calling the route.
+type groupReq struct {
+	Group string `json:"group"`
 }
 
-func (h *GroupMessageHandler) HandleMessage(conn *connection.Connection, msg []byte) ([]byte, error) {
-	// Parse the incoming JSON from client.
-	var parsedMsg struct {
-		Action  string `json:"action"`
-		Group   string `json:"group,omitempty"`
-		Message string `json:"message,omitempty"`
-	}
-	if err := json.Unmarshal(msg, &parsedMsg); err != nil {
-		log.Printf("Error parsing message: %v", err)
-		return nil, err
-	}
+type chatReq struct {
+	Group   string `json:"group"`
+	Message string `json:"message"`
+}
 
-	// Handle the message based on its action type.
-	switch parsedMsg.Action {
-	case "join":
-		// Join the specified group.
-		h.registry.AddToGroup(parsedMsg.Group, conn)
-		log.Printf("Connection %s joined group %s", conn.ID, parsedMsg.Group)
-	case "leave":
-		// Leave the specified group.
-		h.registry.RemoveFromGroup(parsedMsg.Group, conn)
-		log.Printf("Connection %s left group %s", conn.ID, parsedMsg.Group)
-	case "message":
-		// Broadcast the message to the group.
-		h.broadcastMessage(conn, parsedMsg.Group, parsedMsg.Message)
-	default:
-		log.Printf("Unknown action: %s", parsedMsg.Action)
-	}
+// newRouter wires join/leave/message to registry operations.
+func newRouter(registry *connection.Registry) *connection.Router {
+	router := connection.NewRouter()
 
-	return nil, nil
-}
+	connection.Handle(router, "join", func(conn *connection.Connection, req groupReq) (*groupReq, error) {
+		registry.AddToGroup(req.Group, conn)
+		log.Printf("Connection %s joined group %s", conn.ID, req.Group)
+		return &req, nil // Acknowledge the join.
+	})
 
-// Broadcasts a structured message to all connections in the specified group.
-func (h *GroupMessageHandler) broadcastMessage(conn *connection.Connection, groupName, messageContent string) {
-	msgData := map[string]string{
-		"from":    conn.ID,        // Sender ID
-		"message": messageContent, // The message text
-	}
+	connection.Handle(router, "leave", func(conn *connection.Connection, req groupReq) (*groupReq, error) {
+		registry.RemoveFromGroup(req.Group, conn)
+		log.Printf("Connection %s left group %s", conn.ID, req.Group)
+		return &req, nil
+	})
 
-	// Create a new JSONMessage instance with the content.
-	jsonMsg := message.NewJSONMessage(msgData)
-	log.Printf("Broadcasting structured message: %+v", jsonMsg)
+	connection.Handle(router, "message", func(conn *connection.Connection, req chatReq) (any, error) {
+		// Broadcast a structured message to everyone in the group, the
+		// sender included.
+		registry.Broadcast(connection.NewEnvelope("message", map[string]string{
+			"from":    conn.ID,     // Sender ID
+			"message": req.Message, // The message text
+		}), req.Group)
+		return nil, nil // The broadcast is the reply.
+	})
 
-	// Broadcast the JSON message to the specified group.
-	h.registry.Broadcast(jsonMsg, groupName)
+	return router
 }
 
 func main() {
@@ -71,9 +57,8 @@ func main() {
 	registry := connection.NewRegistry()
 	go registry.Run(ctx)
 
-	handler := &GroupMessageHandler{registry: registry}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", registry.RegisterHandler(handler))
+	mux.HandleFunc("/ws", registry.RegisterHandler(newRouter(registry)))
 
 	srv := &http.Server{Addr: ":8080", Handler: mux}
 	go func() {
@@ -3,8 +3,16 @@ module github.com/gclluch/go-rtc-lib
 go 1.22.0
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.2
+	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.36.1
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.17.0 // indirect
+)
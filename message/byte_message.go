@@ -1,6 +1,7 @@
 package message
 
-// ByteMessage represents a simple byte-based message.
+// ByteMessage represents a simple byte-based message. Its bytes are opaque, so
+// it is sent as a binary frame.
 type ByteMessage struct {
 	Data []byte
 }
@@ -17,3 +18,7 @@ func (m *ByteMessage) Deserialize(data []byte) error {
 func (m *ByteMessage) Type() string {
 	return "byte"
 }
+
+func (m *ByteMessage) Binary() bool {
+	return true
+}
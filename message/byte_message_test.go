@@ -24,3 +24,14 @@ func TestByteMessage_SerializeDeserialize(t *testing.T) {
 		t.Errorf("Original and deserialized messages are not equal. got = %v, want = %v", &deserializedMessage, originalMessage)
 	}
 }
+
+// Raw bytes are not guaranteed to be UTF-8, so a ByteMessage must go out as a
+// binary frame or a browser will reject it.
+func TestByteMessage_IsBinary(t *testing.T) {
+	if !IsBinary(&ByteMessage{}) {
+		t.Error("ByteMessage is not marked binary")
+	}
+	if IsBinary(&JSONMessage{}) {
+		t.Error("JSONMessage is marked binary")
+	}
+}
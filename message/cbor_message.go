@@ -0,0 +1,38 @@
+package message
+
+import "github.com/fxamacker/cbor/v2"
+
+// CBORMessage implements the IMessage interface for CBOR (RFC 8949) content.
+// CBOR is not text, so it is sent as a binary frame.
+type CBORMessage struct {
+	Content interface{} // Interface to hold any content.
+}
+
+func (m *CBORMessage) Serialize() ([]byte, error) {
+	return cbor.Marshal(m.Content)
+}
+
+// Deserialize decodes data into the value Content points to, or into Content
+// itself if it holds no pointer; see DecodeCBOR.
+func (m *CBORMessage) Deserialize(data []byte) error {
+	return cbor.Unmarshal(data, decodeTarget(&m.Content))
+}
+
+func (m *CBORMessage) Type() string {
+	return "cbor"
+}
+
+func (m *CBORMessage) Binary() bool { return true }
+
+func NewCBORMessage(data interface{}) *CBORMessage {
+	return &CBORMessage{
+		Content: data,
+	}
+}
+
+// DecodeCBOR decodes an inbound CBOR payload into a T.
+func DecodeCBOR[T any](data []byte) (T, error) {
+	var v T
+	err := NewCBORMessage(&v).Deserialize(data)
+	return v, err
+}
@@ -0,0 +1,78 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCBORMessage_SerializeDeserialize_Struct(t *testing.T) {
+	originalData := testStruct{
+		Name: "John Doe",
+		Age:  30,
+	}
+
+	msg := NewCBORMessage(originalData)
+
+	// Serialize
+	serializedData, err := msg.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	// Deserialize into a struct of the expected type
+	var deserializedData testStruct
+	if err := cbor.Unmarshal(serializedData, &deserializedData); err != nil {
+		t.Fatalf("Deserialize() error = %v", err)
+	}
+
+	if originalData != deserializedData {
+		t.Errorf("Original and deserialized data are not equal. got = %v, want = %v", deserializedData, originalData)
+	}
+}
+
+// TestCBORMessage_RoundTrip goes through Deserialize, both into untyped
+// Content and, via DecodeCBOR, into the sender's type.
+func TestCBORMessage_RoundTrip(t *testing.T) {
+	sent := NewCBORMessage(testStruct{Name: "Ann", Age: 5})
+
+	data, err := sent.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	received := &CBORMessage{}
+	if err := received.Deserialize(data); err != nil {
+		t.Fatalf("Deserialize() error = %v", err)
+	}
+	// Content is untyped, and CBOR map keys need not be strings, so the struct
+	// comes back as a map[interface{}]interface{} under its json tags.
+	m, ok := received.Content.(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("expected Content to be map[interface{}]interface{}, got %T", received.Content)
+	}
+	if m["name"] != "Ann" {
+		t.Errorf("got name = %v, want Ann", m["name"])
+	}
+	if m["age"] != uint64(5) {
+		t.Errorf("got age = %v (%T), want 5", m["age"], m["age"])
+	}
+
+	decoded, err := DecodeCBOR[testStruct](data)
+	if err != nil {
+		t.Fatalf("DecodeCBOR() error = %v", err)
+	}
+	if decoded != (testStruct{Name: "Ann", Age: 5}) {
+		t.Errorf("DecodeCBOR() got = %v", decoded)
+	}
+}
+
+func TestCBORMessage_Type(t *testing.T) {
+	msg := &CBORMessage{}
+	if messageType := msg.Type(); messageType != "cbor" {
+		t.Errorf("Type() got = %v, want = cbor", messageType)
+	}
+	if !IsBinary(msg) {
+		t.Error("CBORMessage is not marked binary")
+	}
+}
@@ -0,0 +1,96 @@
+package message
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec encodes values in one wire format. A connection that negotiated a
+// codec gets every Encodable message in it, whatever format the message itself
+// serializes to, so one Broadcast can reach browsers as JSON and native
+// clients as MessagePack.
+type Codec interface {
+	// Name identifies the codec in negotiation: it is the WebSocket
+	// subprotocol a client offers for it, and the name a hello message asks
+	// for.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// Binary reports whether the encoding is sent as binary frames.
+	Binary() bool
+}
+
+// The codecs for the encodings this package implements.
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+	CBOR    Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Binary() bool                               { return false }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                               { return "msgpack" }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return marshalMsgpack(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return unmarshalMsgpack(data, v) }
+func (msgpackCodec) Binary() bool                               { return true }
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string                               { return "cbor" }
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) Binary() bool                               { return true }
+
+// Encodable is implemented by an IMessage whose content is a plain value any
+// Codec can encode, as JSONMessage, MsgpackMessage and CBORMessage are. Other
+// messages - ByteMessage, ProtoMessage - go out in their own format to every
+// connection.
+type Encodable interface {
+	Value() interface{}
+}
+
+func (m *JSONMessage) Value() interface{}    { return m.Content }
+func (m *MsgpackMessage) Value() interface{} { return m.Content }
+func (m *CBORMessage) Value() interface{}    { return m.Content }
+
+// IsEncodable reports whether m's content can be encoded by any Codec,
+// looking through wrappers such as NoCompression.
+func IsEncodable(m IMessage) bool {
+	_, ok := valueOf(m)
+	return ok
+}
+
+// Encode serializes m with c if c is non-nil and m is Encodable, and with m's
+// own Serialize otherwise.
+func Encode(m IMessage, c Codec) ([]byte, error) {
+	if c != nil {
+		if v, ok := valueOf(m); ok {
+			return c.Marshal(v)
+		}
+	}
+	return m.Serialize()
+}
+
+// valueOf returns the content of m, or of the message it wraps, if that is
+// Encodable.
+func valueOf(m IMessage) (interface{}, bool) {
+	for m != nil {
+		if e, ok := m.(Encodable); ok {
+			return e.Value(), true
+		}
+		w, ok := m.(interface{ Unwrap() IMessage })
+		if !ok {
+			break
+		}
+		m = w.Unwrap()
+	}
+	return nil, false
+}
@@ -0,0 +1,46 @@
+package message
+
+import "testing"
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	for _, c := range []Codec{JSON, Msgpack, CBOR} {
+		data, err := c.Marshal(testStruct{Name: "Ann", Age: 5})
+		if err != nil {
+			t.Fatalf("%s: Marshal() error = %v", c.Name(), err)
+		}
+		var got testStruct
+		if err := c.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal() error = %v", c.Name(), err)
+		}
+		if got != (testStruct{Name: "Ann", Age: 5}) {
+			t.Errorf("%s: got = %v", c.Name(), got)
+		}
+	}
+}
+
+// Encode re-encodes a message's content in the codec asked for, and leaves a
+// message no codec can encode in its own format.
+func TestEncode(t *testing.T) {
+	msg := NoCompression(NewJSONMessage(testStruct{Name: "Ann", Age: 5}))
+	if !IsEncodable(msg) {
+		t.Fatal("NoCompression(JSONMessage) is not encodable")
+	}
+	data, err := Encode(msg, Msgpack)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if got, err := DecodeMsgpack[testStruct](data); err != nil || got.Name != "Ann" {
+		t.Errorf("Encode(msg, Msgpack) decoded to %v, %v", got, err)
+	}
+	if data, _ := Encode(msg, nil); string(data) != `{"name":"Ann","age":5}` {
+		t.Errorf("Encode(msg, nil) = %s, want the message's own JSON", data)
+	}
+
+	raw := &ByteMessage{Data: []byte{1}}
+	if IsEncodable(raw) {
+		t.Error("ByteMessage is encodable")
+	}
+	if data, _ := Encode(raw, Msgpack); string(data) != "\x01" {
+		t.Errorf("Encode(ByteMessage, Msgpack) = %q, want the bytes as they are", data)
+	}
+}
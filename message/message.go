@@ -1,8 +1,169 @@
 package message
 
+import "reflect"
+
 // IMessage represents a generic message interface.
 type IMessage interface {
 	Serialize() ([]byte, error) // Convert the message to a byte slice for sending.
 	Deserialize([]byte) error   // Populate the message fields from a byte slice.
 	Type() string               // Return the message type.
 }
+
+// Binary is implemented by an IMessage whose serialized form is not UTF-8 text
+// - protobuf, images, anything a browser would reject in a text frame. The
+// connection package sends such messages as binary WebSocket frames and every
+// other IMessage as text.
+type Binary interface {
+	Binary() bool
+}
+
+// IsBinary reports whether m should be sent as a binary frame.
+func IsBinary(m IMessage) bool {
+	b, ok := m.(Binary)
+	return ok && b.Binary()
+}
+
+// Uncompressed is implemented by an IMessage whose serialized form is not worth
+// compressing - JPEG, gzip, anything already compressed. The connection
+// package sends such messages uncompressed even on connections that negotiated
+// compression.
+type Uncompressed interface {
+	Uncompressed() bool
+}
+
+// IsUncompressed reports whether m should be sent uncompressed.
+func IsUncompressed(m IMessage) bool {
+	u, ok := m.(Uncompressed)
+	return ok && u.Uncompressed()
+}
+
+// NoCompression returns m marked to be sent uncompressed, for a message whose
+// type does not implement Uncompressed itself.
+func NoCompression(m IMessage) IMessage {
+	return uncompressed{m}
+}
+
+type uncompressed struct {
+	IMessage
+}
+
+func (uncompressed) Uncompressed() bool { return true }
+
+// Binary keeps m's frame type: embedding IMessage alone would hide its Binary
+// method.
+func (u uncompressed) Binary() bool { return IsBinary(u.IMessage) }
+
+// Unwrap returns the message u marks, so a Codec can still encode its content;
+// see Encode.
+func (u uncompressed) Unwrap() IMessage { return u.IMessage }
+
+// decodeTarget returns where a Deserialize should decode to: the value content
+// points to if it holds a non-nil pointer, as encoding/json does, and content
+// itself otherwise.
+func decodeTarget(content *interface{}) interface{} {
+	if v := reflect.ValueOf(*content); v.Kind() == reflect.Pointer && !v.IsNil() {
+		return *content
+	}
+	return content
+}
+
+// Keyed is implemented by an IMessage that carries current state for
+// something - a ticker symbol, a player, a dashboard tile - and so supersedes
+// any earlier message with the same conflation key. The connection package
+// replaces a keyed message still waiting to be written to a connection with a
+// newer one for the same key, so a client that falls behind catches up with
+// the latest state rather than every step to it.
+type Keyed interface {
+	ConflationKey() string
+}
+
+// ConflationKey returns m's conflation key, or "" if it has none, looking
+// through wrappers such as NoCompression.
+func ConflationKey(m IMessage) string {
+	for m != nil {
+		if k, ok := m.(Keyed); ok {
+			return k.ConflationKey()
+		}
+		w, ok := m.(interface{ Unwrap() IMessage })
+		if !ok {
+			break
+		}
+		m = w.Unwrap()
+	}
+	return ""
+}
+
+// WithConflationKey returns m marked with key, for a message whose type does
+// not implement Keyed itself. An empty key leaves m unmarked.
+func WithConflationKey(m IMessage, key string) IMessage {
+	if key == "" {
+		return m
+	}
+	return keyed{m, key}
+}
+
+type keyed struct {
+	IMessage
+	key string
+}
+
+func (k keyed) ConflationKey() string { return k.key }
+
+// Binary and Uncompressed keep m's, as for NoCompression.
+func (k keyed) Binary() bool       { return IsBinary(k.IMessage) }
+func (k keyed) Uncompressed() bool { return IsUncompressed(k.IMessage) }
+
+// Unwrap returns the message k marks; see Encode.
+func (k keyed) Unwrap() IMessage { return k.IMessage }
+
+// Priority orders a connection's outbound messages: the connection package
+// writes a higher-priority message ahead of lower-priority ones queued before
+// it. The zero value is PriorityNormal.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1 // chatter that can wait: typing indicators, telemetry
+	PriorityNormal Priority = 0  // everything not marked otherwise
+	PriorityHigh   Priority = 1  // what a client is waiting on: replies, kicks, alerts
+)
+
+// Prioritized is implemented by an IMessage that is not of normal priority.
+type Prioritized interface {
+	Priority() Priority
+}
+
+// PriorityOf returns m's priority, looking through wrappers such as
+// NoCompression, and PriorityNormal if it has none.
+func PriorityOf(m IMessage) Priority {
+	for m != nil {
+		if p, ok := m.(Prioritized); ok {
+			return p.Priority()
+		}
+		w, ok := m.(interface{ Unwrap() IMessage })
+		if !ok {
+			break
+		}
+		m = w.Unwrap()
+	}
+	return PriorityNormal
+}
+
+// WithPriority returns m marked with priority p, for a message whose type does
+// not implement Prioritized itself.
+func WithPriority(m IMessage, p Priority) IMessage {
+	return prioritized{m, p}
+}
+
+type prioritized struct {
+	IMessage
+	p Priority
+}
+
+func (m prioritized) Priority() Priority { return m.p }
+
+// Binary and Uncompressed keep m's, as for NoCompression.
+func (m prioritized) Binary() bool       { return IsBinary(m.IMessage) }
+func (m prioritized) Uncompressed() bool { return IsUncompressed(m.IMessage) }
+
+// Unwrap returns the message m marks; see Encode.
+func (m prioritized) Unwrap() IMessage { return m.IMessage }
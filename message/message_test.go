@@ -0,0 +1,49 @@
+package message
+
+import "testing"
+
+func TestNoCompressionKeepsTheFrameType(t *testing.T) {
+	bin := NoCompression(&ByteMessage{Data: []byte{1}})
+	if !IsUncompressed(bin) || !IsBinary(bin) {
+		t.Error("NoCompression(ByteMessage) is not uncompressed binary")
+	}
+	text := NoCompression(NewJSONMessage(1))
+	if !IsUncompressed(text) || IsBinary(text) {
+		t.Error("NoCompression(JSONMessage) is not uncompressed text")
+	}
+	if IsUncompressed(NewJSONMessage(1)) {
+		t.Error("JSONMessage is marked uncompressed")
+	}
+}
+
+func TestConflationKeyLooksThroughWrappers(t *testing.T) {
+	msg := NoCompression(WithConflationKey(&ByteMessage{Data: []byte{1}}, "ACME"))
+	if got := ConflationKey(msg); got != "ACME" {
+		t.Errorf("ConflationKey = %q, want ACME", got)
+	}
+	if !IsBinary(msg) || !IsUncompressed(msg) {
+		t.Error("WithConflationKey hid the frame type")
+	}
+	if !IsEncodable(WithConflationKey(NewJSONMessage(1), "k")) {
+		t.Error("WithConflationKey(JSONMessage) is not encodable")
+	}
+	if got := ConflationKey(NewJSONMessage(1)); got != "" {
+		t.Errorf("unkeyed message has key %q", got)
+	}
+	if got := ConflationKey(WithConflationKey(msg, "")); got != "ACME" {
+		t.Errorf("an empty key hid the inner one: got %q, want ACME", got)
+	}
+}
+
+func TestPriorityLooksThroughWrappers(t *testing.T) {
+	msg := WithConflationKey(WithPriority(&ByteMessage{Data: []byte{1}}, PriorityHigh), "k")
+	if got := PriorityOf(msg); got != PriorityHigh {
+		t.Errorf("PriorityOf = %d, want high", got)
+	}
+	if !IsBinary(msg) || ConflationKey(msg) != "k" {
+		t.Error("WithPriority hid the frame type or key")
+	}
+	if got := PriorityOf(NewJSONMessage(1)); got != PriorityNormal {
+		t.Errorf("unmarked message has priority %d", got)
+	}
+}
@@ -0,0 +1,63 @@
+package message
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackMessage implements the IMessage interface for MessagePack content.
+// MessagePack is not text, so it is sent as a binary frame. A struct field
+// without a msgpack tag is keyed by its json tag, as in CBOR, so a struct has
+// the same keys in every encoding.
+type MsgpackMessage struct {
+	Content interface{} // Interface to hold any content.
+}
+
+func (m *MsgpackMessage) Serialize() ([]byte, error) {
+	return marshalMsgpack(m.Content)
+}
+
+// Deserialize decodes data into the value Content points to, or into Content
+// itself if it holds no pointer; see DecodeMsgpack.
+func (m *MsgpackMessage) Deserialize(data []byte) error {
+	return unmarshalMsgpack(data, decodeTarget(&m.Content))
+}
+
+func (m *MsgpackMessage) Type() string {
+	return "msgpack"
+}
+
+func (m *MsgpackMessage) Binary() bool { return true }
+
+func NewMsgpackMessage(data interface{}) *MsgpackMessage {
+	return &MsgpackMessage{
+		Content: data,
+	}
+}
+
+// DecodeMsgpack decodes an inbound MessagePack payload into a T.
+func DecodeMsgpack[T any](data []byte) (T, error) {
+	var v T
+	err := NewMsgpackMessage(&v).Deserialize(data)
+	return v, err
+}
+
+// marshalMsgpack encodes v, falling back on json tags; see MsgpackMessage.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalMsgpack decodes data into v, falling back on json tags.
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,71 @@
+package message
+
+import "testing"
+
+func TestMsgpackMessage_SerializeDeserialize_Struct(t *testing.T) {
+	originalData := testStruct{
+		Name: "John Doe",
+		Age:  30,
+	}
+
+	msg := NewMsgpackMessage(originalData)
+
+	// Serialize
+	serializedData, err := msg.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	// Deserialize into a struct of the expected type
+	var deserializedData testStruct
+	if err := unmarshalMsgpack(serializedData, &deserializedData); err != nil {
+		t.Fatalf("Deserialize() error = %v", err)
+	}
+
+	if originalData != deserializedData {
+		t.Errorf("Original and deserialized data are not equal. got = %v, want = %v", deserializedData, originalData)
+	}
+}
+
+// TestMsgpackMessage_RoundTrip goes through Deserialize, both into untyped
+// Content and, via DecodeMsgpack, into the sender's type.
+func TestMsgpackMessage_RoundTrip(t *testing.T) {
+	sent := NewMsgpackMessage(testStruct{Name: "Ann", Age: 5})
+
+	data, err := sent.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	received := &MsgpackMessage{}
+	if err := received.Deserialize(data); err != nil {
+		t.Fatalf("Deserialize() error = %v", err)
+	}
+	// Content is untyped, so the struct comes back as a map keyed by the
+	// fields' json names.
+	m, ok := received.Content.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected Content to be map[string]interface{}, got %T", received.Content)
+	}
+	if m["name"] != "Ann" {
+		t.Errorf("got name = %v, want Ann", m["name"])
+	}
+
+	decoded, err := DecodeMsgpack[testStruct](data)
+	if err != nil {
+		t.Fatalf("DecodeMsgpack() error = %v", err)
+	}
+	if decoded != (testStruct{Name: "Ann", Age: 5}) {
+		t.Errorf("DecodeMsgpack() got = %v", decoded)
+	}
+}
+
+func TestMsgpackMessage_Type(t *testing.T) {
+	msg := &MsgpackMessage{}
+	if messageType := msg.Type(); messageType != "msgpack" {
+		t.Errorf("Type() got = %v, want = msgpack", messageType)
+	}
+	if !IsBinary(msg) {
+		t.Error("MsgpackMessage is not marked binary")
+	}
+}
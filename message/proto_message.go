@@ -0,0 +1,50 @@
+package message
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoMessage implements the IMessage interface for any protobuf message.
+// The wire format is not text, so it is sent as a binary frame.
+type ProtoMessage struct {
+	Message proto.Message
+}
+
+func (m *ProtoMessage) Serialize() ([]byte, error) {
+	return proto.Marshal(m.Message)
+}
+
+// Deserialize decodes data into Message, which must be non-nil: protobuf
+// needs to know the message type to decode.
+func (m *ProtoMessage) Deserialize(data []byte) error {
+	if m.Message == nil {
+		return errors.New("message: ProtoMessage has no Message to decode into")
+	}
+	return proto.Unmarshal(data, m.Message)
+}
+
+func (m *ProtoMessage) Type() string {
+	return "proto"
+}
+
+func (m *ProtoMessage) Binary() bool { return true }
+
+func NewProtoMessage(msg proto.Message) *ProtoMessage {
+	return &ProtoMessage{
+		Message: msg,
+	}
+}
+
+// DecodeProto decodes an inbound protobuf payload into a new T:
+//
+//	tick, err := message.DecodeProto[pb.Tick](data) // tick is a *pb.Tick
+func DecodeProto[T any, P interface {
+	*T
+	proto.Message
+}](data []byte) (P, error) {
+	p := P(new(T))
+	err := NewProtoMessage(p).Deserialize(data)
+	return p, err
+}
@@ -0,0 +1,53 @@
+package message
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestProtoMessage_SerializeDeserialize(t *testing.T) {
+	original, err := structpb.NewStruct(map[string]interface{}{"name": "John Doe", "age": 30})
+	if err != nil {
+		t.Fatalf("NewStruct() error = %v", err)
+	}
+
+	serializedData, err := NewProtoMessage(original).Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	received := NewProtoMessage(&structpb.Struct{})
+	if err := received.Deserialize(serializedData); err != nil {
+		t.Fatalf("Deserialize() error = %v", err)
+	}
+	if !proto.Equal(original, received.Message) {
+		t.Errorf("Original and deserialized messages are not equal. got = %v, want = %v", received.Message, original)
+	}
+
+	decoded, err := DecodeProto[structpb.Struct](serializedData)
+	if err != nil {
+		t.Fatalf("DecodeProto() error = %v", err)
+	}
+	if decoded.Fields["name"].GetStringValue() != "John Doe" {
+		t.Errorf("DecodeProto() got = %v", decoded)
+	}
+}
+
+// Protobuf cannot decode without knowing the message type.
+func TestProtoMessage_DeserializeNeedsAMessage(t *testing.T) {
+	if err := (&ProtoMessage{}).Deserialize([]byte{}); err == nil {
+		t.Error("Deserialize() into a nil Message succeeded")
+	}
+}
+
+func TestProtoMessage_Type(t *testing.T) {
+	msg := &ProtoMessage{}
+	if messageType := msg.Type(); messageType != "proto" {
+		t.Errorf("Type() got = %v, want = proto", messageType)
+	}
+	if !IsBinary(msg) {
+		t.Error("ProtoMessage is not marked binary")
+	}
+}
@@ -0,0 +1,302 @@
+// Package prommetrics implements connection.Metrics and serves what it
+// measured in the Prometheus text exposition format, without depending on the
+// Prometheus client library:
+//
+//	m := prommetrics.New(prommetrics.DefaultNamespace)
+//	reg := connection.NewRegistry(connection.WithMetrics(m))
+//	http.Handle("/metrics", m)
+package prommetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultNamespace prefixes every metric name unless New is given another.
+const DefaultNamespace = "rtc"
+
+// ContentType is the Content-Type of the exposition ServeHTTP writes.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Histogram buckets. Broadcast durations span a single local connection to
+// tens of thousands; queue depths span the default 256-frame send buffer and
+// the larger ones WithSendBuffer allows.
+var (
+	durationBuckets  = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	recipientBuckets = []float64{1, 10, 100, 1000, 10000, 100000}
+	depthBuckets     = []float64{1, 4, 16, 64, 256, 1024, 4096}
+)
+
+// Metrics counts what a Registry reports and serves it to Prometheus. The zero
+// value is not usable; call New.
+type Metrics struct {
+	ns string
+
+	connections atomic.Int64
+	evictions   atomic.Uint64
+
+	mu       sync.Mutex
+	upgrades map[string]uint64 // by result
+	closes   map[int]uint64    // by close code
+	members  map[string]int    // by group
+	slow     map[string]uint64 // by slow-consumer action
+
+	// By frame type: text, then binary.
+	received, receivedBytes [2]atomic.Uint64
+	sent, sentBytes         [2]atomic.Uint64
+
+	queueDepth          *histogram
+	broadcastDuration   *histogram
+	broadcastRecipients *histogram
+}
+
+var _ connection.Metrics = (*Metrics)(nil)
+
+// New returns a Metrics whose metric names start with namespace and an
+// underscore, or with nothing if namespace is empty.
+func New(namespace string) *Metrics {
+	if namespace != "" {
+		namespace += "_"
+	}
+	return &Metrics{
+		ns:                  namespace,
+		upgrades:            make(map[string]uint64),
+		closes:              make(map[int]uint64),
+		members:             make(map[string]int),
+		slow:                make(map[string]uint64),
+		queueDepth:          newHistogram(depthBuckets),
+		broadcastDuration:   newHistogram(durationBuckets),
+		broadcastRecipients: newHistogram(recipientBuckets),
+	}
+}
+
+// Upgrade implements connection.Metrics.
+func (m *Metrics) Upgrade(result string) {
+	m.mu.Lock()
+	m.upgrades[result]++
+	m.mu.Unlock()
+}
+
+// ConnectionOpened implements connection.Metrics.
+func (m *Metrics) ConnectionOpened() {
+	m.connections.Add(1)
+}
+
+// ConnectionClosed implements connection.Metrics.
+func (m *Metrics) ConnectionClosed(info connection.CloseInfo) {
+	m.connections.Add(-1)
+	if info.SlowConsumer {
+		m.evictions.Add(1)
+	}
+	m.mu.Lock()
+	m.closes[info.Code]++
+	m.mu.Unlock()
+}
+
+// GroupMembers implements connection.Metrics.
+func (m *Metrics) GroupMembers(group string, members int) {
+	m.mu.Lock()
+	m.members[group] = members
+	m.mu.Unlock()
+}
+
+// GroupDeleted implements connection.Metrics. The group's series is dropped
+// rather than left at zero, so deleted groups do not accumulate.
+func (m *Metrics) GroupDeleted(group string) {
+	m.mu.Lock()
+	delete(m.members, group)
+	m.mu.Unlock()
+}
+
+// MessageReceived implements connection.Metrics.
+func (m *Metrics) MessageReceived(frameType, size int) {
+	i := typeIndex(frameType)
+	m.received[i].Add(1)
+	m.receivedBytes[i].Add(uint64(size))
+}
+
+// MessageSent implements connection.Metrics.
+func (m *Metrics) MessageSent(frameType, size int) {
+	i := typeIndex(frameType)
+	m.sent[i].Add(1)
+	m.sentBytes[i].Add(uint64(size))
+}
+
+// QueueDepth implements connection.Metrics.
+func (m *Metrics) QueueDepth(depth int) {
+	m.queueDepth.observe(float64(depth))
+}
+
+// Broadcast implements connection.Metrics.
+func (m *Metrics) Broadcast(recipients int, elapsed time.Duration) {
+	m.broadcastDuration.observe(elapsed.Seconds())
+	m.broadcastRecipients.observe(float64(recipients))
+}
+
+// SlowConsumer implements connection.Metrics.
+func (m *Metrics) SlowConsumer(action string, n int) {
+	m.mu.Lock()
+	m.slow[action] += uint64(n)
+	m.mu.Unlock()
+}
+
+func typeIndex(frameType int) int {
+	if frameType == websocket.BinaryMessage {
+		return 1
+	}
+	return 0
+}
+
+var typeNames = [2]string{"text", "binary"}
+
+// ServeHTTP writes the current values in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo writes the current values to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	e := &encoder{ns: m.ns}
+
+	e.family("connections", "gauge", "Open WebSocket connections.")
+	e.sample("connections", nil, float64(m.connections.Load()))
+
+	m.mu.Lock()
+	e.family("upgrades_total", "counter", "Upgrade requests, by result.")
+	for _, result := range sortedKeys(m.upgrades) {
+		e.sample("upgrades_total", []string{"result", result}, float64(m.upgrades[result]))
+	}
+	e.family("connections_closed_total", "counter", "Closed connections, by WebSocket close code.")
+	codes := make([]int, 0, len(m.closes))
+	for code := range m.closes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		e.sample("connections_closed_total", []string{"code", strconv.Itoa(code)}, float64(m.closes[code]))
+	}
+	e.family("group_members", "gauge", "Connections in each group.")
+	for _, group := range sortedKeys(m.members) {
+		e.sample("group_members", []string{"group", group}, float64(m.members[group]))
+	}
+	e.family("slow_consumer_actions_total", "counter", "What full send queues led to, by action: closed, dropped_newest, dropped_oldest, conflated, blocked or timed_out.")
+	for _, action := range sortedKeys(m.slow) {
+		e.sample("slow_consumer_actions_total", []string{"action", action}, float64(m.slow[action]))
+	}
+	m.mu.Unlock()
+
+	e.family("slow_consumer_evictions_total", "counter", "Connections closed for not draining their send queue.")
+	e.sample("slow_consumer_evictions_total", nil, float64(m.evictions.Load()))
+
+	for _, c := range []struct {
+		name, help string
+		values     *[2]atomic.Uint64
+	}{
+		{"messages_received_total", "Data frames read, by frame type.", &m.received},
+		{"received_bytes_total", "Payload bytes read, by frame type.", &m.receivedBytes},
+		{"messages_sent_total", "Data frames written, by frame type.", &m.sent},
+		{"sent_bytes_total", "Payload bytes written, by frame type.", &m.sentBytes},
+	} {
+		e.family(c.name, "counter", c.help)
+		for i := range c.values {
+			e.sample(c.name, []string{"type", typeNames[i]}, float64(c.values[i].Load()))
+		}
+	}
+
+	e.histogram("send_queue_depth", "Frames in a connection's send queue after each enqueue.", m.queueDepth)
+	e.histogram("broadcast_duration_seconds", "Time to queue a broadcast for its local recipients.", m.broadcastDuration)
+	e.histogram("broadcast_recipients", "Local recipients of each broadcast.", m.broadcastRecipients)
+
+	n, err := io.WriteString(w, e.b.String())
+	return int64(n), err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// histogram is a Prometheus histogram safe for concurrent observation.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, not cumulative; the last is +Inf
+	sum    atomic.Uint64   // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // the first bound >= v
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// encoder builds an exposition.
+type encoder struct {
+	ns string
+	b  strings.Builder
+}
+
+func (e *encoder) family(name, typ, help string) {
+	fmt.Fprintf(&e.b, "# HELP %s%s %s\n# TYPE %s%s %s\n", e.ns, name, help, e.ns, name, typ)
+}
+
+// sample writes one line; labels alternate names and values.
+func (e *encoder) sample(name string, labels []string, v float64) {
+	e.b.WriteString(e.ns)
+	e.b.WriteString(name)
+	if len(labels) > 0 {
+		e.b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				e.b.WriteByte(',')
+			}
+			fmt.Fprintf(&e.b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		e.b.WriteByte('}')
+	}
+	e.b.WriteByte(' ')
+	e.b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	e.b.WriteByte('\n')
+}
+
+func (e *encoder) histogram(name, help string, h *histogram) {
+	e.family(name, "histogram", help)
+	// The count is the buckets' total rather than a counter of its own, so
+	// a scrape racing an observation still sees buckets that add up.
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		e.sample(name+"_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(cumulative))
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	e.sample(name+"_bucket", []string{"le", "+Inf"}, float64(cumulative))
+	e.sample(name+"_sum", nil, math.Float64frombits(h.sum.Load()))
+	e.sample(name+"_count", nil, float64(cumulative))
+}
+
+// labelEscaper escapes a label value as the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
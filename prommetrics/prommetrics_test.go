@@ -0,0 +1,166 @@
+package prommetrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gclluch/go-rtc-lib/prommetrics"
+)
+
+// scrape fetches the exposition from srv.
+func scrape(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != prommetrics.ContentType {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// waitFor scrapes until every line is in the exposition.
+func waitFor(t *testing.T, srv *httptest.Server, lines ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := scrape(t, srv)
+		missing := ""
+		for _, line := range lines {
+			if !strings.Contains(body, "\n"+line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %q in:\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistryReportsToPrometheus(t *testing.T) {
+	m := prommetrics.New(prommetrics.DefaultNamespace)
+	metrics := httptest.NewServer(m)
+	defer metrics.Close()
+
+	r := connection.NewRegistry(connection.WithMetrics(m))
+	r.Hooks.OnConnect = func(c *connection.Connection) { r.AddToGroup("lobby", c) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	srv := httptest.NewServer(r.RegisterHandler(nil, connection.WithNopLogger()))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	waitFor(t, metrics, `rtc_group_members{group="lobby"} 1`)
+
+	ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	r.Broadcast(message.NewJSONMessage("hi"), "lobby")
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != `"hi"` {
+		t.Fatalf("read: %q, %v", data, err)
+	}
+
+	waitFor(t, metrics,
+		`rtc_connections 1`,
+		`rtc_upgrades_total{result="ok"} 1`,
+		`rtc_messages_received_total{type="text"} 1`,
+		`rtc_received_bytes_total{type="text"} 5`,
+		`rtc_messages_sent_total{type="text"} 1`,
+		`rtc_sent_bytes_total{type="text"} 4`,
+		`rtc_broadcast_recipients_count 1`,
+		`rtc_send_queue_depth_count 1`,
+	)
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor(t, metrics,
+		`rtc_connections 0`,
+		`rtc_connections_closed_total{code="1000"} 1`,
+		`rtc_group_members{group="lobby"} 0`,
+	)
+
+	r.DeleteGroup("lobby")
+	if body := scrape(t, metrics); strings.Contains(body, `group="lobby"`) {
+		t.Fatalf("deleted group still exported:\n%s", body)
+	}
+}
+
+func TestUpgradeFailuresByReason(t *testing.T) {
+	m := prommetrics.New("")
+	metrics := httptest.NewServer(m)
+	defer metrics.Close()
+
+	reject := connection.AuthenticatorFunc(func(*http.Request) (*connection.Principal, error) {
+		return nil, connection.ErrNoToken
+	})
+	r := connection.NewRegistry(connection.WithMetrics(m))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	open := httptest.NewServer(r.RegisterHandler(nil))
+	defer open.Close()
+	closed := httptest.NewServer(r.RegisterHandler(nil, connection.WithAuthenticator(reject)))
+	defer closed.Close()
+
+	open.Client().Get(open.URL) // a plain GET is no handshake
+	websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(open.URL, "http"), http.Header{"Origin": {"https://elsewhere.example"}})
+	websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(closed.URL, "http"), nil)
+
+	waitFor(t, metrics,
+		`upgrades_total{result="handshake"} 1`,
+		`upgrades_total{result="origin"} 1`,
+		`upgrades_total{result="unauthorized"} 1`,
+	)
+}
+
+func TestExposition(t *testing.T) {
+	m := prommetrics.New("x")
+	m.GroupMembers("a \"b\"\n\\", 2)
+	m.Broadcast(3, 2*time.Millisecond)
+	m.Broadcast(300, 2*time.Second)
+	m.ConnectionOpened()
+	m.ConnectionClosed(connection.CloseInfo{Code: websocket.ClosePolicyViolation, SlowConsumer: true})
+	m.SlowConsumer(connection.SlowConsumerConflated, 3)
+	m.SlowConsumer(connection.SlowConsumerConflated, 2)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, line := range []string{
+		"# TYPE x_broadcast_duration_seconds histogram",
+		`x_group_members{group="a \"b\"\n\\"} 2`,
+		`x_broadcast_duration_seconds_bucket{le="0.001"} 0`,
+		`x_broadcast_duration_seconds_bucket{le="0.0025"} 1`,
+		`x_broadcast_duration_seconds_bucket{le="1"} 1`,
+		`x_broadcast_duration_seconds_bucket{le="+Inf"} 2`,
+		`x_broadcast_duration_seconds_sum 2.002`,
+		`x_broadcast_duration_seconds_count 2`,
+		`x_broadcast_recipients_bucket{le="10"} 1`,
+		`x_connections 0`,
+		`x_slow_consumer_evictions_total 1`,
+		`x_slow_consumer_actions_total{action="conflated"} 5`,
+		`x_connections_closed_total{code="1008"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("no %q in:\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package redisbackplane is a connection.Backplane over Redis pub/sub, for
+// running several replicas of a go-rtc-lib server behind a load balancer:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "redis:6379"})
+//	reg := connection.NewRegistry(connection.WithBackplane(redisbackplane.New(client, "rtc")))
+//
+// Every replica publishes to and subscribes to the same channel. Pub/sub is
+// fire-and-forget: a replica that is disconnected from Redis misses what is
+// published meanwhile, just as a client that is disconnected misses a plain
+// broadcast.
+package redisbackplane
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the channel New uses for an empty name.
+const DefaultChannel = "go-rtc-lib"
+
+// Backplane publishes to and subscribes to one Redis channel.
+type Backplane struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+// New returns a Backplane on channel, or on DefaultChannel if channel is
+// empty. Replicas that should share groups must use the same channel; a
+// separate one per service keeps services on one Redis apart.
+func New(client redis.UniversalClient, channel string) *Backplane {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	return &Backplane{client: client, channel: channel}
+}
+
+// Publish publishes payload on the channel.
+func (b *Backplane) Publish(ctx context.Context, payload []byte) error {
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe subscribes to the channel and returns once Redis has confirmed
+// it. Messages are then passed to deliver, in order, until ctx ends. The
+// client reconnects and resubscribes on its own if the connection drops.
+func (b *Backplane) Subscribe(ctx context.Context, deliver func(payload []byte)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+
+	messages := sub.Channel()
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				deliver([]byte(m.Payload))
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,119 @@
+package redisbackplane_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/gclluch/go-rtc-lib/connection"
+	"github.com/gclluch/go-rtc-lib/message"
+	"github.com/gclluch/go-rtc-lib/redisbackplane"
+)
+
+func newClient(t *testing.T, mr *miniredis.Miniredis) *redis.Client {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestPublishReachesSubscribers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := redisbackplane.New(newClient(t, mr), "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan string, 1)
+	if err := b.Subscribe(ctx, func(p []byte) { got <- string(p) }); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := b.Publish(ctx, []byte("hello")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	select {
+	case p := <-got:
+		if p != "hello" {
+			t.Fatalf("got %q, want hello", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing was delivered")
+	}
+}
+
+// joinHandler puts each connection in "room" on its first message and
+// confirms with "joined".
+type joinHandler struct{ reg *connection.Registry }
+
+func (h joinHandler) HandleMessage(conn *connection.Connection, msg []byte) ([]byte, error) {
+	h.reg.AddToGroup("room", conn)
+	return []byte("joined"), nil
+}
+
+// replica runs a Registry on the shared Redis and returns a client connected
+// to it and already in "room".
+func replica(t *testing.T, ctx context.Context, mr *miniredis.Miniredis) (*connection.Registry, *websocket.Conn) {
+	t.Helper()
+	reg := connection.NewRegistry(connection.WithBackplane(redisbackplane.New(newClient(t, mr), "rtc")))
+	go reg.Run(ctx)
+
+	srv := httptest.NewServer(reg.RegisterHandler(joinHandler{reg}))
+	t.Cleanup(srv.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	ws.WriteMessage(websocket.TextMessage, []byte("join"))
+	if got := read(t, ws); got != "joined" {
+		t.Fatalf("got %q, want joined", got)
+	}
+	return reg, ws
+}
+
+func read(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(data)
+}
+
+func TestBroadcastSpansReplicasOverRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, here := replica(t, ctx, mr)
+	_, there := replica(t, ctx, mr)
+	for deadline := time.Now().Add(2 * time.Second); mr.PubSubNumSub("rtc")["rtc"] < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the replicas never subscribed")
+		}
+	}
+
+	first.Broadcast(message.NewJSONMessage("one"), "room")
+	first.Broadcast(message.NewJSONMessage("two"), "room")
+
+	// In order, and once each: the publishing replica drops its own copy when
+	// Redis echoes it back.
+	for _, ws := range []*websocket.Conn{here, there} {
+		for _, want := range []string{`"one"`, `"two"`} {
+			if got := read(t, ws); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		}
+	}
+	here.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := here.ReadMessage(); err == nil {
+		t.Fatalf("got %s, want no duplicate", data)
+	}
+}